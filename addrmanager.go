@@ -0,0 +1,112 @@
+package main
+
+import (
+	"container/heap"
+	"math"
+	"sync"
+)
+
+// Queue of addresses to connect to, popped by decreasing priority. Addresses
+// with the same priority are popped in the order they were pushed. Safe for
+// concurrent use
+type AddressManager struct {
+	mu     sync.Mutex
+	ready  *sync.Cond // Signalled when an address is pushed or on Close
+	queue  addressQueue
+	pushed uint64 // Number of addresses pushed, orders equal priorities
+	closed bool
+}
+
+// Address waiting in an AddressManager
+type queuedAddress struct {
+	addr     ip_port
+	priority float64
+	seq      uint64
+}
+
+// heap.Interface of queued addresses, highest priority first
+type addressQueue []queuedAddress
+
+func (q addressQueue) Len() int { return len(q) }
+
+func (q addressQueue) Less(i, j int) bool {
+	if q[i].priority != q[j].priority {
+		return q[i].priority > q[j].priority
+	}
+	return q[i].seq < q[j].seq
+}
+
+func (q addressQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+
+func (q *addressQueue) Push(x interface{}) { *q = append(*q, x.(queuedAddress)) }
+
+func (q *addressQueue) Pop() interface{} {
+	old := *q
+	item := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return item
+}
+
+// Create an empty AddressManager
+func NewAddressManager() *AddressManager {
+	m := &AddressManager{}
+	m.ready = sync.NewCond(&m.mu)
+
+	return m
+}
+
+// Queue an address. Addresses pushed after Close are dropped
+func (m *AddressManager) Push(addr ip_port, priority float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return
+	}
+
+	heap.Push(&m.queue, queuedAddress{addr, priority, m.pushed})
+	m.pushed++
+	m.ready.Signal()
+}
+
+// Remove the address with the highest priority, waiting for one to be pushed
+// if the queue is empty. Returns the zero ip_port once the manager is closed
+// and empty
+func (m *AddressManager) Pop() ip_port {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for len(m.queue) == 0 && !m.closed {
+		m.ready.Wait()
+	}
+	if len(m.queue) == 0 {
+		return ip_port{}
+	}
+
+	return heap.Pop(&m.queue).(queuedAddress).addr
+}
+
+// Number of queued addresses
+func (m *AddressManager) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return len(m.queue)
+}
+
+// Stop accepting addresses. Queued addresses can still be popped
+func (m *AddressManager) Close() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.closed = true
+	m.ready.Broadcast()
+}
+
+// Priority of refreshing a node: the hours it is overdue, plus a bonus for
+// nodes which were often online and for nodes which advertise many peers
+func addressPriority(next_refresh, now int64, uptime float64, peers int) float64 {
+	overdue := float64(now-next_refresh) / 3600
+
+	return overdue + PRIORITY_UPTIME_WEIGHT*uptime + PRIORITY_PEERS_WEIGHT*math.Log2(1+float64(peers))
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAddressManager(t *testing.T) {
+	m := NewAddressManager()
+
+	m.Push(ip_port{"1.1.1.1", "1"}, 1)
+	m.Push(ip_port{"2.2.2.2", "2"}, 5)
+	m.Push(ip_port{"3.3.3.3", "3"}, 1) // Same priority as 1.1.1.1, pushed later
+	m.Push(ip_port{"4.4.4.4", "4"}, PRIORITY_BOOTSTRAP)
+
+	if m.Len() != 4 {
+		t.Error("Expected 4 queued addresses got ", m.Len())
+	}
+
+	expected := []ip_port{{"4.4.4.4", "4"}, {"2.2.2.2", "2"}, {"1.1.1.1", "1"}, {"3.3.3.3", "3"}}
+	got := make([]ip_port, 0)
+	for i := 0; i < 4; i++ {
+		got = append(got, m.Pop())
+	}
+	if !reflect.DeepEqual(expected, got) {
+		t.Error("Expected addresses popped in order ", expected, " got ", got)
+	}
+
+	// TEST: Pop waits for an address
+	popped := make(chan ip_port)
+	go func() { popped <- m.Pop() }()
+
+	time.Sleep(10 * time.Millisecond)
+	m.Push(ip_port{"5.5.5.5", "5"}, 0)
+	if addr := <-popped; addr != (ip_port{"5.5.5.5", "5"}) {
+		t.Error("Expected pushed address got ", addr)
+	}
+
+	// TEST: Queued addresses are popped after Close, then Pop stops waiting
+	m.Push(ip_port{"6.6.6.6", "6"}, 0)
+	m.Close()
+	m.Push(ip_port{"7.7.7.7", "7"}, 0) // Dropped
+
+	if addr := m.Pop(); addr != (ip_port{"6.6.6.6", "6"}) {
+		t.Error("Expected address queued before Close got ", addr)
+	}
+	if addr := m.Pop(); addr != (ip_port{}) {
+		t.Error("Expected zero address after Close got ", addr)
+	}
+}
+
+func TestAddressManagerConcurrent(t *testing.T) {
+	m := NewAddressManager()
+
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				m.Push(ip_port{"1.1.1.1", "1"}, float64(i*j))
+			}
+		}(i)
+	}
+
+	count := make(chan int)
+	go func() {
+		n := 0
+		for m.Pop() != (ip_port{}) {
+			n++
+		}
+		count <- n
+	}()
+
+	wg.Wait()
+	m.Close()
+
+	if n := <-count; n != 1000 {
+		t.Error("Expected 1000 addresses popped got ", n)
+	}
+}
+
+func TestAddressPriority(t *testing.T) {
+	now := int64(1600000000)
+
+	// More overdue first
+	if addressPriority(now-7200, now, 0, 0) <= addressPriority(now-3600, now, 0, 0) {
+		t.Error("Expected more overdue node to have a higher priority")
+	}
+	// Then more often online and advertising more peers
+	if addressPriority(now, now, 1, 0) <= addressPriority(now, now, 0.5, 0) {
+		t.Error("Expected node with higher uptime to have a higher priority")
+	}
+	if addressPriority(now, now, 0, 1000) <= addressPriority(now, now, 0, 10) {
+		t.Error("Expected node with more peers to have a higher priority")
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// Connect to the given node, complete a handshake and ask it for addresses.
+// Returns the addresses advertised in reply to a single getaddr, including
+// those received before a timeout or the end of the context. Nothing is saved
+// to the DB, and no state is shared with other calls so that nodes can be
+// queried concurrently
+func DiscoverPeers(ctx context.Context, ip, port string) (peers []ip_port, err error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(ip, port))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	return discoverPeers(ctx, conn)
+}
+
+// Handshake and getaddr exchange of DiscoverPeers on an open connection
+func discoverPeers(ctx context.Context, conn net.Conn) (peers []ip_port, err error) {
+	// Abort the exchange if the context ends
+	done := make(chan bool)
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	node := Node{Conn: conn}
+
+	err = sendVersion(node)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = receiveVersion(node)
+	if err != nil {
+		return nil, err
+	}
+
+	err = sendVerack(node)
+	if err != nil {
+		return nil, err
+	}
+
+	msg, err := receiveMessage(node)
+	if err != nil {
+		return nil, err
+	}
+	if msg.Type != "verack" {
+		return nil, fmt.Errorf("Expected verack got %s", msg.Type)
+	}
+
+	err = sendGetAddr(node)
+	if err != nil {
+		return nil, err
+	}
+
+	// Replies to getaddr are split in messages of at most 1000 addresses. Most
+	// nodes send a single one, so more are only waited for a short time
+	peers = make([]ip_port, 0)
+	timeout := flagMessageTimeout
+	for {
+		msg, err = receiveMessageWithTimeout(node, timeout)
+		if err != nil {
+			net_err, ok := err.(net.Error)
+			if len(peers) > 0 && ((ok && net_err.Timeout()) || ctx.Err() != nil) {
+				return peers, nil
+			}
+			return peers, err
+		}
+		if msg.Type != "addr" {
+			continue
+		}
+
+		addresses, err := parseAddr(msg)
+		if err != nil {
+			return peers, err
+		}
+
+		for _, na := range addresses {
+			peers = append(peers, ip_port{na.IP.String(), strconv.Itoa(int(na.Port))})
+		}
+
+		// Counted before duplicates are dropped
+		if addrMessageCount(msg) < 1000 {
+			return peers, nil
+		}
+		timeout = DISCOVER_ADDR_TIMEOUT
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDiscoverPeers(t *testing.T) {
+	drainStats()
+	defer drainStats()
+
+	// TEST: Addresses sent after other messages
+	local, remote := net.Pipe()
+	go func() {
+		defer remote.Close()
+
+		// Both sides write their verack at once, which net.Pipe cannot buffer
+		node := Node{Conn: remote}
+		_, err := receiveVersion(node)
+		if err != nil || sendVersion(node) != nil {
+			return
+		}
+		msg, err := receiveMessage(node)
+		if err != nil || msg.Type != "verack" {
+			return
+		}
+		if sendVerack(node) != nil {
+			return
+		}
+		msg, err = receiveMessage(node)
+		if err != nil || msg.Type != "getaddr" {
+			return
+		}
+
+		sendMessage(node, Message{Type: "ping", Payload: make([]byte, 8)})
+		sendMessage(node, Message{Type: "addr", Payload: addrPayload(
+			NetAddr{IP: net.ParseIP("1.2.3.4"), Port: 8333},
+			NetAddr{IP: net.ParseIP("2001:db8::1"), Port: 18333},
+		)})
+	}()
+
+	peers, err := discoverPeers(context.Background(), local)
+	local.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []ip_port{{"1.2.3.4", "8333"}, {"2001:db8::1", "18333"}}
+	if !reflect.DeepEqual(expected, peers) {
+		t.Error("Expected peers ", expected, " got ", peers)
+	}
+
+	// TEST: Addresses received before the end of the context, with no stats()
+	// goroutine consuming the counters
+	for len(chstatcounter) < cap(chstatcounter) {
+		chstatcounter <- Stat{"fill", 1}
+	}
+
+	full := make([]NetAddr, 1000)
+	for i := range full {
+		full[i] = NetAddr{IP: net.IPv4(10, 0, byte(i>>8), byte(i)), Port: 8333}
+	}
+
+	local, remote = net.Pipe()
+	go func() {
+		defer remote.Close()
+
+		node := Node{Conn: remote}
+		_, err := receiveVersion(node)
+		if err != nil || sendVersion(node) != nil {
+			return
+		}
+		msg, err := receiveMessage(node)
+		if err != nil || msg.Type != "verack" {
+			return
+		}
+		if sendVerack(node) != nil {
+			return
+		}
+		msg, err = receiveMessage(node)
+		if err != nil || msg.Type != "getaddr" {
+			return
+		}
+
+		// A full message and nothing else
+		sendMessage(node, Message{Type: "addr", Payload: addrPayload(full...)})
+		receiveMessage(node)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	peers, err = discoverPeers(ctx, local)
+	cancel()
+	local.Close()
+	drainStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 1000 {
+		t.Error("Expected 1000 peers got ", len(peers))
+	}
+
+	// TEST: Context ends while waiting for the node
+	local, remote = net.Pipe()
+	defer remote.Close()
+	go receiveVersion(Node{Conn: remote})
+
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err = discoverPeers(ctx, local)
+	if err == nil {
+		t.Error("Expected error for unresponsive node")
+	}
+	if time.Since(start) > 500*time.Millisecond {
+		t.Error("DiscoverPeers did not stop at end of context")
+	}
+}
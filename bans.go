@@ -0,0 +1,140 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// A node excluded from the crawl
+type BannedNode struct {
+	IP       string    `json:"ip"`
+	Port     string    `json:"port"`
+	Reason   string    `json:"reason"`
+	BanUntil time.Time `json:"ban_until"`
+}
+
+// Exclude the given node from the crawl for the given duration. Nodes are
+// queued again once their ban expires. The protocol errors caused by the node
+// so far are recorded with the ban
+func BanNode(db *sql.DB, ip, port, reason string, duration time.Duration) (err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+
+	var id int64
+	err = tx.QueryRow("SELECT id FROM nodes WHERE ip=? AND port=?", ip, port).Scan(&id)
+	if err == sql.ErrNoRows {
+		return ErrNodeNotFound
+	} else if err != nil {
+		return
+	}
+
+	now := time.Now()
+	_, err = tx.Exec(`INSERT OR REPLACE INTO node_bans 
+			(node_id, ban_reason, banned_at, ban_until, error_count) 
+		VALUES (?, ?, ?, ?, 
+			(SELECT COALESCE(SUM(count), 0) FROM node_errors WHERE node_id=?))`,
+		id, reason, now.Unix(), now.Add(duration).Unix(), id)
+	if err != nil {
+		return
+	}
+
+	return tx.Commit()
+}
+
+// Lift the ban of the given node. It is refreshed as soon as possible. The
+// ban is kept as expired so that the errors recorded with it are not counted
+// again by AutoBanMisbehavingNodes
+func UnbanNode(db *sql.DB, ip, port string) (err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+
+	now := time.Now().Unix()
+	res, err := tx.Exec(`UPDATE node_bans SET ban_until=? 
+		WHERE node_id IN (SELECT id FROM nodes WHERE ip=? AND port=?) 
+		  AND ban_until > ?`, now, ip, port, now)
+	if err != nil {
+		return
+	}
+
+	count, err := res.RowsAffected()
+	if err != nil {
+		return
+	}
+	if count == 0 {
+		return ErrNodeNotFound
+	}
+
+	_, err = tx.Exec("UPDATE nodes SET next_refresh=? WHERE ip=? AND port=?",
+		now, ip, port)
+	if err != nil {
+		return
+	}
+
+	return tx.Commit()
+}
+
+// Retrieve the nodes whose ban has not expired, ending soonest first
+func GetBannedNodes(db *sql.DB) (banned []BannedNode, err error) {
+	rows, err := db.Query(`SELECT n.ip, n.port, b.ban_reason, b.ban_until 
+		FROM node_bans b 
+		JOIN nodes n ON n.id = b.node_id 
+		WHERE b.ban_until > ?
+		ORDER BY b.ban_until`, time.Now().Unix())
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	var (
+		b         BannedNode
+		ban_until int64
+	)
+	banned = make([]BannedNode, 0)
+
+	for rows.Next() {
+		err = rows.Scan(&b.IP, &b.Port, &b.Reason, &ban_until)
+		if err != nil {
+			return
+		}
+
+		b.BanUntil = time.Unix(ban_until, 0)
+		banned = append(banned, b)
+	}
+
+	return banned, rows.Err()
+}
+
+// Ban the nodes which caused at least threshold protocol errors since their
+// last ban for AUTO_BAN_DURATION. Nodes which are currently banned are
+// skipped. Returns the number of banned nodes
+func AutoBanMisbehavingNodes(db *sql.DB, threshold int) (count int, err error) {
+	addresses, err := queryAddresses(db, `SELECT n.ip, n.port 
+		FROM node_errors e 
+		JOIN nodes n ON n.id = e.node_id 
+		LEFT JOIN node_bans b ON b.node_id = e.node_id 
+		WHERE b.ban_until IS NULL OR b.ban_until <= ? 
+		GROUP BY e.node_id 
+		HAVING SUM(e.count) - COALESCE(MAX(b.error_count), 0) >= ?`,
+		time.Now().Unix(), threshold)
+	if err != nil {
+		return
+	}
+
+	reason := fmt.Sprintf("At least %d protocol errors", threshold)
+	for _, addr := range addresses {
+		err = BanNode(db, addr.ip, addr.port, reason, AUTO_BAN_DURATION)
+		if err != nil {
+			return
+		}
+		count++
+	}
+
+	return
+}
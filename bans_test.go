@@ -0,0 +1,188 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestBanNode(t *testing.T) {
+	db := tempDB(t)
+	defer db.Close()
+
+	tempGraph(t, db, 2, nil)
+
+	// TEST: Unknown node
+	err := BanNode(db, "9.9.9.9", "9", "test", time.Hour)
+	if err != ErrNodeNotFound {
+		t.Error("Expected ErrNodeNotFound got ", err)
+	}
+
+	// TEST: Ban
+	before := time.Now()
+	err = BanNode(db, "1.1.1.1", "1", "test", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	banned, err := GetBannedNodes(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(banned) != 1 {
+		t.Fatal("Expected 1 banned node got ", banned)
+	}
+	if banned[0].IP != "1.1.1.1" || banned[0].Port != "1" || banned[0].Reason != "test" ||
+		banned[0].BanUntil.Unix() < before.Add(time.Hour).Unix() {
+		t.Error("Unexpected ban ", banned[0])
+	}
+
+	// TEST: Unban
+	err = UnbanNode(db, "1.1.1.1", "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var next_refresh int64
+	err = db.QueryRow("SELECT next_refresh FROM nodes WHERE id=1").Scan(&next_refresh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next_refresh > time.Now().Unix() {
+		t.Error("Expected node to be due for refresh got next_refresh ", next_refresh)
+	}
+
+	// TEST: Node not banned
+	err = UnbanNode(db, "2.2.2.2", "2")
+	if err != ErrNodeNotFound {
+		t.Error("Expected ErrNodeNotFound got ", err)
+	}
+}
+
+func TestAutoBanMisbehavingNodes(t *testing.T) {
+	db := tempDB(t)
+	defer db.Close()
+
+	tempGraph(t, db, 3, nil)
+	_, err := db.Exec(`INSERT INTO node_errors (node_id, error_type, count, updated_at) 
+		VALUES (1, 'invalid_checksum', 10, 0), (2, 'invalid_checksum', 3, 0)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	count, err := AutoBanMisbehavingNodes(db, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Error("Expected 1 banned node got ", count)
+	}
+
+	var node_id int64
+	err = db.QueryRow("SELECT node_id FROM node_bans").Scan(&node_id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if node_id != 1 {
+		t.Error("Expected node 1 to be banned got ", node_id)
+	}
+
+	// Set the ban in the past to check that it is not extended
+	_, err = db.Exec("UPDATE node_bans SET ban_until=ban_until-10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ban_until int64
+	err = db.QueryRow("SELECT ban_until FROM node_bans WHERE node_id=1").Scan(&ban_until)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// TEST: Banned nodes are skipped
+	count, err = AutoBanMisbehavingNodes(db, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Error("Expected no banned node got ", count)
+	}
+	var got_until int64
+	err = db.QueryRow("SELECT ban_until FROM node_bans WHERE node_id=1").Scan(&got_until)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got_until != ban_until {
+		t.Error("Expected ban until ", ban_until, " to be kept got ", got_until)
+	}
+
+	// TEST: Errors before the ban are not counted once it is lifted
+	err = UnbanNode(db, "1.1.1.1", "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	count, err = AutoBanMisbehavingNodes(db, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Error("Expected unbanned node not to be banned again got ", count)
+	}
+
+	// TEST: New errors after the ban
+	_, err = db.Exec("UPDATE node_errors SET count=count+5 WHERE node_id=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	count, err = AutoBanMisbehavingNodes(db, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Error("Expected node with new errors to be banned again got ", count)
+	}
+}
+
+func TestGetBannedNodes(t *testing.T) {
+	db := tempDB(t)
+	defer db.Close()
+	tempDBPool(db)
+
+	due := time.Now().Unix() - 1
+	_, err := db.Exec(`INSERT INTO nodes (id, ip, port, next_refresh, updated_at) VALUES
+		(1, '1.1.1.1', 1, ?, 0), -- banned
+		(2, '2.2.2.2', 2, ?, 0), -- ban expired
+		(3, '3.3.3.3', 3, ?, 0)  -- never banned`, due, due-10, due-20)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().Unix()
+	_, err = db.Exec(`INSERT INTO node_bans (node_id, ban_reason, banned_at, ban_until) 
+		VALUES (1, 'spam', ?, ?), (2, 'spam', ?, ?)`, now, now+3600, now-7200, now-3600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// TEST: Only current bans are listed
+	banned, err := GetBannedNodes(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(banned) != 1 || banned[0].IP != "1.1.1.1" || banned[0].BanUntil.Unix() != now+3600 {
+		t.Error("Expected only 1.1.1.1 to be banned got ", banned)
+	}
+
+	// TEST: Expired bans do not prevent re-queuing
+	got, _, max := addressesToUpdate()
+
+	expected := []ip_port{
+		ip_port{ip: "3.3.3.3", port: "3"},
+		ip_port{ip: "2.2.2.2", port: "2"},
+	}
+	if !reflect.DeepEqual(expected, got) {
+		t.Error("Addresses to update expected ", expected, " got ", got)
+	}
+	if max != len(expected) {
+		t.Error("Max addresses expected ", len(expected), " got ", max)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"strings"
 	"time"
 )
 
@@ -14,6 +15,33 @@ type Message struct {
 	Payload []byte
 }
 
+// Protocol errors caused by invalid data sent by a node, by part of their
+// error message. The first match wins, so prefixes come before generic
+// messages they may contain
+var NODE_ERROR_TYPES = []struct{ match, name string }{
+	{"parseHeaders:", "invalid_headers"},
+	{"Invalid checksum", "invalid_checksum"},
+	{"Payload too small", "payload_too_small"},
+	{"payload to big", "payload_too_big"},
+	{"Wrong network", "wrong_network"},
+}
+
+// Type of the protocol error err, or "" if it was not caused by invalid data
+// (e.g. connection errors)
+func nodeErrorType(err error) string {
+	if err == nil {
+		return ""
+	}
+
+	for _, t := range NODE_ERROR_TYPES {
+		if strings.Contains(err.Error(), t.match) {
+			return t.name
+		}
+	}
+
+	return ""
+}
+
 // Send a version message to initiate a connection with node
 func sendVersion(node Node) (err error) {
 	msg := makeVersion(node)
@@ -40,6 +68,15 @@ func receiveVersion(node Node) (version MsgVersion, err error) {
 	return
 }
 
+// Acknowledge the version received from the node, completing our side of the
+// handshake
+func sendVerack(node Node) (err error) {
+	return sendMessage(node, Message{
+		Type:    "verack",
+		Payload: []byte{},
+	})
+}
+
 // Ask the node to provide us with addresses
 func sendGetAddr(node Node) (err error) {
 	return sendMessage(node, Message{
@@ -48,8 +85,17 @@ func sendGetAddr(node Node) (err error) {
 	})
 }
 
-// Read on message from the given node. Times out after 30s
+// Read one message from the given node. Times out after -message-timeout
 func receiveMessage(node Node) (msg Message, err error) {
+	return receiveMessageWithTimeout(node, flagMessageTimeout)
+}
+
+// Read one message from the given node, failing if it is not completely
+// received within timeout. The read deadline is cleared afterwards
+func receiveMessageWithTimeout(node Node, timeout time.Duration) (msg Message, err error) {
+	node.Conn.SetReadDeadline(time.Now().Add(timeout))
+	defer node.Conn.SetReadDeadline(time.Time{})
+
 	// Header has the following format
 	//   magic     0.. 3  [4]byte  magic number
 	//   command   4..15  [12]byte command contained by this message
@@ -57,8 +103,6 @@ func receiveMessage(node Node) (msg Message, err error) {
 	//   checksum 20..23  [4]byte  checksum of the payload
 	var header [24]byte
 
-	// Set 30s timeout for function
-	node.Conn.SetDeadline(time.Now().Add(30 * time.Second))
 	_, err = io.ReadFull(node.Conn, header[:])
 	if err != nil {
 		return
@@ -93,6 +137,14 @@ func receiveMessage(node Node) (msg Message, err error) {
 		return
 	}
 
+	// Dropped if the counters are not consumed, when used through DiscoverPeers
+	// without stats()
+	select {
+	case chstatcounter <- Stat{MSG_STAT_PREFIX + msg.Type, 1}:
+	default:
+	}
+	messageLogger.Log(node.Conn.RemoteAddr().String(), msg, DIRECTION_RECV)
+
 	return
 }
 
@@ -110,14 +162,22 @@ func sendMessage(node Node, msg Message) (err error) {
 	binary.LittleEndian.PutUint32(header[16:20], uint32(len(msg.Payload)))
 	copy(header[20:], doubleSha256(msg.Payload)[:4])
 
+	node.Conn.SetWriteDeadline(time.Now().Add(flagMessageTimeout))
+	defer node.Conn.SetWriteDeadline(time.Time{})
+
 	_, err = node.Conn.Write(header[:])
 	if err != nil {
 		return
 	}
-	_, err = node.Conn.Write(msg.Payload)
-	if err != nil {
-		return
+	// Empty writes block on synchronous connections such as net.Pipe
+	if len(msg.Payload) > 0 {
+		_, err = node.Conn.Write(msg.Payload)
+		if err != nil {
+			return
+		}
 	}
 
+	messageLogger.Log(node.Conn.RemoteAddr().String(), msg, DIRECTION_SEND)
+
 	return
 }
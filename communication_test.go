@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestNodeErrorType(t *testing.T) {
+	for _, c := range []struct {
+		err      error
+		expected string
+	}{
+		{nil, ""},
+		{io.EOF, ""},
+		{fmt.Errorf("Invalid checksum"), "invalid_checksum"},
+		{fmt.Errorf("parseVersion: Payload too small (12)"), "payload_too_small"},
+		{fmt.Errorf("parseHeaders: Payload size mismatch (80, expected 165) for 2 headers"), "invalid_headers"},
+		{fmt.Errorf("Message payload to big %d", 1<<30), "payload_too_big"},
+		{fmt.Errorf("Wrong network"), "wrong_network"},
+	} {
+		got := nodeErrorType(c.err)
+		if got != c.expected {
+			t.Error(c.err, " expected type ", c.expected, " got ", got)
+		}
+	}
+}
+
+// Build the header of a message with the given magic number carrying payload
+func messageHeader(magic []byte, command string, payload []byte) []byte {
+	header := make([]byte, 24)
+	copy(header[0:4], magic)
+	copy(header[4:16], command)
+	binary.LittleEndian.PutUint32(header[16:20], uint32(len(payload)))
+	copy(header[20:], doubleSha256(payload)[:4])
+
+	return header
+}
+
+// Receive a message from a connection on which data is written then closed
+func receivePiped(data []byte) (Message, error) {
+	local, remote := net.Pipe()
+	defer local.Close()
+
+	go func() {
+		remote.Write(data)
+		remote.Close()
+	}()
+
+	return receiveMessage(Node{Conn: local})
+}
+
+func TestReceiveMessageTruncatedPayload(t *testing.T) {
+	payload := make([]byte, 100)
+	data := append(messageHeader(NETWORK_CURRENT, "ping", payload), payload[:50]...)
+
+	_, err := receivePiped(data)
+	if err != io.ErrUnexpectedEOF {
+		t.Error("Expected ErrUnexpectedEOF got ", err)
+	}
+
+	// TEST: Connection closed within the header
+	_, err = receivePiped(data[:10])
+	if err != io.ErrUnexpectedEOF {
+		t.Error("Expected ErrUnexpectedEOF for truncated header got ", err)
+	}
+
+	// TEST: Complete message
+	msg, err := receivePiped(append(messageHeader(NETWORK_CURRENT, "ping", payload), payload...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Type != "ping" || len(msg.Payload) != 100 {
+		t.Error("Unexpected message ", msg.Type, " with ", len(msg.Payload), " bytes")
+	}
+}
+
+func TestReceiveMessageWithTimeout(t *testing.T) {
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+
+	// TEST: Peer stops after the header
+	payload := make([]byte, 100)
+	go remote.Write(messageHeader(NETWORK_CURRENT, "ping", payload))
+
+	start := time.Now()
+	_, err := receiveMessageWithTimeout(Node{Conn: local}, 50*time.Millisecond)
+	if err == nil {
+		t.Error("Expected timeout for truncated message")
+	}
+	if time.Since(start) > 500*time.Millisecond {
+		t.Error("Receiving did not stop at the timeout")
+	}
+
+	// TEST: Deadline is cleared after a message is received
+	local, remote = net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+	node := Node{Conn: local}
+
+	data := append(messageHeader(NETWORK_CURRENT, "ping", payload), payload...)
+	go func() {
+		remote.Write(data)
+		time.Sleep(100 * time.Millisecond)
+		remote.Write(data)
+	}()
+
+	_, err = receiveMessageWithTimeout(node, 50*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf [24]byte
+	_, err = io.ReadFull(local, buf[:])
+	if err != nil {
+		t.Error("Expected no deadline after message got ", err)
+	}
+	drainStats()
+}
+
+func TestSetNetwork(t *testing.T) {
+	defer setNetwork("main")
+
+	for _, c := range []struct {
+		name    string
+		magic   []byte
+		genesis []byte
+		port    uint16
+	}{
+		{"testnet3", NETWORK_TESTNET3, GENESIS_TESTNET3, PORT_TESTNET},
+		{"namecoin", NETWORK_NAMECOIN, nil, PORT_NAMECOIN},
+		{"main", NETWORK_MAIN, GENESIS_MAIN, PORT_MAIN},
+	} {
+		err := setNetwork(c.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(NETWORK_CURRENT, c.magic) || !bytes.Equal(GENESIS_CURRENT, c.genesis) ||
+			PORT_CURRENT != c.port {
+			t.Error(c.name, ": unexpected network ", networkName(NETWORK_CURRENT), " port ", PORT_CURRENT)
+		}
+	}
+
+	// TEST: Unknown network
+	err := setNetwork("regtest")
+	if err == nil {
+		t.Error("Expected error for unknown network")
+	}
+	if !bytes.Equal(NETWORK_CURRENT, NETWORK_MAIN) {
+		t.Error("Unknown network changed the network in use")
+	}
+}
+
+func TestReceiveMessageWrongMagic(t *testing.T) {
+	if !bytes.Equal(NETWORK_CURRENT, NETWORK_MAIN) {
+		t.Skip("Test expects NETWORK_CURRENT to be NETWORK_MAIN")
+	}
+
+	off_by_one := append([]byte{}, NETWORK_MAIN...)
+	off_by_one[3]++
+
+	for _, c := range []struct {
+		name  string
+		magic []byte
+	}{
+		{"testnet3", NETWORK_TESTNET3},
+		{"zero", []byte{0, 0, 0, 0}},
+		{"one byte off", off_by_one},
+	} {
+		payload := []byte{}
+		_, err := receivePiped(messageHeader(c.magic, "verack", payload))
+		if err == nil || err.Error() != "Wrong network" {
+			t.Error(c.name, ": expected Wrong network got ", err)
+		}
+	}
+}
@@ -1,6 +1,9 @@
 package main
 
 import (
+	"bytes"
+	"fmt"
+	"math"
 	"time"
 )
 
@@ -14,11 +17,83 @@ var (
 	NETWORK_CURRENT = NETWORK_MAIN // The network in use
 )
 
+// Hash of the genesis block of each network
+var (
+	GENESIS_MAIN     = hashFromHex("000000000019d6689c085ae165831e934ff763ae46a2a6c172b3f1b60a8ce26f")
+	GENESIS_TESTNET3 = hashFromHex("000000000933ea01ad0ee984209779baaec3ced90fa3f408719526f8d77f4943")
+
+	GENESIS_CURRENT = GENESIS_MAIN // Genesis of the network in use
+)
+
+// Genesis block of each network by name, when known
+var GENESIS = map[string][]byte{
+	"main":     GENESIS_MAIN,
+	"testnet3": GENESIS_TESTNET3,
+}
+
+// Default port of each network
+const (
+	PORT_MAIN     = 8333
+	PORT_TESTNET  = 18333
+	PORT_NAMECOIN = 8334
+)
+
+var PORT_CURRENT uint16 = PORT_MAIN // Default port of the network in use
+
+// Default port of each network by name
+var PORTS = map[string]uint16{
+	"main":     PORT_MAIN,
+	"testnet":  PORT_TESTNET,
+	"testnet3": PORT_TESTNET,
+	"namecoin": PORT_NAMECOIN,
+}
+
+// Networks by name
+var NETWORKS = map[string][]byte{
+	"main":     NETWORK_MAIN,
+	"testnet":  NETWORK_TESTNET,
+	"testnet3": NETWORK_TESTNET3,
+	"namecoin": NETWORK_NAMECOIN,
+}
+
+// Name of the network with the given magic number
+func networkName(magic []byte) string {
+	for name, m := range NETWORKS {
+		if bytes.Equal(m, magic) {
+			return name
+		}
+	}
+
+	return fmt.Sprintf("%x", magic)
+}
+
+// Select the network in use by name: its magic number, genesis block and
+// default port. Heights are unknown on networks without a known genesis block
+func setNetwork(name string) error {
+	magic, ok := NETWORKS[name]
+	if !ok {
+		return fmt.Errorf("Unknown network %q", name)
+	}
+
+	NETWORK_CURRENT = magic
+	GENESIS_CURRENT = GENESIS[name]
+	PORT_CURRENT = PORTS[name]
+
+	return nil
+}
+
 // Maximum size payload that a message can have
 const MAX_PAYLOAD = 1024 * 100
 
+// Maximum number of headers in a headers message, and size of each header
+const MAX_HEADERS = 2000
+const SIZE_HEADER = 80
+
 const VERSION_TIME_IN_NETADDR = 31402
+const VERSION_BIP_0031 = 60001 // pong
 const VERSION_BIP_0037 = 70001
+const VERSION_BIP_0130 = 70012    // sendheaders
+const VERSION_WTXID_RELAY = 70016 // wtxidrelay
 
 const SIZE_NETADDR = 26
 const SIZE_NETADDR_WITH_TIME = 30
@@ -27,12 +102,47 @@ const SIZE_NETADDR_WITH_TIME = 30
 const CURRENT_PROTOCOL = 70001
 const USER_AGENT = "/BTCCRAWLER/0.4/"
 
-// Number of goroutines
+// Default number of goroutines, and maximum which can be set by flags
 const NUM_CONNECTION_GOROUTINES = 100
 const NUM_UPDATE_GOROUTINES = 4
+const MAX_GOROUTINES = 1000
+
+// Default timeouts for connecting to a node and for receiving a message. The
+// connection timeout is the maximum, lower for subnets answering faster
+const NODE_CONNECT_TIMEOUT = 10 * time.Second
+const MESSAGE_TIMEOUT = 30 * time.Second
+
+// Default number of protocol errors after which a node is misbehaving
+const MISBEHAVING_MIN_ERRORS = 10
+
+// Duration of the ban of misbehaving nodes
+const AUTO_BAN_DURATION = 7 * 24 * time.Hour
+
+// Default number of nodes which must advertise a node for it to be popular
+const POPULAR_MIN_SEEN_BY = 10
+
+// The crawler is considered stalled if no node was updated during this period
+const STALL_WINDOW = 10 * time.Minute
 
-// Timeout
-const NODE_CONNECT_TIMEOUT = 10
+// Period over which the share of the network online is computed in stats
+const NETWORK_ONLINE_WINDOW = 24 * time.Hour
+
+// Period over which the churn rate is computed in stats
+const CHURN_WINDOW = 7 * 24 * time.Hour
+
+// Timeout of a ping through the API, including the handshake
+const PING_TIMEOUT = 30 * time.Second
+
+// Time DiscoverPeers waits for more addresses after an addr message with the
+// maximum of 1000 entries
+const DISCOVER_ADDR_TIMEOUT = 5 * time.Second
+
+// Lower bound of the connection timeout derived from the latency of a subnet.
+// The upper bound is -connect-timeout
+const MIN_CONNECT_TIMEOUT = 2 * time.Second
+
+// Number of connection times kept per subnet
+const SUBNET_LATENCY_HISTORY = 100
 
 // Size of channel of nodes which are live but haven't been refreshed yet
 const NODE_BUFFER_SIZE = 20
@@ -43,5 +153,60 @@ const NUM_DB_CONN = 10
 const ADDRESSES_NUM = 5000                 // Number of addresses to fetch
 const ADDRESSES_INTERVAL = 5 * time.Minute // Interval to check for new addresses to update
 
+// Default interval between deletions of old relations between nodes, and age
+// after which relations are deleted
+const GRAPH_GC_INTERVAL = 6 * time.Hour
+const GRAPH_EDGE_TTL = 30 * 24 * time.Hour
+
+// Maximum number of nodes in a subgraph returned by SubgraphBFS
+const SUBGRAPH_MAX_NODES = 10000
+
+// Weights in the priority of refreshing a node, in hours overdue: for a node
+// which was online on every refresh, and for each doubling of the number of
+// peers it advertised. Bootstrap addresses are queued before any other
+const PRIORITY_UPTIME_WEIGHT = 24
+const PRIORITY_PEERS_WEIGHT = 1
+
+var PRIORITY_BOOTSTRAP = math.Inf(1)
+
+// Maximum number of addresses sent in reply to a getaddr, which is also the
+// maximum of an addr message
+const ADDR_RESPONSE_SIZE = 1000
+
+// Duration during which the same sample of nodes is sent to inbound nodes in
+// reply to getaddr
+const ADDR_RESPONSE_CACHE_TTL = 5 * time.Minute
+
+// Maximum number of simultaneous connections from nodes with -listen
+const MAX_INBOUND_CONNECTIONS = 125
+
+// Maximum number of nodes returned by GetSiblingNodes
+const SIBLINGS_MAX_NODES = 1000
+
+// Default interval between memory usage writes
+const MEMUSAGE_INTERVAL = 60 * time.Second
+
+// Number of nodes geolocated per transaction by BackfillGeolocation
+const GEO_BACKFILL_BATCH = 500
+
+// Number of user agents listed in summary reports
+const REPORT_TOP_USER_AGENTS = 10
+
+// Number of previous summary reports kept next to -report-file
+const REPORT_KEEP_ROTATED = 24
+
 // Minimum update interval for nodes (hours)
 const NODE_REFRESH_INTERVAL = 24
+
+// Update interval for nodes excluded with -exclude-user-agent (hours)
+const EXCLUDED_REFRESH_INTERVAL = 365 * 24
+
+// Number of times the save of a node is retried when another goroutine saved
+// it in the meantime
+const MAX_SAVE_RETRIES = 5
+
+// Number of nodes written to the bootstrap list
+const BOOTSTRAP_LIST_SIZE = 20
+
+// Number of nodes used with -auto-bootstrap
+const AUTO_BOOTSTRAP_NUM = 5
@@ -2,13 +2,14 @@ package main
 
 import (
 	"database/sql"
+	"encoding/json"
 	"fmt"
 	"log"
 	"net"
+	"os"
 	"strconv"
+	"sync"
 	"time"
-
-	_ "github.com/mattn/go-sqlite3"
 )
 
 // Default max number of arguments for an SQLite query
@@ -28,9 +29,11 @@ type ip_port struct {
 type nodeDB struct {
 	node *Node
 
+	db           *sql.DB // Used for caching prepared statements, may be nil
 	tx           *sql.Tx
 	now          int64 // Current time for updated_at, next_refresh..
 	dbInfo       dbNodeInfo
+	stored       dbNodeInfo                 // Version read by dbGetNode, expected by dbPutNode
 	dbNeighbours map[string]dbNeighbourInfo // Key is joined IP/Port
 }
 
@@ -41,8 +44,11 @@ type dbNodeInfo struct {
 	ip   string
 	port string
 
-	protocol   int
-	user_agent string
+	protocol     int
+	user_agent   string
+	relay        bool
+	services     ServiceFlag
+	start_height int32
 
 	next_refresh int64
 
@@ -50,8 +56,50 @@ type dbNodeInfo struct {
 	online_at  int64
 	success    bool
 	success_at int64
+
+	updated_at int64
+}
+
+// Combine the information about a node with another version of it, keeping
+// the most optimistic values. The node keeps its own id and address. The
+// handshake results are taken from the most recent successful handshake
+func (n dbNodeInfo) Merge(other dbNodeInfo) dbNodeInfo {
+	merged := n
+
+	merged.online = n.online || other.online
+	merged.success = n.success || other.success
+
+	if other.online_at > n.online_at {
+		merged.online_at = other.online_at
+	}
+	if other.success_at > n.success_at {
+		merged.success_at = other.success_at
+
+		merged.protocol = other.protocol
+		merged.user_agent = other.user_agent
+		merged.relay = other.relay
+		merged.services = other.services
+		merged.start_height = other.start_height
+	}
+	if other.next_refresh > n.next_refresh {
+		merged.next_refresh = other.next_refresh
+	}
+	if other.updated_at > n.updated_at {
+		merged.updated_at = other.updated_at
+	}
+
+	return merged
 }
 
+// Prepared statements are cached per DB and query so that they are not
+// prepared again for each transaction
+type stmtKey struct {
+	db    *sql.DB
+	query string
+}
+
+var stmtCache sync.Map // stmtKey -> *sql.Stmt
+
 // Node neighbour partial attributes stored in the DB
 type dbNeighbourInfo struct {
 	id           int64
@@ -69,6 +117,12 @@ const INIT_SCHEMA_NODES = `
 		"port"         INTEGER NOT NULL,
 		"protocol"     INTEGER NOT NULL DEFAULT 0,
 		"user_agent"   TEXT DEFAULT '',
+		"relay"        BOOLEAN NOT NULL DEFAULT 0,
+		"services"     INTEGER NOT NULL DEFAULT 0,
+		"start_height" INTEGER NOT NULL DEFAULT 0,
+
+		"country_code" TEXT NOT NULL DEFAULT '',
+		"asn"          INTEGER NOT NULL DEFAULT 0,
 
 		"online"       BOOLEAN NOT NULL DEFAULT 0, 
 		"success"      BOOLEAN NOT NULL DEFAULT 0,
@@ -99,18 +153,157 @@ const INIT_SCHEMA_NODES_KNOWN = `
 	);
 	`
 
+// Columns which were added to existing tables after their creation. They are
+// added to older DBs when missing.
+type dbColumn struct {
+	table      string
+	name       string
+	definition string
+}
+
+var MIGRATIONS = []dbColumn{
+	{"nodes", "relay", "BOOLEAN NOT NULL DEFAULT 0"},
+	{"nodes", "country_code", "TEXT NOT NULL DEFAULT ''"},
+	{"nodes", "asn", "INTEGER NOT NULL DEFAULT 0"},
+	{"nodes", "services", "INTEGER NOT NULL DEFAULT 0"},
+	{"nodes", "start_height", "INTEGER NOT NULL DEFAULT 0"},
+	{"node_bans", "error_count", "INTEGER NOT NULL DEFAULT 0"},
+}
+
+const INIT_SCHEMA_NODE_SERVICES_HISTORY = `
+	CREATE TABLE IF NOT EXISTS "node_services_history" (
+		"id" INTEGER PRIMARY KEY,
+
+		"node_id" INTEGER NOT NULL,
+		"services" INTEGER NOT NULL,
+
+		"first_seen" DATE NOT NULL,
+		"last_seen" DATE NOT NULL
+	);
+	`
+
+// Each attempt at refreshing a node
+const INIT_SCHEMA_NODE_SESSIONS = `
+	CREATE TABLE IF NOT EXISTS "node_sessions" (
+		"id" INTEGER PRIMARY KEY,
+
+		"node_id" INTEGER NOT NULL,
+		"started_at" DATE NOT NULL,
+
+		"online" BOOLEAN NOT NULL DEFAULT 0,
+		"success" BOOLEAN NOT NULL DEFAULT 0
+	);
+	`
+
+// Protocol errors caused by each node, by type
+const INIT_SCHEMA_NODE_ERRORS = `
+	CREATE TABLE IF NOT EXISTS "node_errors" (
+		"node_id" INTEGER NOT NULL,
+		"error_type" TEXT NOT NULL,
+
+		"count" INTEGER NOT NULL DEFAULT 0,
+		"updated_at" DATE NOT NULL,
+
+		PRIMARY KEY ("node_id", "error_type")
+	);
+	`
+
+// Client implementation fingerprint of each node, from its last version message
+const INIT_SCHEMA_NODE_FINGERPRINTS = `
+	CREATE TABLE IF NOT EXISTS "node_fingerprints" (
+		"node_id" INTEGER PRIMARY KEY,
+
+		"has_relay" BOOLEAN NOT NULL,
+		"user_agent_bucket" TEXT NOT NULL,
+		"protocol_band" TEXT NOT NULL,
+		"services" INTEGER NOT NULL,
+
+		"updated_at" DATE NOT NULL
+	);
+	`
+
+// Nodes excluded from the crawl
+const INIT_SCHEMA_NODE_BANS = `
+	CREATE TABLE IF NOT EXISTS "node_bans" (
+		"node_id" INTEGER PRIMARY KEY,
+
+		"ban_reason" TEXT NOT NULL,
+		"banned_at" DATE NOT NULL,
+		"ban_until" DATE NOT NULL,
+		"error_count" INTEGER NOT NULL DEFAULT 0
+	);
+	`
+
+// Names of autonomous systems, loaded with -load-asn-names
+const INIT_SCHEMA_ASN_NAMES = `
+	CREATE TABLE IF NOT EXISTS "asn_names" (
+		"asn" INTEGER PRIMARY KEY,
+		"name" TEXT NOT NULL
+	);
+	`
+
+// Connection time percentiles by subnet, in milliseconds
+const INIT_SCHEMA_SUBNET_LATENCY = `
+	CREATE TABLE IF NOT EXISTS "subnet_latency" (
+		"subnet" TEXT PRIMARY KEY,
+
+		"p50" INTEGER NOT NULL,
+		"p90" INTEGER NOT NULL,
+		"samples" INTEGER NOT NULL,
+
+		"updated_at" DATE NOT NULL
+	);
+	`
+
+// Each run of the crawler
+const INIT_SCHEMA_CRAWLER_SESSIONS = `
+	CREATE TABLE IF NOT EXISTS "crawler_sessions" (
+		"id" INTEGER PRIMARY KEY,
+
+		"tag" TEXT NOT NULL DEFAULT '',
+		"started_at" DATE NOT NULL,
+		"ended_at" DATE NOT NULL DEFAULT 0,
+
+		"network" TEXT NOT NULL,
+		"node_count_start" INTEGER NOT NULL DEFAULT 0,
+		"node_count_end" INTEGER NOT NULL DEFAULT 0,
+
+		"config_json" TEXT NOT NULL DEFAULT '{}'
+	);
+	`
+
+// Log of the addresses advertised by nodes, along with the timestamp which was
+// advertised for each address
+const INIT_SCHEMA_ADDRESSES_SEEN = `
+	CREATE TABLE IF NOT EXISTS "addresses_seen" (
+		"id" INTEGER PRIMARY KEY,
+
+		"id_source" INTEGER NOT NULL,
+		"ip" TEXT NOT NULL,
+		"port" INTEGER NOT NULL,
+
+		"addr_timestamp" DATE NOT NULL,
+		"seen_at" DATE NOT NULL
+	);
+	`
+
 const INDEX_IP_PORT = "CREATE INDEX IF NOT EXISTS node_ip_port ON nodes (ip, port);"
 const INDEX_SOURCE_KNOWN = "CREATE INDEX IF NOT EXISTS nodes_known_source_known ON nodes_known (id_source, id_known);"
+const INDEX_SESSIONS_NODE = "CREATE INDEX IF NOT EXISTS node_sessions_node ON node_sessions (node_id, started_at);"
+const INDEX_SERVICES_HISTORY_NODE = "CREATE INDEX IF NOT EXISTS node_services_history_node ON node_services_history (node_id, last_seen);"
 
 var dbConnectionPool chan *sql.DB
 
+// Returned when the requested node is not in the DB
+var ErrNodeNotFound = fmt.Errorf("Node not found")
+
 // Initialize pool of DB connections
 func initDB() (err error) {
 	log.Print("Initializing DB connections")
 
 	dbConnectionPool = make(chan *sql.DB, NUM_DB_CONN)
 	for i := 0; i < NUM_DB_CONN; i++ {
-		db, err := sql.Open("sqlite3", "data.db")
+		db, err := sql.Open(SQLITE_DRIVER, "data.db")
 		if err != nil {
 			return err
 		}
@@ -135,14 +328,71 @@ func setupDB(db *sql.DB) {
 	for _, q := range []string{
 		INIT_SCHEMA_NODES,
 		INIT_SCHEMA_NODES_KNOWN,
+		INIT_SCHEMA_NODE_SERVICES_HISTORY,
+		INIT_SCHEMA_ADDRESSES_SEEN,
+		INIT_SCHEMA_NODE_SESSIONS,
+		INIT_SCHEMA_CRAWLER_SESSIONS,
+		INIT_SCHEMA_SUBNET_LATENCY,
+		INIT_SCHEMA_NODE_ERRORS,
+		INIT_SCHEMA_NODE_BANS,
+		INIT_SCHEMA_NODE_FINGERPRINTS,
+		INIT_SCHEMA_ASN_NAMES,
 		INDEX_IP_PORT,
 		INDEX_SOURCE_KNOWN,
+		INDEX_SERVICES_HISTORY_NODE,
+		INDEX_SESSIONS_NODE,
 	} {
 		_, err := db.Exec(q)
 		if err != nil {
 			logQueryError(q, err)
 		}
 	}
+
+	migrateDB(db)
+}
+
+// Add columns missing from tables of a DB created by an older version
+func migrateDB(db *sql.DB) {
+	for _, c := range MIGRATIONS {
+		if hasColumn(db, c.table, c.name) {
+			continue
+		}
+
+		log.Print("Migrating DB: adding column ", c.name, " to ", c.table)
+
+		q := fmt.Sprintf(`ALTER TABLE "%s" ADD COLUMN "%s" %s`, c.table, c.name, c.definition)
+		_, err := db.Exec(q)
+		if err != nil {
+			logQueryError(q, err)
+		}
+	}
+}
+
+// Returns whether the given table has a column with the given name
+func hasColumn(db *sql.DB, table, column string) bool {
+	q := fmt.Sprintf(`PRAGMA table_info("%s")`, table)
+	rows, err := db.Query(q)
+	if err != nil {
+		logQueryError(q, err)
+	}
+	defer rows.Close()
+
+	var (
+		cid, notnull, pk int
+		name, col_type   string
+		dflt_value       sql.NullString
+	)
+	for rows.Next() {
+		err = rows.Scan(&cid, &name, &col_type, &notnull, &dflt_value, &pk)
+		if err != nil {
+			logQueryError(q, err)
+		}
+		if name == column {
+			return true
+		}
+	}
+
+	return false
 }
 
 // Clean up pool of DB connections
@@ -151,10 +401,22 @@ func cleanDB() {
 
 	for i := 0; i < NUM_DB_CONN; i++ {
 		db := <-dbConnectionPool
+		closeStmts(db)
 		db.Close()
 	}
 }
 
+// Close the cached prepared statements of the given DB
+func closeStmts(db *sql.DB) {
+	stmtCache.Range(func(key, stmt interface{}) bool {
+		if key.(stmtKey).db == db {
+			stmt.(*sql.Stmt).Close()
+			stmtCache.Delete(key)
+		}
+		return true
+	})
+}
+
 // Get a connection from the pool of DB connections
 func acquireDBConn() (db *sql.DB) {
 	return <-dbConnectionPool
@@ -184,33 +446,53 @@ func haveKnownNodes() bool {
 	return count != 0
 }
 
-// Retrieves addresses which need to be updated
-func addressesToUpdate() (addresses []ip_port, max int) {
+// Retrieves addresses which need to be updated, with the priority of each
+// (see addressPriority)
+func addressesToUpdate() (addresses []ip_port, priorities []float64, max int) {
 	db := acquireDBConn()
 	defer releaseDBConn(db)
 
-	query := fmt.Sprintf(`SELECT ip, port 
+	// Random sampling avoids several crawlers hitting the same nodes
+	order := "next_refresh"
+	if flagRandomSample {
+		order = "RANDOM()"
+	}
+
+	query := fmt.Sprintf(`SELECT ip, port, next_refresh, 
+			(SELECT COALESCE(AVG(s.online), 0) FROM node_sessions s WHERE s.node_id = nodes.id), 
+			(SELECT COUNT(*) FROM nodes_known k WHERE k.id_source = nodes.id) 
 		FROM nodes 
 		WHERE port!=0
 			AND next_refresh != 0
 			AND next_refresh < strftime('%%s', 'now')
-		ORDER BY next_refresh
-		LIMIT %d`, ADDRESSES_NUM)
+			AND id NOT IN (
+				SELECT node_id FROM node_bans 
+				WHERE ban_until > strftime('%%s', 'now'))
+		ORDER BY %s
+		LIMIT %d`, order, ADDRESSES_NUM)
 
 	rows, err := db.Query(query)
 	if err != nil {
 		logQueryError(query, err)
 	}
 
-	var ip, port string
+	var (
+		ip, port     string
+		next_refresh int64
+		uptime       float64
+		peers        int
+	)
 	addresses = make([]ip_port, 0, ADDRESSES_NUM)
+	priorities = make([]float64, 0, ADDRESSES_NUM)
+	now := time.Now().Unix()
 
 	for rows.Next() {
-		rows.Scan(&ip, &port)
+		rows.Scan(&ip, &port, &next_refresh, &uptime, &peers)
 		// if verbose {
 		// 	log.Print("Getting ", ip, " ", port)
 		// }
 		addresses = append(addresses, ip_port{ip: ip, port: port})
+		priorities = append(priorities, addressPriority(next_refresh, now, uptime, peers))
 	}
 
 	// Get max count
@@ -218,7 +500,10 @@ func addressesToUpdate() (addresses []ip_port, max int) {
 		FROM nodes 
 		WHERE port!=0
 			AND next_refresh != 0
-			AND next_refresh < strftime('%s', 'now')`
+			AND next_refresh < strftime('%s', 'now')
+			AND id NOT IN (
+				SELECT node_id FROM node_bans 
+				WHERE ban_until > strftime('%s', 'now'))`
 
 	row := db.QueryRow(query)
 	err = row.Scan(&max)
@@ -226,12 +511,493 @@ func addressesToUpdate() (addresses []ip_port, max int) {
 		logQueryError(query, err)
 	}
 
-	return addresses, max
+	return addresses, priorities, max
+}
+
+// Retrieve the nodes which are known by the most other nodes. These are the
+// best candidates for bootstrapping
+func GetTopBootstrapNodes(db *sql.DB, limit int) (addresses []ip_port, err error) {
+	query := `SELECT n.ip, n.port, COUNT(*) AS in_degree
+		FROM nodes_known nk
+		JOIN nodes n ON n.id = nk.id_known
+		GROUP BY nk.id_known
+		ORDER BY in_degree DESC
+		LIMIT ?`
+
+	rows, err := db.Query(query, limit)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	var (
+		ip, port  string
+		in_degree int
+	)
+	addresses = make([]ip_port, 0, limit)
+
+	for rows.Next() {
+		err = rows.Scan(&ip, &port, &in_degree)
+		if err != nil {
+			return
+		}
+		addresses = append(addresses, ip_port{ip: ip, port: port})
+	}
+
+	return addresses, rows.Err()
+}
+
+// Queue the best bootstrap nodes in `addresses`, in order and before any other
+// address. Returns the number of addresses which were queued
+func enqueueBootstrapNodes(db *sql.DB, addresses *AddressManager, limit int) (n int, err error) {
+	bootstrap, err := GetTopBootstrapNodes(db, limit)
+	if err != nil {
+		return
+	}
+
+	for _, addr := range bootstrap {
+		addresses.Push(addr, PRIORITY_BOOTSTRAP)
+	}
+
+	return len(bootstrap), nil
+}
+
+// Write the best bootstrap nodes to the given file, one address per line
+func writeBootstrapList(db *sql.DB, filename string, limit int) (err error) {
+	addresses, err := GetTopBootstrapNodes(db, limit)
+	if err != nil {
+		return
+	}
+
+	f, err := os.Create(filename)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	for _, addr := range addresses {
+		_, err = fmt.Fprintln(f, net.JoinHostPort(addr.ip, addr.port))
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// Summary of the state of the crawled network
+type NetworkStats struct {
+	TotalNodes   int // Nodes in the DB
+	OnlineNodes  int // Nodes which accepted a connection on their last refresh
+	SuccessNodes int // Nodes which completed a handshake on their last refresh
+	TotalEdges   int // Relations between nodes
+
+	IPv4Nodes int // Nodes with an IPv4 address
+	IPv6Nodes int // Nodes with an IPv6 address
+
+	OnlineByProtocol map[int]int // Online nodes by protocol version
+}
+
+// Returns the number of relations between nodes
+func TotalKnownEdges(db *sql.DB) (count int, err error) {
+	err = db.QueryRow("SELECT COUNT(*) FROM nodes_known").Scan(&count)
+	return
+}
+
+// Retrieve summary statistics about the crawled network
+func GetNetworkStats(db *sql.DB) (stats NetworkStats, err error) {
+	query := `SELECT COUNT(*), 
+			COALESCE(SUM(online), 0), 
+			COALESCE(SUM(success), 0)
+		FROM nodes`
+	err = db.QueryRow(query).Scan(&stats.TotalNodes, &stats.OnlineNodes,
+		&stats.SuccessNodes)
+	if err != nil {
+		return
+	}
+
+	stats.TotalEdges, err = TotalKnownEdges(db)
+	if err != nil {
+		return
+	}
+
+	stats.IPv4Nodes, stats.IPv6Nodes, err = GetIPVersionDistribution(db)
+	if err != nil {
+		return
+	}
+
+	stats.OnlineByProtocol, err = CountOnlineNodesByProtocol(db)
+	return
+}
+
+// Delete relations between nodes which were last updated before t. Returns
+// the number of deleted relations
+func DropEdgesOlderThan(db *sql.DB, t time.Time) (count int64, err error) {
+	res, err := db.Exec("DELETE FROM nodes_known WHERE updated_at < ?", t.Unix())
+	if err != nil {
+		return
+	}
+
+	return res.RowsAffected()
+}
+
+// Retrieve nodes which were added as neighbours but never successfully
+// crawled, and which have not been updated since at least `olderThan`. These
+// can be deleted or reprioritised.
+func GetNodesNeverSeen(db *sql.DB, olderThan time.Duration) ([]ip_port, error) {
+	return queryAddresses(db, `SELECT ip, port 
+		FROM nodes 
+		WHERE success=0 
+			AND online=0
+			AND updated_at < ?
+			AND next_refresh != 0`, time.Now().Add(-olderThan).Unix())
+}
+
+// Number of nodes updated during the last `window`. No update during a few
+// minutes means the crawler is stalled
+func GetNodesUpdatedInLastN(db *sql.DB, window time.Duration) (count int, err error) {
+	err = db.QueryRow("SELECT COUNT(*) FROM nodes WHERE updated_at >= ?",
+		time.Now().Add(-window).Unix()).Scan(&count)
+	return
+}
+
+// Retrieve nodes which were successfully crawled in the past but which have not
+// been online since at least `olderThan`. These are candidates for no longer
+// being crawled.
+func GetOfflineNodesOnceOnline(db *sql.DB, olderThan time.Duration) ([]ip_port, error) {
+	return queryAddresses(db, `SELECT ip, port 
+		FROM nodes 
+		WHERE online=0 
+			AND success=1
+			AND online_at < ?`, time.Now().Add(-olderThan).Unix())
+}
+
+// Retrieve nodes which caused at least minErrors protocol errors, of any type
+func DetectMisbehavingNodes(db *sql.DB, minErrors int) ([]ip_port, error) {
+	return queryAddresses(db, `SELECT n.ip, n.port 
+		FROM node_errors e 
+		JOIN nodes n ON n.id = e.node_id 
+		GROUP BY e.node_id 
+		HAVING SUM(e.count) >= ?`, minErrors)
+}
+
+// Retrieve the nodes advertised by at least minCount other nodes. These are
+// the best known nodes of the network
+func GetNodesSeenByCount(db *sql.DB, minCount int) ([]ip_port, error) {
+	return queryAddresses(db, `SELECT n.ip, n.port 
+		FROM nodes n 
+		JOIN nodes_known nk ON n.id = nk.id_known 
+		GROUP BY nk.id_known 
+		HAVING COUNT(*) >= ?`, minCount)
+}
+
+// Retrieve the nodes listening on the given port which completed a handshake
+// on their last refresh
+func GetNodesWithOpenPort(db *sql.DB, port uint16) ([]ip_port, error) {
+	return queryAddresses(db, `SELECT ip, port 
+		FROM nodes 
+		WHERE port=? AND success=1`, port)
+}
+
+// Period during which a node advertised a set of services
+type ServiceHistoryEntry struct {
+	Services  uint64
+	FirstSeen time.Time
+	LastSeen  time.Time
+}
+
+// Retrieve the successive sets of services advertised by the given node,
+// oldest first
+func GetServiceHistory(db *sql.DB, ip, port string) (history []ServiceHistoryEntry, err error) {
+	rows, err := db.Query(`SELECT h.services, h.first_seen, h.last_seen
+		FROM node_services_history h
+		JOIN nodes n ON n.id = h.node_id
+		WHERE n.ip=? AND n.port=?
+		ORDER BY h.first_seen, h.id`, ip, port)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	var services, first_seen, last_seen int64
+	history = make([]ServiceHistoryEntry, 0)
+
+	for rows.Next() {
+		err = rows.Scan(&services, &first_seen, &last_seen)
+		if err != nil {
+			return
+		}
+		history = append(history, ServiceHistoryEntry{
+			Services:  uint64(services),
+			FirstSeen: time.Unix(first_seen, 0),
+			LastSeen:  time.Unix(last_seen, 0),
+		})
+	}
+
+	return history, rows.Err()
+}
+
+// Retrieve the nodes which completed a handshake on their last refresh while
+// listening on a port other than the standard one of the network. Nodes
+// without a port are ignored. These may be misconfigured or not Bitcoin nodes
+func GetNodesWithAbnormalPorts(db *sql.DB, standardPort uint16) ([]ip_port, error) {
+	return queryAddresses(db, `SELECT ip, port 
+		FROM nodes 
+		WHERE port != ? AND port != 0 AND success=1`, standardPort)
+}
+
+// Retrieve the IPs of which several ports are known, with the ports of each in
+// increasing order. These may be services running multiple nodes on one host
+func GetDuplicateIPs(db *sql.DB) (duplicates map[string][]uint16, err error) {
+	rows, err := db.Query(`SELECT ip, port 
+		FROM nodes 
+		WHERE ip IN (SELECT ip FROM nodes GROUP BY ip HAVING COUNT(DISTINCT port) > 1) 
+		ORDER BY ip, port`)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	var (
+		ip   string
+		port uint16
+	)
+	duplicates = make(map[string][]uint16)
+
+	for rows.Next() {
+		err = rows.Scan(&ip, &port)
+		if err != nil {
+			return
+		}
+		duplicates[ip] = append(duplicates[ip], port)
+	}
+
+	return duplicates, rows.Err()
+}
+
+// Retrieve the addresses of nodes matching the given WHERE clause fragment.
+// Values MUST be passed through args to keep the query parameterised
+func FilterNodes(db *sql.DB, filter string, args ...interface{}) ([]ip_port, error) {
+	return queryAddresses(db, "SELECT ip, port FROM nodes WHERE "+filter, args...)
+}
+
+// Retrieve nodes whose user agent matches the given LIKE pattern
+func GetNodesByUserAgent(db *sql.DB, pattern string) ([]ip_port, error) {
+	return FilterNodes(db, "user_agent LIKE ?", pattern)
+}
+
+// Create a filter retrieving nodes whose user agent matches the given LIKE
+// pattern
+func FilterByUserAgent(pattern string) func(*sql.DB) ([]ip_port, error) {
+	return func(db *sql.DB) ([]ip_port, error) {
+		return GetNodesByUserAgent(db, pattern)
+	}
+}
+
+// Retrieve the nodes of the given autonomous system which completed a
+// handshake on their last refresh
+func GetNodesByASN(db *sql.DB, asn int) ([]ip_port, error) {
+	return FilterNodes(db, "asn=? AND success=1", asn)
+}
+
+// Create a filter retrieving the nodes of the given autonomous system
+func FilterByASN(asn int) func(*sql.DB) ([]ip_port, error) {
+	return func(db *sql.DB) ([]ip_port, error) {
+		return GetNodesByASN(db, asn)
+	}
+}
+
+// Run a query returning ip, port rows and collect the addresses
+func queryAddresses(db *sql.DB, query string, args ...interface{}) (addresses []ip_port, err error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	var ip, port string
+	addresses = make([]ip_port, 0)
+
+	for rows.Next() {
+		err = rows.Scan(&ip, &port)
+		if err != nil {
+			return
+		}
+		addresses = append(addresses, ip_port{ip: ip, port: port})
+	}
+
+	return addresses, rows.Err()
+}
+
+// Set the next time the given node should be refreshed. A value of 0 stops
+// updating the node
+func UpdateNextRefresh(db *sql.DB, ip, port string, nextRefresh int64) (err error) {
+	res, err := db.Exec("UPDATE nodes SET next_refresh=? WHERE ip=? AND port=?",
+		nextRefresh, ip, port)
+	if err != nil {
+		return
+	}
+
+	count, err := res.RowsAffected()
+	if err != nil {
+		return
+	}
+	if count == 0 {
+		return ErrNodeNotFound
+	}
+
+	return
+}
+
+// Poll the DB every interval for nodes created since the last poll and send
+// them to out, until stop is closed. Only nodes created after the call are
+// sent.
+func Watch(db *sql.DB, interval time.Duration, out chan<- dbNodeInfo, stop <-chan struct{}) {
+	// Nodes created in the same second as the watermark are told apart by id
+	var watermark, last_id int64
+
+	query := "SELECT strftime('%s', 'now'), COALESCE(MAX(id), 0) FROM nodes"
+	err := db.QueryRow(query).Scan(&watermark, &last_id)
+	if err != nil {
+		logQueryError(query, err)
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	query = `SELECT id, ip, port, protocol, user_agent, relay, next_refresh,
+			online, online_at, success, success_at, created_at
+		FROM nodes 
+		WHERE created_at >= ? AND id > ?
+		ORDER BY id`
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		rows, err := db.Query(query, watermark, last_id)
+		if err != nil {
+			logQueryError(query, err)
+			continue
+		}
+
+		created := make([]dbNodeInfo, 0)
+		for rows.Next() {
+			var (
+				n          dbNodeInfo
+				created_at int64
+			)
+			err = rows.Scan(&n.id, &n.ip, &n.port, &n.protocol, &n.user_agent,
+				&n.relay, &n.next_refresh, &n.online, &n.online_at, &n.success,
+				&n.success_at, &created_at)
+			if err != nil {
+				logQueryError(query, err)
+				break
+			}
+
+			created = append(created, n)
+			watermark, last_id = created_at, n.id
+		}
+		rows.Close()
+
+		// Send after closing rows so that the connection is not held while
+		// the caller is slow to receive
+		for _, n := range created {
+			select {
+			case out <- n:
+			case <-stop:
+				return
+			}
+		}
+	}
+}
+
+// A run of the crawler
+type CrawlSession struct {
+	ID  int64  `json:"id"`
+	Tag string `json:"tag"`
+
+	StartedAt time.Time `json:"started_at"`
+	EndedAt   time.Time `json:"ended_at"` // Zero if the session is running
+
+	Network        string `json:"network"`
+	NodeCountStart int    `json:"node_count_start"`
+	NodeCountEnd   int    `json:"node_count_end"`
+
+	Config json.RawMessage `json:"config"`
+}
+
+// Record the start of a crawler run with the given configuration. Returns the
+// id of the session
+func startCrawlSession(db *sql.DB, tag, network string, config interface{}) (id int64, err error) {
+	config_json, err := json.Marshal(config)
+	if err != nil {
+		return
+	}
+
+	res, err := db.Exec(`INSERT INTO crawler_sessions 
+			(tag, started_at, network, node_count_start, config_json)
+		VALUES (?, ?, ?, (SELECT COUNT(*) FROM nodes), ?)`,
+		tag, time.Now().Unix(), network, string(config_json))
+	if err != nil {
+		return
+	}
+
+	return res.LastInsertId()
+}
+
+// Record the end of the given crawler run
+func endCrawlSession(db *sql.DB, id int64) (err error) {
+	_, err = db.Exec(`UPDATE crawler_sessions 
+		SET ended_at=?, node_count_end=(SELECT COUNT(*) FROM nodes) 
+		WHERE id=?`, time.Now().Unix(), id)
+	return
+}
+
+// Retrieve all crawler runs, most recent first
+func GetCrawlSessions(db *sql.DB) (sessions []CrawlSession, err error) {
+	rows, err := db.Query(`SELECT id, tag, started_at, ended_at, network, 
+			node_count_start, node_count_end, config_json
+		FROM crawler_sessions
+		ORDER BY started_at DESC, id DESC`)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	var (
+		s                    CrawlSession
+		started_at, ended_at int64
+		config_json          string
+	)
+	sessions = make([]CrawlSession, 0)
+
+	for rows.Next() {
+		err = rows.Scan(&s.ID, &s.Tag, &started_at, &ended_at, &s.Network,
+			&s.NodeCountStart, &s.NodeCountEnd, &config_json)
+		if err != nil {
+			return
+		}
+
+		s.StartedAt = time.Unix(started_at, 0)
+		s.EndedAt = time.Time{}
+		if ended_at != 0 {
+			s.EndedAt = time.Unix(ended_at, 0)
+		}
+		s.Config = json.RawMessage(config_json)
+
+		sessions = append(sessions, s)
+	}
+
+	return sessions, rows.Err()
 }
 
 // Save the node to the database
 func (node *Node) Save(db *sql.DB) (err error) {
-	dbnode := nodeDB{node: node}
+	dbnode := nodeDB{node: node, db: db}
 	return dbnode.Save(db)
 }
 
@@ -249,14 +1015,30 @@ func (n *nodeDB) Save(db *sql.DB) (err error) {
 		}
 	}
 
+	save_timer := NewStatTimer("save")
+	defer save_timer.Stop()
+
+	n.load(db)
+	return n.store(db)
+}
+
+// Get existing information from current node if any. It is read in a
+// transaction of its own: if another goroutine saves the node before it is
+// stored, dbBeginPutNode writes it again
+func (n *nodeDB) load(db *sql.DB) {
+	var err error
+
 	n.tx, err = db.Begin()
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer n.tx.Rollback()
-
-	// Get existing information from current node if any
 	n.dbGetNode()
+	n.tx.Rollback()
+}
+
+// Update the information read by load with the result of the refresh of the
+// node, and write it along with its relations to other nodes
+func (n *nodeDB) store(db *sql.DB) (err error) {
 	// Update last updated time
 	n.now = time.Now().Unix()
 
@@ -269,12 +1051,18 @@ func (n *nodeDB) Save(db *sql.DB) (err error) {
 		n.dbInfo.online_at = n.now
 
 		n.dbInfo.next_refresh = n.now + (NODE_REFRESH_INTERVAL * 3600)
+		if n.node.Excluded {
+			n.dbInfo.next_refresh = n.now + (EXCLUDED_REFRESH_INTERVAL * 3600)
+		}
 	}
 
 	// Was able initiate communication with node
 	if n.node.Version != nil {
 		n.dbInfo.protocol = int(n.node.Version.Protocol)
 		n.dbInfo.user_agent = n.node.Version.UserAgent
+		n.dbInfo.relay = n.node.Version.Relay
+		n.dbInfo.services = n.node.Version.Services
+		n.dbInfo.start_height = n.node.Version.StartHeight
 
 		n.dbInfo.success = true
 		n.dbInfo.success_at = n.now
@@ -282,7 +1070,19 @@ func (n *nodeDB) Save(db *sql.DB) (err error) {
 		n.dbInfo.success = false
 	}
 
-	n.dbPutNode()
+	err = n.dbBeginPutNode(db)
+	if err != nil {
+		return
+	}
+	defer n.tx.Rollback()
+
+	n.dbPutSession()
+	n.dbPutErrors()
+
+	if n.node.Version != nil {
+		n.dbPutServices(uint64(n.node.Version.Services))
+		n.dbPutFingerprint(ComputeFingerprint(*n.node.Version))
+	}
 
 	// Update neighbour nodes
 
@@ -291,7 +1091,7 @@ func (n *nodeDB) Save(db *sql.DB) (err error) {
 
 	// Update next_refresh if necessary
 	for _, addr := range n.node.Addresses {
-		canon_addr := net.JoinHostPort(addr.IP.String(), strconv.Itoa(int(addr.Port)))
+		canon_addr := CanonicalNetAddr(addr)
 
 		neigh := n.dbNeighbours[canon_addr]
 		if neigh.next_refresh < n.now {
@@ -300,6 +1100,7 @@ func (n *nodeDB) Save(db *sql.DB) (err error) {
 		}
 	}
 	n.dbPutNeighbours()
+	n.dbPutAddressesSeen()
 
 	err = n.tx.Commit()
 	if err != nil {
@@ -308,34 +1109,81 @@ func (n *nodeDB) Save(db *sql.DB) (err error) {
 	return
 }
 
+// Get a prepared statement for the query bound to the current transaction.
+// The statement is prepared once per DB if n.db is set. It must be closed
+// after use.
+func (n *nodeDB) prepare(query string) (*sql.Stmt, error) {
+	if n.db == nil {
+		return n.tx.Prepare(query)
+	}
+
+	key := stmtKey{db: n.db, query: query}
+	cached, ok := stmtCache.Load(key)
+	if !ok {
+		stmt, err := n.db.Prepare(query)
+		if err != nil {
+			return nil, err
+		}
+
+		// Another goroutine may have prepared the same statement
+		var loaded bool
+		cached, loaded = stmtCache.LoadOrStore(key, stmt)
+		if loaded {
+			stmt.Close()
+		}
+	}
+
+	return n.tx.Stmt(cached.(*sql.Stmt)), nil
+}
+
 // Retrive database information about a single node
 func (n *nodeDB) dbGetNode() {
 	if n.tx == nil {
 		log.Fatal("Transaction not initialized")
 	}
 
-	// Get dates with strftime to get timestamps
-	query := `SELECT id, protocol, user_agent, online, online_at, 
-				success, success_at, next_refresh
-			FROM nodes 
-			WHERE ip=?
-  			  AND port=?`
-	row := n.tx.QueryRow(query, n.dbInfo.ip, n.dbInfo.port)
-
-	err := row.Scan(&(n.dbInfo.id), &(n.dbInfo.protocol), &(n.dbInfo.user_agent),
-		&(n.dbInfo.online), &(n.dbInfo.online_at),
-		&(n.dbInfo.success), &(n.dbInfo.success_at),
-		&(n.dbInfo.next_refresh))
+	info, err := n.queryNode()
 
 	// Ignore if err if node does not exist
 	switch {
 	case err == sql.ErrNoRows:
 		n.dbInfo.id = -1
 	case err != nil:
-		logQueryError(query, err)
+		logQueryError(QUERY_GET_NODE, err)
+	default:
+		n.dbInfo = info
+		n.stored = info
 	}
 }
 
+// Stored information about a node. updated_at is cast so that it is read as a
+// timestamp
+const QUERY_GET_NODE = `SELECT id, protocol, user_agent, relay, services, start_height, 
+				online, online_at, success, success_at, next_refresh, 
+				CAST(updated_at AS INTEGER)
+			FROM nodes 
+			WHERE ip=?
+  			  AND port=?`
+
+// Read the information currently stored about the node, without modifying
+// n.dbInfo
+func (n *nodeDB) queryNode() (info dbNodeInfo, err error) {
+	info.ip = n.dbInfo.ip
+	info.port = n.dbInfo.port
+
+	// Services are stored as int64, see dbPutServices
+	var services int64
+
+	row := n.tx.QueryRow(QUERY_GET_NODE, n.dbInfo.ip, n.dbInfo.port)
+	err = row.Scan(&(info.id), &(info.protocol), &(info.user_agent),
+		&(info.relay), &services, &(info.start_height),
+		&(info.online), &(info.online_at),
+		&(info.success), &(info.success_at),
+		&(info.next_refresh), &(info.updated_at))
+	info.services = ServiceFlag(services)
+	return
+}
+
 // Retrieve only the id for the given node
 func (n *nodeDB) dbGetNodeId() {
 	if n.tx == nil {
@@ -360,49 +1208,223 @@ func (n *nodeDB) dbGetNodeId() {
 	}
 }
 
-// Save a node to the DB and store its id
-func (n *nodeDB) dbPutNode() {
+// Begin the transaction saving the node and write the node in it with
+// dbPutNode. If another goroutine saved the node since it was read, the
+// transaction is restarted and the node is written again, merged with the
+// stored version if it was refreshed in the meantime. Fails after
+// MAX_SAVE_RETRIES restarts, with the transaction rolled back
+func (n *nodeDB) dbBeginPutNode(db *sql.DB) (err error) {
+	for retries := 0; ; retries++ {
+		n.tx, err = db.Begin()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if n.dbPutNode() {
+			return
+		}
+		n.tx.Rollback()
+
+		if retries == MAX_SAVE_RETRIES {
+			return fmt.Errorf("dbBeginPutNode: Node %s %s saved concurrently %d times",
+				n.dbInfo.ip, n.dbInfo.port, retries+1)
+		}
+
+		// Read the stored version outside of the transaction writing the node,
+		// like in Save
+		n.tx, err = db.Begin()
+		if err != nil {
+			log.Fatal(err)
+		}
+		stored, err := n.queryNode()
+		n.tx.Rollback()
+
+		switch {
+		case err == sql.ErrNoRows:
+			n.dbInfo.id = ID_NOT_IN_DB
+			n.stored = dbNodeInfo{}
+		case err != nil:
+			logQueryError(QUERY_GET_NODE, err)
+		default:
+			// Only a refresh of the node changes the results of its
+			// connection. Other writers, such as the refresh of a neighbour,
+			// only rescheduled it: this refresh just computed its schedule
+			if stored.online_at != n.stored.online_at ||
+				stored.success_at != n.stored.success_at {
+				n.dbInfo = n.dbInfo.Merge(stored)
+			}
+
+			// The stored version is the one expected by the next write
+			n.dbInfo.id = stored.id
+			n.dbInfo.updated_at = stored.updated_at
+			n.stored = stored
+		}
+		chstatcounter <- Stat{"save_merged", 1}
+	}
+}
+
+// Save a node to the DB and store its id. The node is only written if it was
+// not saved by another transaction since it was read with dbGetNode, i.e. if
+// its updated_at did not change. An unknown node (ID_UNKNOWN) is always
+// written. Returns whether the node was written.
+//
+// updated_at has a resolution of one second: a save by another transaction
+// in the same second as the one which was read is not detected
+func (n *nodeDB) dbPutNode() (written bool) {
 	if n.tx == nil {
 		log.Fatal("Transaction not initialized")
 	}
 
-	// Retrieve info from DB if state unknown
-	if n.dbInfo.id == ID_UNKNOWN {
+	// Retrieve info from DB if state unknown. The node is then overwritten
+	overwrite := n.dbInfo.id == ID_UNKNOWN
+	if overwrite {
 		n.dbGetNodeId()
 	}
 
 	var (
 		err   error
+		res   sql.Result
 		query string
 	)
-	params := [11]interface{}{n.dbInfo.ip, n.dbInfo.port, n.dbInfo.next_refresh,
-		n.dbInfo.protocol, n.dbInfo.user_agent,
+	params := [15]interface{}{n.dbInfo.ip, n.dbInfo.port, n.dbInfo.next_refresh,
+		n.dbInfo.protocol, n.dbInfo.user_agent, n.dbInfo.relay,
+		int64(n.dbInfo.services), n.dbInfo.start_height,
 		n.dbInfo.online, n.dbInfo.online_at,
 		n.dbInfo.success, n.dbInfo.success_at,
-		n.now, 0}
+		n.now, 0, 0}
 
 	if n.dbInfo.id == ID_NOT_IN_DB {
+		// Another transaction may have inserted the node since it was read
 		query = `INSERT INTO nodes (ip, port, next_refresh, protocol, user_agent, 
-					online, online_at, success, success_at, updated_at)
-				VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
-		_, err = n.tx.Exec(query, params[:10]...)
+					relay, services, start_height, online, online_at, success, 
+					success_at, updated_at)
+				SELECT ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?
+				WHERE NOT EXISTS (SELECT 1 FROM nodes WHERE ip=? AND port=?)`
+		params[13], params[14] = n.dbInfo.ip, n.dbInfo.port
+		res, err = n.tx.Exec(query, params[:15]...)
 	} else {
 		query = `UPDATE nodes SET ip=?, port=?, next_refresh=?, protocol=?, 
-					user_agent=?, online=?, online_at=?, success=?, success_at=?, 
-					updated_at=?
+					user_agent=?, relay=?, services=?, start_height=?, online=?, 
+					online_at=?, success=?, success_at=?, updated_at=?
 					WHERE id=?`
-		params[10] = n.dbInfo.id
-		_, err = n.tx.Exec(query, params[:11]...)
+		params[13] = n.dbInfo.id
+		num_params := 14
+		if !overwrite {
+			query += " AND CAST(updated_at AS INTEGER)=?"
+			params[14] = n.dbInfo.updated_at
+			num_params = 15
+		}
+		res, err = n.tx.Exec(query, params[:num_params]...)
 	}
 
 	if err != nil {
 		logQueryError(query, err)
 	}
 
+	affected, err := res.RowsAffected()
+	if err != nil {
+		logQueryError(query, err)
+	}
+	if affected == 0 {
+		return false
+	}
+
 	// Retrieve the inserted row's id if previously unknown
-	if n.dbInfo.id == ID_UNKNOWN || n.dbInfo.id == ID_NOT_IN_DB {
+	if n.dbInfo.id == ID_NOT_IN_DB {
 		n.dbGetNode()
 	}
+
+	return true
+}
+
+// Record the result of the current refresh of the node
+func (n *nodeDB) dbPutSession() {
+	if n.tx == nil {
+		log.Fatal("Transaction not initialized")
+	}
+
+	query := `INSERT INTO node_sessions (node_id, started_at, online, success)
+			VALUES (?, ?, ?, ?)`
+	_, err := n.tx.Exec(query, n.dbInfo.id, n.now, n.dbInfo.online, n.dbInfo.success)
+	if err != nil {
+		logQueryError(query, err)
+	}
+}
+
+// Add the protocol errors caused by the node during this refresh to its totals
+func (n *nodeDB) dbPutErrors() {
+	if n.tx == nil {
+		log.Fatal("Transaction not initialized")
+	}
+
+	update := `UPDATE node_errors SET count=count+?, updated_at=? 
+		WHERE node_id=? AND error_type=?`
+	insert := `INSERT INTO node_errors (node_id, error_type, count, updated_at)
+			VALUES (?, ?, ?, ?)`
+
+	for error_type, count := range n.node.Errors {
+		res, err := n.tx.Exec(update, count, n.now, n.dbInfo.id, error_type)
+		if err != nil {
+			logQueryError(update, err)
+			continue
+		}
+
+		if affected, _ := res.RowsAffected(); affected > 0 {
+			continue
+		}
+
+		_, err = n.tx.Exec(insert, n.dbInfo.id, error_type, count, n.now)
+		if err != nil {
+			logQueryError(insert, err)
+		}
+	}
+}
+
+// Record the fingerprint computed from the last version message of the node
+func (n *nodeDB) dbPutFingerprint(f NodeFingerprint) {
+	if n.tx == nil {
+		log.Fatal("Transaction not initialized")
+	}
+
+	query := `INSERT OR REPLACE INTO node_fingerprints 
+			(node_id, has_relay, user_agent_bucket, protocol_band, services, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?)`
+	_, err := n.tx.Exec(query, n.dbInfo.id, f.HasRelay, f.UserAgentBucket,
+		f.ProtocolBand, int64(f.ServiceFlags), n.now)
+	if err != nil {
+		logQueryError(query, err)
+	}
+}
+
+// Record the services currently advertised by the node. A new history entry is
+// created if they changed since the last crawl. Services are stored as int64
+// as database/sql does not support uint64 values with the high bit set
+func (n *nodeDB) dbPutServices(services uint64) {
+	if n.tx == nil {
+		log.Fatal("Transaction not initialized")
+	}
+
+	var id, db_services int64
+
+	query := `SELECT id, services 
+			FROM node_services_history 
+			WHERE node_id=?
+			ORDER BY last_seen DESC, id DESC
+			LIMIT 1`
+	err := n.tx.QueryRow(query, n.dbInfo.id).Scan(&id, &db_services)
+
+	switch {
+	case err == sql.ErrNoRows || (err == nil && uint64(db_services) != services):
+		query = `INSERT INTO node_services_history (node_id, services, first_seen, last_seen)
+				VALUES (?, ?, ?, ?)`
+		_, err = n.tx.Exec(query, n.dbInfo.id, int64(services), n.now, n.now)
+	case err == nil:
+		query = "UPDATE node_services_history SET last_seen=? WHERE id=?"
+		_, err = n.tx.Exec(query, n.now, id)
+	}
+
+	if err != nil {
+		logQueryError(query, err)
+	}
 }
 
 // Gets id and next_refresh for neighbour nodes. Stores in n.dbNeighbours
@@ -422,7 +1444,7 @@ func (n *nodeDB) dbGetNeighbours() {
 
 	// Prepare query
 	query := "SELECT id, next_refresh FROM nodes WHERE ip=? AND port=?"
-	stmt, err := n.tx.Prepare(query)
+	stmt, err := n.prepare(query)
 	if err != nil {
 		logQueryError(query, err)
 	}
@@ -443,7 +1465,7 @@ func (n *nodeDB) dbGetNeighbours() {
 	for i := 0; i < len(n.node.Addresses); i++ {
 		ip = n.node.Addresses[i].IP.String()
 		port = strconv.Itoa(int(n.node.Addresses[i].Port))
-		canon_addr = net.JoinHostPort(ip, port)
+		canon_addr = CanonicalNetAddr(n.node.Addresses[i])
 
 		row = stmt.QueryRow(ip, port)
 		err = row.Scan(&id, &next_refresh)
@@ -490,21 +1512,21 @@ func (n *nodeDB) dbPutNeighbours() {
 
 	// Prepare node queries
 	select_node_query := "SELECT id FROM nodes WHERE ip=? AND port=?"
-	select_node_stmt, err := n.tx.Prepare(select_node_query)
+	select_node_stmt, err := n.prepare(select_node_query)
 	if err != nil {
 		logQueryError(select_node_query, err)
 	}
 	defer select_node_stmt.Close()
 
 	insert_node_query := "INSERT INTO nodes (ip, port, next_refresh, updated_at) VALUES (?, ?, ?, ?)"
-	insert_node_stmt, err := n.tx.Prepare(insert_node_query)
+	insert_node_stmt, err := n.prepare(insert_node_query)
 	if err != nil {
 		logQueryError(insert_node_query, err)
 	}
 	defer insert_node_stmt.Close()
 
 	update_node_query := "UPDATE nodes SET next_refresh=?, updated_at=? WHERE id=?"
-	update_node_stmt, err := n.tx.Prepare(update_node_query)
+	update_node_stmt, err := n.prepare(update_node_query)
 	if err != nil {
 		logQueryError(update_node_query, err)
 	}
@@ -512,21 +1534,21 @@ func (n *nodeDB) dbPutNeighbours() {
 
 	// Prepare known nodes queries
 	select_known_query := "SELECT id FROM nodes_known WHERE id_source=? AND id_known=?"
-	select_known_stmt, err := n.tx.Prepare(select_known_query)
+	select_known_stmt, err := n.prepare(select_known_query)
 	if err != nil {
 		logQueryError(select_known_query, err)
 	}
 	defer select_known_stmt.Close()
 
 	insert_known_query := "INSERT INTO nodes_known (id_source, id_known, updated_at) VALUES (?, ?, ?)"
-	insert_known_stmt, err := n.tx.Prepare(insert_known_query)
+	insert_known_stmt, err := n.prepare(insert_known_query)
 	if err != nil {
 		logQueryError(insert_known_query, err)
 	}
 	defer insert_known_stmt.Close()
 
 	update_known_query := "UPDATE nodes_known SET updated_at=? WHERE id=?"
-	update_known_stmt, err := n.tx.Prepare(update_known_query)
+	update_known_stmt, err := n.prepare(update_known_query)
 	if err != nil {
 		logQueryError(update_known_query, err)
 	}
@@ -604,6 +1626,29 @@ func (n *nodeDB) dbPutNeighbours() {
 	}
 }
 
+// Log the addresses advertised by the node
+func (n *nodeDB) dbPutAddressesSeen() {
+	if len(n.node.Addresses) == 0 {
+		return
+	}
+
+	query := `INSERT INTO addresses_seen (id_source, ip, port, addr_timestamp, seen_at) 
+			VALUES (?, ?, ?, ?, ?)`
+	stmt, err := n.prepare(query)
+	if err != nil {
+		logQueryError(query, err)
+	}
+	defer stmt.Close()
+
+	for _, addr := range n.node.Addresses {
+		_, err = stmt.Exec(n.dbInfo.id, addr.IP.String(), addr.Port,
+			addr.Timestamp.Unix(), n.now)
+		if err != nil {
+			logQueryError(query, err)
+		}
+	}
+}
+
 // Log a query error. Calls os.Exit(1)
 func logQueryError(query string, err error) {
 	log.Print(query)
@@ -3,15 +3,16 @@ package main
 import (
 	"database/sql"
 	"net"
+	"path/filepath"
 	"reflect"
+	"strconv"
 	"testing"
-
-	_ "github.com/mattn/go-sqlite3"
+	"time"
 )
 
 // Get a connection to an temporary empty DB
 func tempDB(t *testing.T) *sql.DB {
-	db, err := sql.Open("sqlite3", ":memory:")
+	db, err := sql.Open(SQLITE_DRIVER, ":memory:")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -21,6 +22,72 @@ func tempDB(t *testing.T) *sql.DB {
 	return db
 }
 
+// Insert nodes with ids 1..numNodes into the DB along with the given
+// (id_source, id_known) relations. Node i has address i.i.i.i:i
+func tempGraph(t *testing.T, db *sql.DB, numNodes int, edges [][2]int64) {
+	stmt, err := db.Prepare("INSERT INTO nodes (id, ip, port, updated_at) VALUES (?,?,?,?)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= numNodes; i++ {
+		ip := net.IPv4(byte(i), byte(i), byte(i), byte(i))
+		_, err = stmt.Exec(i, ip.String(), i, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	stmt.Close()
+
+	stmt, err = db.Prepare("INSERT INTO nodes_known (id_source, id_known, updated_at) VALUES (?,?,?)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range edges {
+		_, err = stmt.Exec(e[0], e[1], 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	stmt.Close()
+}
+
+// Set up a pool of DB connections containing only the given DB, for
+// functions which use acquireDBConn
+func tempDBPool(db *sql.DB) {
+	dbConnectionPool = make(chan *sql.DB, 1)
+	dbConnectionPool <- db
+}
+
+func TestMigrateDB(t *testing.T) {
+	db, err := sql.Open(SQLITE_DRIVER, ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// DB created by a version without the migrated columns
+	_, err = db.Exec(`CREATE TABLE "nodes" ("id" INTEGER PRIMARY KEY, "ip" TEXT);
+		CREATE TABLE "node_bans" ("node_id" INTEGER PRIMARY KEY, "ban_until" DATE)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(`INSERT INTO nodes (ip) VALUES ('1.1.1.1')`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	migrateDB(db)
+
+	for _, c := range MIGRATIONS {
+		if !hasColumn(db, c.table, c.name) {
+			t.Error("Missing column ", c.name, " in ", c.table, " after migration")
+		}
+	}
+
+	// Migrating twice must not fail
+	migrateDB(db)
+}
+
 func TestDbGetNode(t *testing.T) {
 	var err error
 	db := tempDB(t)
@@ -60,10 +127,10 @@ func TestDbGetNode(t *testing.T) {
 	}
 
 	_, err = n.tx.Exec(`INSERT INTO nodes (id, ip, port, next_refresh, protocol, 
-										user_agent, online, 
+										user_agent, services, start_height, online, 
 										online_at, success, success_at, 
 										updated_at) VALUES 
-						(5, 'ip', '999', 456, 27, 'user_agent', 1, 123, 1, 321, 234)`)
+						(5, 'ip', '999', 456, 27, 'user_agent', 1033, 800000, 1, 123, 1, 321, 234)`)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -81,10 +148,13 @@ func TestDbGetNode(t *testing.T) {
 		next_refresh: 456,
 		protocol:     27,
 		user_agent:   "user_agent",
+		services:     1033,
+		start_height: 800000,
 		online:       true,
 		online_at:    123,
 		success:      true,
 		success_at:   321,
+		updated_at:   234,
 	}
 
 	if !reflect.DeepEqual(n.dbInfo, expected) {
@@ -113,6 +183,9 @@ func TestDbPutNode(t *testing.T) {
 		next_refresh: 456,
 		protocol:     27,
 		user_agent:   "user_agent",
+		relay:        true,
+		services:     1033,
+		start_height: 800000,
 		online:       true,
 		online_at:    123,
 		success:      true,
@@ -122,11 +195,11 @@ func TestDbPutNode(t *testing.T) {
 
 	got := dbNodeInfo{}
 	row := n.tx.QueryRow(`SELECT id, ip, port, next_refresh, protocol, 
-		user_agent, online, online_at, success, success_at 
+		user_agent, relay, services, start_height, online, online_at, success, success_at 
 		FROM nodes WHERE ip='ip' AND port='999'`)
 	err = row.Scan(&(got.id), &(got.ip), &(got.port), &(got.next_refresh),
-		&(got.protocol), &(got.user_agent), &(got.online), &(got.online_at),
-		&(got.success), &(got.success_at))
+		&(got.protocol), &(got.user_agent), &(got.relay), &(got.services), &(got.start_height),
+		&(got.online), &(got.online_at), &(got.success), &(got.success_at))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -137,6 +210,9 @@ func TestDbPutNode(t *testing.T) {
 		next_refresh: 456,
 		protocol:     27,
 		user_agent:   "user_agent",
+		relay:        true,
+		services:     1033,
+		start_height: 800000,
 		online:       true,
 		online_at:    123,
 		success:      true,
@@ -174,6 +250,7 @@ func TestDbPutNode(t *testing.T) {
 		next_refresh: 456,
 		protocol:     27,
 		user_agent:   "user_agent",
+		relay:        true,
 		online:       true,
 		online_at:    123,
 		success:      true,
@@ -183,10 +260,10 @@ func TestDbPutNode(t *testing.T) {
 
 	got = dbNodeInfo{}
 	row = n.tx.QueryRow(`SELECT id, ip, port, next_refresh, protocol, 
-		user_agent, online, online_at, success, success_at
+		user_agent, relay, online, online_at, success, success_at
 		FROM nodes WHERE ip='ip' AND port='999'`)
 	err = row.Scan(&(got.id), &(got.ip), &(got.port), &(got.next_refresh),
-		&(got.protocol), &(got.user_agent), &(got.online), &(got.online_at),
+		&(got.protocol), &(got.user_agent), &(got.relay), &(got.online), &(got.online_at),
 		&(got.success), &(got.success_at))
 	if err != nil {
 		t.Fatal(err)
@@ -199,6 +276,7 @@ func TestDbPutNode(t *testing.T) {
 		next_refresh: 456,
 		protocol:     27,
 		user_agent:   "user_agent",
+		relay:        true,
 		online:       true,
 		online_at:    123,
 		success:      true,
@@ -215,208 +293,664 @@ func TestDbPutNode(t *testing.T) {
 	n.tx.Rollback()
 }
 
-func TestDbGetNeighbours(t *testing.T) {
-	var err error
-	db := tempDB(t)
-	defer db.Close()
+func TestDbNodeInfoMerge(t *testing.T) {
+	older := dbNodeInfo{
+		id:           5,
+		ip:           "ip",
+		port:         "999",
+		next_refresh: 1000,
+		protocol:     70015,
+		user_agent:   "old",
+		relay:        true,
+		online:       true,
+		online_at:    300,
+		success:      true,
+		success_at:   300,
+		updated_at:   300,
+	}
+	newer := dbNodeInfo{
+		id:           5,
+		ip:           "ip",
+		port:         "999",
+		next_refresh: 0,
+		protocol:     70016,
+		user_agent:   "new",
+		online:       false,
+		online_at:    200,
+		success:      false,
+		success_at:   400,
+		updated_at:   500,
+	}
 
-	// Add nodes to the DB
-	stmt, err := db.Prepare("INSERT INTO nodes (id, ip, port, next_refresh) VALUES (?,?,?,?)")
+	expected := dbNodeInfo{
+		id:           5,
+		ip:           "ip",
+		port:         "999",
+		next_refresh: 1000,
+		protocol:     70016,
+		user_agent:   "new",
+		relay:        false,
+		online:       true,
+		online_at:    300,
+		success:      true,
+		success_at:   400,
+		updated_at:   500,
+	}
+
+	got := older.Merge(newer)
+	if !reflect.DeepEqual(expected, got) {
+		t.Error("Merge expected ", expected, " got ", got)
+	}
+	got = newer.Merge(older)
+	if !reflect.DeepEqual(expected, got) {
+		t.Error("Reverse merge expected ", expected, " got ", got)
+	}
+}
+
+// Open two connections to the same temporary DB file, as used by two
+// goroutines saving nodes
+func tempSharedDB(t *testing.T) (db, other *sql.DB) {
+	path := filepath.Join(t.TempDir(), "data.db")
+
+	db, err := sql.Open(SQLITE_DRIVER, path)
 	if err != nil {
 		t.Fatal(err)
 	}
+	t.Cleanup(func() { db.Close() })
+	setupDB(db)
 
-	for i := 0; i < 10; i++ {
-		id := i + 1
-		ip := net.IPv4(byte(i), byte(i), byte(i), byte(i))
-		port := uint16(i)
-		next_refresh := i * 2
-		_, err = stmt.Exec(id, ip.String(), port, next_refresh)
-		if err != nil {
-			t.Fatal(err)
-		}
+	other, err = sql.Open(SQLITE_DRIVER, path)
+	if err != nil {
+		t.Fatal(err)
 	}
-	stmt.Close()
+	t.Cleanup(func() { other.Close() })
 
-	// TEST: Exising nodes
-	n := &nodeDB{}
-	n.tx, err = db.Begin()
+	return
+}
+
+func TestDbPutNodeMergesConcurrentUpdate(t *testing.T) {
+	var err error
+	db, other := tempSharedDB(t)
+	drainStats()
+	defer drainStats()
+
+	_, err = db.Exec(`INSERT INTO nodes (id, ip, port, next_refresh, protocol, 
+			user_agent, online, online_at, success, success_at, updated_at) 
+		VALUES (5, 'ip', '999', 456, 70015, 'ua', 0, 0, 0, 0, 100)`)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	addresses := []NetAddr{
-		NetAddr{IP: net.IPv4(0, 0, 0, 0), Port: uint16(0)},
-		NetAddr{IP: net.IPv4(1, 1, 1, 1), Port: uint16(1)},
-		NetAddr{IP: net.IPv4(2, 2, 2, 2), Port: uint16(2)},
-		NetAddr{IP: net.IPv4(3, 3, 3, 3), Port: uint16(3)},
+	n := &nodeDB{dbInfo: dbNodeInfo{ip: "ip", port: "999"}}
+	n.tx, err = db.Begin()
+	if err != nil {
+		t.Fatal(err)
 	}
+	n.dbGetNode()
+	n.tx.Rollback()
 
-	n.node = &Node{
-		Addresses: addresses[:],
+	// Another goroutine records a successful handshake in the meantime
+	_, err = other.Exec(`UPDATE nodes SET online=1, online_at=200, success=1, 
+			success_at=200, next_refresh=900, updated_at=200 WHERE id=5`)
+	if err != nil {
+		t.Fatal(err)
 	}
-	n.dbGetNeighbours()
 
-	expected := make(map[string]dbNeighbourInfo)
-	expected["0.0.0.0:0"] = dbNeighbourInfo{id: 1, next_refresh: 0}
-	expected["1.1.1.1:1"] = dbNeighbourInfo{id: 2, next_refresh: 2}
-	expected["2.2.2.2:2"] = dbNeighbourInfo{id: 3, next_refresh: 4}
-	expected["3.3.3.3:3"] = dbNeighbourInfo{id: 4, next_refresh: 6}
+	// This update failed to connect
+	n.now = 300
+	n.dbInfo.online = false
+	n.dbInfo.success = false
+	n.dbInfo.next_refresh = 0
 
-	if !reflect.DeepEqual(expected, n.dbNeighbours) {
-		t.Error("Existing nodes expected ", expected, " got ", n.dbNeighbours)
+	// TEST: The node is not overwritten
+	n.tx, err = db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.dbPutNode() {
+		t.Error("Expected node saved since it was read not to be written")
 	}
 	n.tx.Rollback()
 
-	// TEST: Non existing nodes
-	n = &nodeDB{}
-	n.tx, err = db.Begin()
+	// TEST: The node is written merged with the stored version
+	n.dbBeginPutNode(db)
+	err = n.tx.Commit()
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	addresses = []NetAddr{
-		NetAddr{IP: net.IPv4(10, 0, 0, 0), Port: uint16(0)},
-		NetAddr{IP: net.IPv4(11, 1, 1, 1), Port: uint16(1)},
-		NetAddr{IP: net.IPv4(12, 2, 2, 2), Port: uint16(2)},
-		NetAddr{IP: net.IPv4(13, 3, 3, 3), Port: uint16(3)},
+	got := dbNodeInfo{}
+	err = other.QueryRow(`SELECT online, online_at, success, success_at, next_refresh, 
+			CAST(updated_at AS INTEGER) 
+		FROM nodes WHERE id=5`).Scan(&got.online, &got.online_at, &got.success,
+		&got.success_at, &got.next_refresh, &got.updated_at)
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	n.node = &Node{
-		Addresses: addresses[:],
+	expected := dbNodeInfo{online: true, online_at: 200, success: true,
+		success_at: 200, next_refresh: 900, updated_at: 300}
+	if !reflect.DeepEqual(expected, got) {
+		t.Error("Merged node expected ", expected, " got ", got)
 	}
-	n.dbGetNeighbours()
+}
 
-	expected = make(map[string]dbNeighbourInfo)
-	expected["10.0.0.0:0"] = dbNeighbourInfo{id: -1, next_refresh: 0}
-	expected["11.1.1.1:1"] = dbNeighbourInfo{id: -1, next_refresh: 0}
-	expected["12.2.2.2:2"] = dbNeighbourInfo{id: -1, next_refresh: 0}
-	expected["13.3.3.3:3"] = dbNeighbourInfo{id: -1, next_refresh: 0}
+func TestDbPutNodeKeepsRefreshOnNeighbourUpdate(t *testing.T) {
+	var err error
+	db, other := tempSharedDB(t)
+	drainStats()
+	defer drainStats()
 
-	if !reflect.DeepEqual(expected, n.dbNeighbours) {
-		t.Error("Non existing nodes expected ", expected, " got ", n.dbNeighbours)
+	_, err = db.Exec(`INSERT INTO nodes (id, ip, port, next_refresh, protocol, 
+			user_agent, online, online_at, success, success_at, updated_at) 
+		VALUES (5, 'ip', '999', 456, 70015, 'ua', 1, 100, 1, 100, 100)`)
+	if err != nil {
+		t.Fatal(err)
 	}
-	n.tx.Rollback()
 
-	// TEST: Update for known nodes
-	// WARNING: reuses internal state from previous test
-	n.tx, err = db.Begin()
+	n := &nodeDB{dbInfo: dbNodeInfo{ip: "ip", port: "999"}}
+	n.load(db)
+
+	// The refresh of a neighbour reschedules the node in the meantime
+	_, err = other.Exec(`UPDATE nodes SET next_refresh=900, updated_at=200 WHERE id=5`)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	n.node.Addresses = append(n.node.Addresses, NetAddr{IP: net.IPv4(1, 1, 1, 1), Port: uint16(1)})
-	n.node.Addresses = append(n.node.Addresses, NetAddr{IP: net.IPv4(2, 2, 2, 2), Port: uint16(2)})
+	// This update failed to connect
+	n.now = 300
+	n.dbInfo.online = false
+	n.dbInfo.success = false
+	n.dbInfo.next_refresh = 0
 
-	n.dbGetNeighbours()
+	// TEST: The result of this refresh is kept
+	err = n.dbBeginPutNode(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = n.tx.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	expected = make(map[string]dbNeighbourInfo)
-	expected["10.0.0.0:0"] = dbNeighbourInfo{id: -1, next_refresh: 0}
-	expected["11.1.1.1:1"] = dbNeighbourInfo{id: -1, next_refresh: 0}
-	expected["12.2.2.2:2"] = dbNeighbourInfo{id: -1, next_refresh: 0}
-	expected["13.3.3.3:3"] = dbNeighbourInfo{id: -1, next_refresh: 0}
-	expected["1.1.1.1:1"] = dbNeighbourInfo{id: 2, next_refresh: 2}
-	expected["2.2.2.2:2"] = dbNeighbourInfo{id: 3, next_refresh: 4}
+	got := dbNodeInfo{}
+	err = other.QueryRow(`SELECT online, online_at, success, success_at, next_refresh, 
+			CAST(updated_at AS INTEGER) 
+		FROM nodes WHERE id=5`).Scan(&got.online, &got.online_at, &got.success,
+		&got.success_at, &got.next_refresh, &got.updated_at)
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	if !reflect.DeepEqual(expected, n.dbNeighbours) {
-		t.Error("Update internal state ", expected, " got ", n.dbNeighbours)
+	expected := dbNodeInfo{online: false, online_at: 100, success: false,
+		success_at: 100, next_refresh: 0, updated_at: 300}
+	if !reflect.DeepEqual(expected, got) {
+		t.Error("Node expected ", expected, " got ", got)
 	}
-	n.tx.Rollback()
 }
 
-func TestDbPutNeighbours(t *testing.T) {
+func TestDbBeginPutNodeRetries(t *testing.T) {
 	var err error
 	db := tempDB(t)
 	defer db.Close()
-	// Setup
-	// Add nodes to the DB
-	stmt, err := db.Prepare("INSERT INTO nodes (id, ip, port, next_refresh, updated_at) VALUES (?,?,?,?,?)")
+	drainStats()
+	defer drainStats()
+
+	_, err = db.Exec(`INSERT INTO nodes (id, ip, port, updated_at) 
+		VALUES (5, 'ip', '999', 100)`)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	for i := 0; i < 10; i++ {
-		id := i + 1
-		ip := net.IPv4(byte(i), byte(i), byte(i), byte(i))
-		port := uint16(i)
-		next_refresh := i * 2
-		updated_at := 900 + i
-		_, err = stmt.Exec(id, ip.String(), port, next_refresh, updated_at)
-		if err != nil {
-			t.Fatal(err)
-		}
-	}
-	stmt.Close()
-	// Add relations
-	stmt, err = db.Prepare("INSERT INTO nodes_known (id, id_source, id_known, updated_at) VALUES (?,?,?,?)")
+	// Every write of the node looks like it lost against another goroutine
+	_, err = db.Exec(`CREATE TRIGGER ignore_updates BEFORE UPDATE ON nodes 
+		BEGIN SELECT RAISE(IGNORE); END`)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	// node with id=1 already knowns nodes 2-5 (1.1.1.1:1-4.4.4.4:4)
-	for i := 2; i < 6; i++ {
-		id := i
-		id_source := 1
-		id_known := i
-		updated_at := 700 + i
-		_, err = stmt.Exec(id, id_source, id_known, updated_at)
-		if err != nil {
-			t.Fatal(err)
-		}
+	n := &nodeDB{dbInfo: dbNodeInfo{ip: "ip", port: "999"}}
+	n.load(db)
+	n.now = 300
+
+	err = n.dbBeginPutNode(db)
+	if err == nil {
+		n.tx.Rollback()
+		t.Fatal("Expected the save to fail after ", MAX_SAVE_RETRIES, " retries")
 	}
-	stmt.Close()
+	if len(chstatcounter) != MAX_SAVE_RETRIES {
+		t.Error("Expected ", MAX_SAVE_RETRIES, " merges got ", len(chstatcounter))
+	}
+}
+
+func TestDbPutSession(t *testing.T) {
+	var err error
+	db := tempDB(t)
+	defer db.Close()
 
-	// TEST: New neighbours
 	n := &nodeDB{
-		dbInfo: dbNodeInfo{id: 1},
-		now:    222}
+		dbInfo: dbNodeInfo{id: 5, online: true, success: false},
+		now:    123,
+	}
 	n.tx, err = db.Begin()
 	if err != nil {
 		t.Fatal(err)
 	}
-	n.dbNeighbours = make(map[string]dbNeighbourInfo)
-	n.dbNeighbours["15.15.15.15:15"] = dbNeighbourInfo{id: -1, next_refresh: 666}
-	n.dbNeighbours["16.16.16.16:16"] = dbNeighbourInfo{id: -1, next_refresh: 777}
+	defer n.tx.Rollback()
 
-	n.dbPutNeighbours()
+	n.dbPutSession()
 
-	type node struct {
-		Id           int64
-		Ip           string
-		Port         int
-		Next_refresh int64
-		Updated_at   int64
-	}
-	type rel struct {
-		Id_source  int64
-		Id_known   int64
-		Updated_at int64
-	}
-	got_node := make([]node, 0)
-	rows, err := n.tx.Query(`SELECT id, ip, port, next_refresh, updated_at FROM nodes
-		WHERE ip='15.15.15.15' OR ip='16.16.16.16'
-		ORDER BY ip`)
+	var (
+		node_id, started_at int64
+		online, success     bool
+	)
+	err = n.tx.QueryRow(`SELECT node_id, started_at, online, success 
+		FROM node_sessions`).Scan(&node_id, &started_at, &online, &success)
 	if err != nil {
 		t.Fatal(err)
 	}
-	for rows.Next() {
-		n := node{}
-		rows.Scan(&(n.Id), &(n.Ip), &(n.Port), &(n.Next_refresh), &(n.Updated_at))
-		got_node = append(got_node, n)
+	if node_id != 5 || started_at != 123 || !online || success {
+		t.Error("Unexpected session ", node_id, started_at, online, success)
 	}
+}
 
-	expected_node := []node{
-		node{Id: got_node[0].Id, Ip: "15.15.15.15", Port: 15,
-			Next_refresh: 666, Updated_at: n.now},
-		node{Id: got_node[1].Id, Ip: "16.16.16.16", Port: 16,
-			Next_refresh: 777, Updated_at: n.now},
-	}
+func TestDbPutErrors(t *testing.T) {
+	var err error
+	db := tempDB(t)
+	defer db.Close()
 
-	if !reflect.DeepEqual(got_node, expected_node[:]) {
-		t.Error("New neighbours: nodes expected ", expected_node, " got ", got_node)
+	n := &nodeDB{
+		node:   &Node{Errors: map[string]int{"invalid_checksum": 2, "wrong_network": 1}},
+		dbInfo: dbNodeInfo{id: 5},
+		now:    123,
 	}
-
-	got_rel := make([]rel, 0)
+	n.tx, err = db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.tx.Rollback()
+
+	// Errors are added to the existing count
+	n.dbPutErrors()
+	n.node.Errors = map[string]int{"invalid_checksum": 3}
+	n.now = 456
+	n.dbPutErrors()
+
+	for _, c := range []struct {
+		error_type string
+		count      int
+		updated_at int64
+	}{
+		{"invalid_checksum", 5, 456},
+		{"wrong_network", 1, 123},
+	} {
+		var count int
+		var updated_at int64
+		err = n.tx.QueryRow(`SELECT count, updated_at FROM node_errors 
+			WHERE node_id=5 AND error_type=?`, c.error_type).Scan(&count, &updated_at)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != c.count || updated_at != c.updated_at {
+			t.Error(c.error_type, " expected ", c.count, " at ", c.updated_at,
+				" got ", count, " at ", updated_at)
+		}
+	}
+}
+
+func TestDbPutServices(t *testing.T) {
+	var err error
+	db := tempDB(t)
+	defer db.Close()
+
+	_, err = db.Exec(`INSERT INTO nodes (id, ip, port, updated_at) VALUES (5, 'ip', '999', 0)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Services 1 seen at 100 and 200, then 9 at 300, then the high bit at 400
+	// and 500
+	n := &nodeDB{dbInfo: dbNodeInfo{id: 5}}
+	for _, c := range []struct {
+		now      int64
+		services uint64
+	}{{100, 1}, {200, 1}, {300, 9}, {400, 1 << 63}, {500, 1 << 63}} {
+		n.tx, err = db.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		n.now = c.now
+		n.dbPutServices(c.services)
+
+		err = n.tx.Commit()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := GetServiceHistory(db, "ip", "999")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []ServiceHistoryEntry{
+		ServiceHistoryEntry{Services: 1, FirstSeen: time.Unix(100, 0), LastSeen: time.Unix(200, 0)},
+		ServiceHistoryEntry{Services: 9, FirstSeen: time.Unix(300, 0), LastSeen: time.Unix(300, 0)},
+		ServiceHistoryEntry{Services: 1 << 63, FirstSeen: time.Unix(400, 0), LastSeen: time.Unix(500, 0)},
+	}
+	if !reflect.DeepEqual(expected, got) {
+		t.Error("Service history expected ", expected, " got ", got)
+	}
+}
+
+func TestNodeDBPrepare(t *testing.T) {
+	// Statements are prepared on a different connection than the one used by
+	// the transaction, which requires a DB shared between connections
+	db, err := sql.Open(SQLITE_DRIVER, filepath.Join(t.TempDir(), "data.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	setupDB(db)
+	defer closeStmts(db)
+
+	_, err = db.Exec("INSERT INTO nodes (ip, port, updated_at) VALUES ('ip', '999', 0)")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n := &nodeDB{db: db}
+	query := "SELECT COUNT(*) FROM nodes WHERE ip=?"
+
+	// The statement must be usable in successive transactions
+	for i := 0; i < 2; i++ {
+		n.tx, err = db.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		stmt, err := n.prepare(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var count int
+		err = stmt.QueryRow("ip").Scan(&count)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != 1 {
+			t.Error("Expected 1 node got ", count)
+		}
+
+		stmt.Close()
+		n.tx.Rollback()
+	}
+
+	if _, ok := stmtCache.Load(stmtKey{db: db, query: query}); !ok {
+		t.Error("Statement was not cached")
+	}
+
+	closeStmts(db)
+	if _, ok := stmtCache.Load(stmtKey{db: db, query: query}); ok {
+		t.Error("Statement still cached after closeStmts")
+	}
+}
+
+func TestDbPutAddressesSeen(t *testing.T) {
+	var err error
+	db := tempDB(t)
+	defer db.Close()
+
+	n := &nodeDB{
+		dbInfo: dbNodeInfo{id: 1},
+		now:    500,
+		node: &Node{
+			Addresses: []NetAddr{
+				NetAddr{IP: net.IPv4(1, 1, 1, 1), Port: 1, Timestamp: time.Unix(100, 0)},
+				NetAddr{IP: net.IPv4(2, 2, 2, 2), Port: 2, Timestamp: time.Unix(200, 0)},
+			},
+		},
+	}
+	n.tx, err = db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.tx.Rollback()
+
+	n.dbPutAddressesSeen()
+
+	type seen struct {
+		Id_source      int64
+		Ip             string
+		Port           int
+		Addr_timestamp int64
+		Seen_at        int64
+	}
+	got := make([]seen, 0)
+	rows, err := n.tx.Query(`SELECT id_source, ip, port, addr_timestamp, seen_at 
+		FROM addresses_seen ORDER BY ip`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rows.Next() {
+		s := seen{}
+		rows.Scan(&s.Id_source, &s.Ip, &s.Port, &s.Addr_timestamp, &s.Seen_at)
+		got = append(got, s)
+	}
+
+	expected := []seen{
+		seen{1, "1.1.1.1", 1, 100, 500},
+		seen{1, "2.2.2.2", 2, 200, 500},
+	}
+	if !reflect.DeepEqual(expected, got) {
+		t.Error("Addresses seen expected ", expected, " got ", got)
+	}
+}
+
+func TestDbGetNeighbours(t *testing.T) {
+	var err error
+	db := tempDB(t)
+	defer db.Close()
+
+	// Add nodes to the DB
+	stmt, err := db.Prepare("INSERT INTO nodes (id, ip, port, next_refresh) VALUES (?,?,?,?)")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		id := i + 1
+		ip := net.IPv4(byte(i), byte(i), byte(i), byte(i))
+		port := uint16(i)
+		next_refresh := i * 2
+		_, err = stmt.Exec(id, ip.String(), port, next_refresh)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	stmt.Close()
+
+	// TEST: Exising nodes
+	n := &nodeDB{}
+	n.tx, err = db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addresses := []NetAddr{
+		NetAddr{IP: net.IPv4(0, 0, 0, 0), Port: uint16(0)},
+		NetAddr{IP: net.IPv4(1, 1, 1, 1), Port: uint16(1)},
+		NetAddr{IP: net.IPv4(2, 2, 2, 2), Port: uint16(2)},
+		NetAddr{IP: net.IPv4(3, 3, 3, 3), Port: uint16(3)},
+	}
+
+	n.node = &Node{
+		Addresses: addresses[:],
+	}
+	n.dbGetNeighbours()
+
+	expected := make(map[string]dbNeighbourInfo)
+	expected["0.0.0.0:0"] = dbNeighbourInfo{id: 1, next_refresh: 0}
+	expected["1.1.1.1:1"] = dbNeighbourInfo{id: 2, next_refresh: 2}
+	expected["2.2.2.2:2"] = dbNeighbourInfo{id: 3, next_refresh: 4}
+	expected["3.3.3.3:3"] = dbNeighbourInfo{id: 4, next_refresh: 6}
+
+	if !reflect.DeepEqual(expected, n.dbNeighbours) {
+		t.Error("Existing nodes expected ", expected, " got ", n.dbNeighbours)
+	}
+	n.tx.Rollback()
+
+	// TEST: Non existing nodes
+	n = &nodeDB{}
+	n.tx, err = db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addresses = []NetAddr{
+		NetAddr{IP: net.IPv4(10, 0, 0, 0), Port: uint16(0)},
+		NetAddr{IP: net.IPv4(11, 1, 1, 1), Port: uint16(1)},
+		NetAddr{IP: net.IPv4(12, 2, 2, 2), Port: uint16(2)},
+		NetAddr{IP: net.IPv4(13, 3, 3, 3), Port: uint16(3)},
+	}
+
+	n.node = &Node{
+		Addresses: addresses[:],
+	}
+	n.dbGetNeighbours()
+
+	expected = make(map[string]dbNeighbourInfo)
+	expected["10.0.0.0:0"] = dbNeighbourInfo{id: -1, next_refresh: 0}
+	expected["11.1.1.1:1"] = dbNeighbourInfo{id: -1, next_refresh: 0}
+	expected["12.2.2.2:2"] = dbNeighbourInfo{id: -1, next_refresh: 0}
+	expected["13.3.3.3:3"] = dbNeighbourInfo{id: -1, next_refresh: 0}
+
+	if !reflect.DeepEqual(expected, n.dbNeighbours) {
+		t.Error("Non existing nodes expected ", expected, " got ", n.dbNeighbours)
+	}
+	n.tx.Rollback()
+
+	// TEST: Update for known nodes
+	// WARNING: reuses internal state from previous test
+	n.tx, err = db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n.node.Addresses = append(n.node.Addresses, NetAddr{IP: net.IPv4(1, 1, 1, 1), Port: uint16(1)})
+	n.node.Addresses = append(n.node.Addresses, NetAddr{IP: net.IPv4(2, 2, 2, 2), Port: uint16(2)})
+
+	n.dbGetNeighbours()
+
+	expected = make(map[string]dbNeighbourInfo)
+	expected["10.0.0.0:0"] = dbNeighbourInfo{id: -1, next_refresh: 0}
+	expected["11.1.1.1:1"] = dbNeighbourInfo{id: -1, next_refresh: 0}
+	expected["12.2.2.2:2"] = dbNeighbourInfo{id: -1, next_refresh: 0}
+	expected["13.3.3.3:3"] = dbNeighbourInfo{id: -1, next_refresh: 0}
+	expected["1.1.1.1:1"] = dbNeighbourInfo{id: 2, next_refresh: 2}
+	expected["2.2.2.2:2"] = dbNeighbourInfo{id: 3, next_refresh: 4}
+
+	if !reflect.DeepEqual(expected, n.dbNeighbours) {
+		t.Error("Update internal state ", expected, " got ", n.dbNeighbours)
+	}
+	n.tx.Rollback()
+}
+
+func TestDbPutNeighbours(t *testing.T) {
+	var err error
+	db := tempDB(t)
+	defer db.Close()
+	// Setup
+	// Add nodes to the DB
+	stmt, err := db.Prepare("INSERT INTO nodes (id, ip, port, next_refresh, updated_at) VALUES (?,?,?,?,?)")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		id := i + 1
+		ip := net.IPv4(byte(i), byte(i), byte(i), byte(i))
+		port := uint16(i)
+		next_refresh := i * 2
+		updated_at := 900 + i
+		_, err = stmt.Exec(id, ip.String(), port, next_refresh, updated_at)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	stmt.Close()
+	// Add relations
+	stmt, err = db.Prepare("INSERT INTO nodes_known (id, id_source, id_known, updated_at) VALUES (?,?,?,?)")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// node with id=1 already knowns nodes 2-5 (1.1.1.1:1-4.4.4.4:4)
+	for i := 2; i < 6; i++ {
+		id := i
+		id_source := 1
+		id_known := i
+		updated_at := 700 + i
+		_, err = stmt.Exec(id, id_source, id_known, updated_at)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	stmt.Close()
+
+	// TEST: New neighbours
+	n := &nodeDB{
+		dbInfo: dbNodeInfo{id: 1},
+		now:    222}
+	n.tx, err = db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.dbNeighbours = make(map[string]dbNeighbourInfo)
+	n.dbNeighbours["15.15.15.15:15"] = dbNeighbourInfo{id: -1, next_refresh: 666}
+	n.dbNeighbours["16.16.16.16:16"] = dbNeighbourInfo{id: -1, next_refresh: 777}
+
+	n.dbPutNeighbours()
+
+	type node struct {
+		Id           int64
+		Ip           string
+		Port         int
+		Next_refresh int64
+		Updated_at   int64
+	}
+	type rel struct {
+		Id_source  int64
+		Id_known   int64
+		Updated_at int64
+	}
+	got_node := make([]node, 0)
+	rows, err := n.tx.Query(`SELECT id, ip, port, next_refresh, updated_at FROM nodes
+		WHERE ip='15.15.15.15' OR ip='16.16.16.16'
+		ORDER BY ip`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rows.Next() {
+		n := node{}
+		rows.Scan(&(n.Id), &(n.Ip), &(n.Port), &(n.Next_refresh), &(n.Updated_at))
+		got_node = append(got_node, n)
+	}
+
+	expected_node := []node{
+		node{Id: got_node[0].Id, Ip: "15.15.15.15", Port: 15,
+			Next_refresh: 666, Updated_at: n.now},
+		node{Id: got_node[1].Id, Ip: "16.16.16.16", Port: 16,
+			Next_refresh: 777, Updated_at: n.now},
+	}
+
+	if !reflect.DeepEqual(got_node, expected_node[:]) {
+		t.Error("New neighbours: nodes expected ", expected_node, " got ", got_node)
+	}
+
+	got_rel := make([]rel, 0)
 	rows, err = n.tx.Query(`SELECT id_source, id_known, nodes_known.updated_at 
 		FROM nodes_known 
 		LEFT JOIN nodes ON nodes_known.id_known=nodes.id
@@ -425,155 +959,827 @@ func TestDbPutNeighbours(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	for rows.Next() {
-		r := rel{}
-		rows.Scan(&(r.Id_source), &(r.Id_known), &(r.Updated_at))
-		got_rel = append(got_rel, r)
+	for rows.Next() {
+		r := rel{}
+		rows.Scan(&(r.Id_source), &(r.Id_known), &(r.Updated_at))
+		got_rel = append(got_rel, r)
+	}
+
+	expected_rel := []rel{
+		rel{Id_source: 1, Id_known: got_node[0].Id, Updated_at: n.now},
+		rel{Id_source: 1, Id_known: got_node[1].Id, Updated_at: n.now},
+	}
+
+	if !reflect.DeepEqual(got_rel, expected_rel[:]) {
+		t.Error("New neighbours: rel expected ", expected_rel, " got ", got_rel)
+	}
+	n.tx.Rollback()
+
+	// TEST: Existing neighbours, no relation
+	n = &nodeDB{
+		dbInfo: dbNodeInfo{id: 1},
+		now:    222}
+	n.tx, err = db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.dbNeighbours = make(map[string]dbNeighbourInfo)
+	n.dbNeighbours["5.5.5.5:5"] = dbNeighbourInfo{id: 0, next_refresh: 666}
+	n.dbNeighbours["6.6.6.6:6"] = dbNeighbourInfo{id: 0, next_refresh: 777}
+
+	n.dbPutNeighbours()
+
+	got_node = make([]node, 0)
+	rows, err = n.tx.Query(`SELECT id, ip, port, next_refresh, updated_at FROM nodes
+		WHERE ip='5.5.5.5' OR ip='6.6.6.6'
+		ORDER BY ip`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rows.Next() {
+		n := node{}
+		rows.Scan(&(n.Id), &(n.Ip), &(n.Port), &(n.Next_refresh), &(n.Updated_at))
+		got_node = append(got_node, n)
+	}
+
+	expected_node = []node{
+		node{Id: 6, Ip: "5.5.5.5", Port: 5,
+			Next_refresh: 666, Updated_at: n.now},
+		node{Id: 7, Ip: "6.6.6.6", Port: 6,
+			Next_refresh: 777, Updated_at: n.now},
+	}
+
+	if !reflect.DeepEqual(got_node, expected_node[:]) {
+		t.Error("Existing neighbours: nodes expected ", expected_node, " got ", got_node)
+	}
+
+	got_rel = make([]rel, 0)
+	rows, err = n.tx.Query(`SELECT id_source, id_known, nodes_known.updated_at 
+		FROM nodes_known 
+		LEFT JOIN nodes ON nodes_known.id_known=nodes.id
+		WHERE ip='5.5.5.5' OR ip='6.6.6.6'
+		ORDER BY nodes.ip`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rows.Next() {
+		r := rel{}
+		rows.Scan(&(r.Id_source), &(r.Id_known), &(r.Updated_at))
+		got_rel = append(got_rel, r)
+	}
+
+	expected_rel = []rel{
+		rel{Id_source: 1, Id_known: got_node[0].Id, Updated_at: n.now},
+		rel{Id_source: 1, Id_known: got_node[1].Id, Updated_at: n.now},
+	}
+
+	if !reflect.DeepEqual(got_rel, expected_rel[:]) {
+		t.Error(expected_rel)
+		t.Error(got_rel)
+	}
+	n.tx.Rollback()
+
+	// TEST: Existing neighbours, existing relation
+	n = &nodeDB{
+		dbInfo: dbNodeInfo{id: 1},
+		now:    222}
+	n.tx, err = db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.dbNeighbours = make(map[string]dbNeighbourInfo)
+	n.dbNeighbours["2.2.2.2:2"] = dbNeighbourInfo{id: 0, next_refresh: 666}
+	n.dbNeighbours["3.3.3.3:3"] = dbNeighbourInfo{id: 0, next_refresh: 777}
+
+	n.dbPutNeighbours()
+
+	got_node = make([]node, 0)
+	rows, err = n.tx.Query(`SELECT id, ip, port, next_refresh, updated_at FROM nodes
+		WHERE ip='2.2.2.2' OR ip='3.3.3.3'
+		ORDER BY ip`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rows.Next() {
+		n := node{}
+		rows.Scan(&(n.Id), &(n.Ip), &(n.Port), &(n.Next_refresh), &(n.Updated_at))
+		got_node = append(got_node, n)
+	}
+
+	expected_node = []node{
+		node{Id: 3, Ip: "2.2.2.2", Port: 2,
+			Next_refresh: 666, Updated_at: n.now},
+		node{Id: 4, Ip: "3.3.3.3", Port: 3,
+			Next_refresh: 777, Updated_at: n.now},
+	}
+
+	if !reflect.DeepEqual(got_node, expected_node[:]) {
+		t.Error("Existing neighbours: nodes expected ", expected_node, " got ", got_node)
+	}
+
+	got_rel = make([]rel, 0)
+	rows, err = n.tx.Query(`SELECT id_source, id_known, nodes_known.updated_at 
+		FROM nodes_known 
+		LEFT JOIN nodes ON nodes_known.id_known=nodes.id
+		WHERE ip='2.2.2.2' OR ip='3.3.3.3'
+		ORDER BY nodes.ip`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rows.Next() {
+		r := rel{}
+		rows.Scan(&(r.Id_source), &(r.Id_known), &(r.Updated_at))
+		got_rel = append(got_rel, r)
+	}
+
+	expected_rel = []rel{
+		rel{Id_source: 1, Id_known: got_node[0].Id, Updated_at: n.now},
+		rel{Id_source: 1, Id_known: got_node[1].Id, Updated_at: n.now},
+	}
+
+	if !reflect.DeepEqual(got_rel, expected_rel[:]) {
+		t.Error(expected_rel)
+		t.Error(got_rel)
+	}
+	n.tx.Rollback()
+}
+
+func TestHaveKnownNodes(t *testing.T) {
+	db := tempDB(t)
+	defer db.Close()
+	tempDBPool(db)
+
+	// TEST: Empty DB
+	if haveKnownNodes() {
+		t.Error("Empty DB should not have known nodes")
+	}
+
+	// TEST: Node which was successfully crawled
+	_, err := db.Exec(`INSERT INTO nodes (ip, port, success, updated_at) 
+		VALUES ('1.1.1.1', 1, 1, 0)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !haveKnownNodes() {
+		t.Error("DB with successful node should have known nodes")
+	}
+
+	// TEST: Only nodes which were not successfully crawled
+	db2 := tempDB(t)
+	defer db2.Close()
+	tempDBPool(db2)
+
+	_, err = db2.Exec(`INSERT INTO nodes (ip, port, success, updated_at) 
+		VALUES ('2.2.2.2', 2, 0, 0)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if haveKnownNodes() {
+		t.Error("DB without successful nodes should not have known nodes")
+	}
+}
+
+func TestGetTopBootstrapNodes(t *testing.T) {
+	var err error
+	db := tempDB(t)
+	defer db.Close()
+
+	// Setup: star topology where node 1 (the hub) is known by nodes 2-6 and
+	// node 2 is known by node 3 only
+	tempGraph(t, db, 6, [][2]int64{{2, 1}, {3, 1}, {4, 1}, {5, 1}, {6, 1}, {3, 2}})
+
+	// TEST: Hub comes first
+	got, err := GetTopBootstrapNodes(db, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []ip_port{
+		ip_port{ip: "1.1.1.1", port: "1"},
+		ip_port{ip: "2.2.2.2", port: "2"},
+	}
+	if !reflect.DeepEqual(expected, got) {
+		t.Error("Top bootstrap nodes expected ", expected, " got ", got)
+	}
+
+	// TEST: Limit is respected
+	got, err = GetTopBootstrapNodes(db, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(expected[:1], got) {
+		t.Error("Top bootstrap node expected ", expected[:1], " got ", got)
+	}
+}
+
+func TestEnqueueBootstrapNodes(t *testing.T) {
+	db := tempDB(t)
+	defer db.Close()
+
+	// Nodes 1 and 2 are known by the most nodes
+	tempGraph(t, db, 4, [][2]int64{{2, 1}, {3, 1}, {4, 1}, {3, 2}, {4, 2}, {1, 3}})
+
+	addresses := NewAddressManager()
+	addresses.Push(ip_port{ip: "9.9.9.9", port: "9"}, 100)
+	n, err := enqueueBootstrapNodes(db, addresses, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addresses.Close()
+
+	// Bootstrap nodes are popped first
+	got := make([]ip_port, 0)
+	for i := 0; i < n; i++ {
+		got = append(got, addresses.Pop())
+	}
+
+	expected := []ip_port{
+		ip_port{ip: "1.1.1.1", port: "1"},
+		ip_port{ip: "2.2.2.2", port: "2"},
+	}
+	if n != len(expected) {
+		t.Error("Enqueued count expected ", len(expected), " got ", n)
+	}
+	if !reflect.DeepEqual(expected, got) {
+		t.Error("Enqueued addresses expected ", expected, " got ", got)
+	}
+}
+
+func TestAddressesToUpdate(t *testing.T) {
+	db := tempDB(t)
+	defer db.Close()
+	tempDBPool(db)
+
+	due := time.Now().Unix() - 1
+	future := time.Now().Unix() + 3600
+
+	_, err := db.Exec(`INSERT INTO nodes (ip, port, next_refresh, updated_at) VALUES
+		('1.1.1.1', 1, ?, 0), -- due
+		('2.2.2.2', 2, ?, 0), -- not due yet
+		('3.3.3.3', 3, 0, 0), -- not scheduled
+		('4.4.4.4', 0, ?, 0), -- no port
+		('5.5.5.5', 5, ?, 0)  -- due`, due, future, due, due-10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, priorities, max := addressesToUpdate()
+
+	// Ordered by next_refresh
+	expected := []ip_port{
+		ip_port{ip: "5.5.5.5", port: "5"},
+		ip_port{ip: "1.1.1.1", port: "1"},
+	}
+	if !reflect.DeepEqual(expected, got) {
+		t.Error("Addresses to update expected ", expected, " got ", got)
+	}
+	if max != len(expected) {
+		t.Error("Max addresses expected ", len(expected), " got ", max)
+	}
+	if len(priorities) != len(expected) || priorities[0] <= priorities[1] {
+		t.Error("Expected the most overdue address to have a higher priority got ", priorities)
+	}
+}
+
+func TestAddressesToUpdateRandomSample(t *testing.T) {
+	db := tempDB(t)
+	defer db.Close()
+	tempDBPool(db)
+
+	stmt, err := db.Prepare("INSERT INTO nodes (ip, port, next_refresh, updated_at) VALUES (?,?,?,?)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 50; i++ {
+		ip := net.IPv4(byte(i), byte(i), byte(i), byte(i))
+		_, err = stmt.Exec(ip.String(), i, i, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	stmt.Close()
+
+	flagRandomSample = true
+	defer func() { flagRandomSample = false }()
+
+	first, _, max := addressesToUpdate()
+	if len(first) != 50 || max != 50 {
+		t.Fatal("Expected 50 addresses got ", len(first), "/", max)
+	}
+
+	second, _, _ := addressesToUpdate()
+	if reflect.DeepEqual(first, second) {
+		t.Error("Random sample returned the same order twice ", first)
+	}
+}
+
+func TestTotalKnownEdges(t *testing.T) {
+	db := tempDB(t)
+	defer db.Close()
+
+	// TEST: No relations
+	count, err := TotalKnownEdges(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Error("Empty DB expected 0 edges got ", count)
+	}
+
+	// TEST: Existing relations
+	tempGraph(t, db, 4, [][2]int64{{1, 2}, {1, 3}, {2, 3}, {4, 1}})
+
+	count, err = TotalKnownEdges(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 4 {
+		t.Error("Expected 4 edges got ", count)
+	}
+
+	stats, err := GetNetworkStats(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.TotalEdges != 4 || stats.TotalNodes != 4 {
+		t.Error("Network stats expected 4 nodes and 4 edges got ", stats)
+	}
+}
+
+func TestDropEdgesOlderThan(t *testing.T) {
+	db := tempDB(t)
+	defer db.Close()
+
+	tempGraph(t, db, 3, [][2]int64{{1, 2}, {1, 3}, {2, 3}, {3, 1}})
+
+	// Relations 1->2 and 2->3 are recent, the others are old
+	now := time.Now()
+	_, err := db.Exec("UPDATE nodes_known SET updated_at=?", now.Add(-48*time.Hour).Unix())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(`UPDATE nodes_known SET updated_at=? 
+		WHERE (id_source=1 AND id_known=2) OR (id_source=2 AND id_known=3)`, now.Unix())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	count, err := DropEdgesOlderThan(db, now.Add(-24*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Error("Expected 2 dropped edges got ", count)
+	}
+
+	got := make([][2]int64, 0)
+	rows, err := db.Query("SELECT id_source, id_known FROM nodes_known ORDER BY id_source")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rows.Next() {
+		var e [2]int64
+		rows.Scan(&e[0], &e[1])
+		got = append(got, e)
+	}
+
+	expected := [][2]int64{{1, 2}, {2, 3}}
+	if !reflect.DeepEqual(expected, got) {
+		t.Error("Remaining edges expected ", expected, " got ", got)
+	}
+}
+
+func TestGetNodesNeverSeen(t *testing.T) {
+	db := tempDB(t)
+	defer db.Close()
+
+	old := time.Now().Add(-48 * time.Hour).Unix()
+	recent := time.Now().Unix()
+
+	_, err := db.Exec(`INSERT INTO nodes (ip, port, next_refresh, online, success, updated_at) VALUES
+		('1.1.1.1', 1, 1, 0, 0, ?), -- never seen
+		('2.2.2.2', 2, 1, 0, 0, ?), -- never seen, too recent
+		('3.3.3.3', 3, 1, 1, 1, ?), -- crawled
+		('4.4.4.4', 4, 0, 0, 0, ?)  -- not scheduled`, old, recent, old, old)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := GetNodesNeverSeen(db, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []ip_port{ip_port{ip: "1.1.1.1", port: "1"}}
+	if !reflect.DeepEqual(expected, got) {
+		t.Error("Never seen nodes expected ", expected, " got ", got)
+	}
+}
+
+func TestGetNodesUpdatedInLastN(t *testing.T) {
+	db := tempDB(t)
+	defer db.Close()
+
+	now := time.Now().Unix()
+	old := time.Now().Add(-48 * time.Hour).Unix()
+	_, err := db.Exec(`INSERT INTO nodes (ip, port, updated_at) VALUES
+		('1.1.1.1', 1, ?),
+		('2.2.2.2', 2, ?),
+		('3.3.3.3', 3, ?),
+		('4.4.4.4', 4, ?),
+		('5.5.5.5', 5, ?)`, now, now-60, now-300, old, old)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := GetNodesUpdatedInLastN(db, 10*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != 3 {
+		t.Error("Expected 3 recently updated nodes got ", got)
+	}
+
+	got, err = GetNodesUpdatedInLastN(db, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != 1 {
+		t.Error("Expected 1 node updated in the last second got ", got)
+	}
+}
+
+func TestGetOfflineNodesOnceOnline(t *testing.T) {
+	db := tempDB(t)
+	defer db.Close()
+
+	old := time.Now().Add(-10 * 24 * time.Hour).Unix()
+	recent := time.Now().Add(-time.Hour).Unix()
+
+	_, err := db.Exec(`INSERT INTO nodes (ip, port, online, online_at, success, updated_at) VALUES
+		('1.1.1.1', 1, 0, ?, 1, 0), -- churned
+		('2.2.2.2', 2, 0, ?, 1, 0), -- offline recently
+		('3.3.3.3', 3, 1, ?, 1, 0), -- online
+		('4.4.4.4', 4, 0, ?, 0, 0)  -- never successful`, old, recent, old, old)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := GetOfflineNodesOnceOnline(db, 7*24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []ip_port{ip_port{ip: "1.1.1.1", port: "1"}}
+	if !reflect.DeepEqual(expected, got) {
+		t.Error("Churned nodes expected ", expected, " got ", got)
+	}
+}
+
+func TestUpdateNextRefresh(t *testing.T) {
+	db := tempDB(t)
+	defer db.Close()
+
+	_, err := db.Exec(`INSERT INTO nodes (ip, port, next_refresh, user_agent, updated_at) 
+		VALUES ('1.1.1.1', 1, 500, 'ua', 0)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// TEST: Existing node
+	err = UpdateNextRefresh(db, "1.1.1.1", "1", 42)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		next_refresh int64
+		user_agent   string
+	)
+	err = db.QueryRow(`SELECT next_refresh, user_agent FROM nodes 
+		WHERE ip='1.1.1.1' AND port=1`).Scan(&next_refresh, &user_agent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next_refresh != 42 || user_agent != "ua" {
+		t.Error("Expected next_refresh 42 and untouched user agent got ",
+			next_refresh, " ", user_agent)
+	}
+
+	// TEST: Non existing node
+	err = UpdateNextRefresh(db, "2.2.2.2", "2", 42)
+	if err != ErrNodeNotFound {
+		t.Error("Non existing node expected ", ErrNodeNotFound, " got ", err)
+	}
+}
+
+func TestGetNodesByUserAgent(t *testing.T) {
+	db := tempDB(t)
+	defer db.Close()
+
+	_, err := db.Exec(`INSERT INTO nodes (ip, port, user_agent, updated_at) VALUES
+		('1.1.1.1', 1, '/Satoshi:25.0.0/', 0),
+		('2.2.2.2', 2, '/btcd:0.23.3/', 0),
+		('3.3.3.3', 3, '/Satoshi:24.0.1/', 0)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := GetNodesByUserAgent(db, "/Satoshi%")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []ip_port{
+		ip_port{ip: "1.1.1.1", port: "1"},
+		ip_port{ip: "3.3.3.3", port: "3"},
+	}
+	if !reflect.DeepEqual(expected, got) {
+		t.Error("Nodes by user agent expected ", expected, " got ", got)
+	}
+
+	// TEST: Pattern is not interpreted as SQL
+	got, err = FilterByUserAgent("' OR 1=1 --")(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 0 {
+		t.Error("Injected pattern expected no nodes got ", got)
+	}
+}
+
+func TestGetNodesByASN(t *testing.T) {
+	db := tempDB(t)
+	defer db.Close()
+
+	_, err := db.Exec(`INSERT INTO nodes (ip, port, asn, success, updated_at) VALUES
+		('1.1.1.1', 1, 15169, 1, 0),
+		('2.2.2.2', 2, 16509, 1, 0),
+		('3.3.3.3', 3, 15169, 0, 0), -- no handshake
+		('4.4.4.4', 4, 15169, 1, 0),
+		('5.5.5.5', 5, 0, 1, 0)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		asn      int
+		expected []ip_port
+	}{
+		{15169, []ip_port{{"1.1.1.1", "1"}, {"4.4.4.4", "4"}}},
+		{16509, []ip_port{{"2.2.2.2", "2"}}},
+		{3215, []ip_port{}},
+	} {
+		got, err := FilterByASN(c.asn)(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(c.expected, got) {
+			t.Error("ASN ", c.asn, " expected ", c.expected, " got ", got)
+		}
+	}
+}
+
+func TestCrawlSession(t *testing.T) {
+	db := tempDB(t)
+	defer db.Close()
+
+	tempGraph(t, db, 2, nil)
+
+	before := time.Now().Unix()
+	id, err := startCrawlSession(db, "test", "main", map[string]string{"v": "true"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// TEST: Running session
+	sessions, err := GetCrawlSessions(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 1 {
+		t.Fatal("Expected 1 session got ", sessions)
 	}
 
-	expected_rel := []rel{
-		rel{Id_source: 1, Id_known: got_node[0].Id, Updated_at: n.now},
-		rel{Id_source: 1, Id_known: got_node[1].Id, Updated_at: n.now},
+	s := sessions[0]
+	if s.ID != id || s.Tag != "test" || s.Network != "main" || s.NodeCountStart != 2 {
+		t.Error("Unexpected session ", s)
 	}
-
-	if !reflect.DeepEqual(got_rel, expected_rel[:]) {
-		t.Error("New neighbours: rel expected ", expected_rel, " got ", got_rel)
+	if s.StartedAt.Unix() < before || !s.EndedAt.IsZero() {
+		t.Error("Unexpected session times ", s.StartedAt, " ", s.EndedAt)
+	}
+	if string(s.Config) != `{"v":"true"}` {
+		t.Error("Unexpected session config ", string(s.Config))
 	}
-	n.tx.Rollback()
 
-	// TEST: Existing neighbours, no relation
-	n = &nodeDB{
-		dbInfo: dbNodeInfo{id: 1},
-		now:    222}
-	n.tx, err = db.Begin()
+	// TEST: Ended session
+	_, err = db.Exec("INSERT INTO nodes (ip, port, updated_at) VALUES ('3.3.3.3', 3, 0)")
 	if err != nil {
 		t.Fatal(err)
 	}
-	n.dbNeighbours = make(map[string]dbNeighbourInfo)
-	n.dbNeighbours["5.5.5.5:5"] = dbNeighbourInfo{id: 0, next_refresh: 666}
-	n.dbNeighbours["6.6.6.6:6"] = dbNeighbourInfo{id: 0, next_refresh: 777}
 
-	n.dbPutNeighbours()
+	err = endCrawlSession(db, id)
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	got_node = make([]node, 0)
-	rows, err = n.tx.Query(`SELECT id, ip, port, next_refresh, updated_at FROM nodes
-		WHERE ip='5.5.5.5' OR ip='6.6.6.6'
-		ORDER BY ip`)
+	sessions, err = GetCrawlSessions(db)
 	if err != nil {
 		t.Fatal(err)
 	}
-	for rows.Next() {
-		n := node{}
-		rows.Scan(&(n.Id), &(n.Ip), &(n.Port), &(n.Next_refresh), &(n.Updated_at))
-		got_node = append(got_node, n)
+	if sessions[0].EndedAt.Unix() < before || sessions[0].NodeCountEnd != 3 {
+		t.Error("Unexpected ended session ", sessions[0])
 	}
+}
 
-	expected_node = []node{
-		node{Id: 6, Ip: "5.5.5.5", Port: 5,
-			Next_refresh: 666, Updated_at: n.now},
-		node{Id: 7, Ip: "6.6.6.6", Port: 6,
-			Next_refresh: 777, Updated_at: n.now},
-	}
+func TestDetectMisbehavingNodes(t *testing.T) {
+	db := tempDB(t)
+	defer db.Close()
 
-	if !reflect.DeepEqual(got_node, expected_node[:]) {
-		t.Error("Existing neighbours: nodes expected ", expected_node, " got ", got_node)
+	tempGraph(t, db, 3, nil)
+	_, err := db.Exec(`INSERT INTO node_errors (node_id, error_type, count, updated_at) 
+		VALUES (1, 'invalid_checksum', 4, 0), (1, 'payload_too_small', 6, 0),
+			(2, 'invalid_checksum', 9, 0),
+			(3, 'wrong_network', 10, 0)`)
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	got_rel = make([]rel, 0)
-	rows, err = n.tx.Query(`SELECT id_source, id_known, nodes_known.updated_at 
-		FROM nodes_known 
-		LEFT JOIN nodes ON nodes_known.id_known=nodes.id
-		WHERE ip='5.5.5.5' OR ip='6.6.6.6'
-		ORDER BY nodes.ip`)
+	addresses, err := DetectMisbehavingNodes(db, 10)
 	if err != nil {
 		t.Fatal(err)
 	}
-	for rows.Next() {
-		r := rel{}
-		rows.Scan(&(r.Id_source), &(r.Id_known), &(r.Updated_at))
-		got_rel = append(got_rel, r)
-	}
 
-	expected_rel = []rel{
-		rel{Id_source: 1, Id_known: got_node[0].Id, Updated_at: n.now},
-		rel{Id_source: 1, Id_known: got_node[1].Id, Updated_at: n.now},
+	expected := map[ip_port]bool{
+		ip_port{"1.1.1.1", "1"}: true, // Sum of all error types
+		ip_port{"3.3.3.3", "3"}: true,
 	}
+	if len(addresses) != len(expected) {
+		t.Fatal("Expected ", expected, " got ", addresses)
+	}
+	for _, a := range addresses {
+		if !expected[a] {
+			t.Error("Unexpected misbehaving node ", a)
+		}
+	}
+}
 
-	if !reflect.DeepEqual(got_rel, expected_rel[:]) {
-		t.Error(expected_rel)
-		t.Error(got_rel)
+func TestGetNodesSeenByCount(t *testing.T) {
+	db := tempDB(t)
+	defer db.Close()
+
+	// Node 1 is advertised by 3 nodes, node 2 by 2 and node 3 by 1
+	tempGraph(t, db, 4, [][2]int64{
+		{2, 1}, {3, 1}, {4, 1},
+		{1, 2}, {3, 2},
+		{1, 3},
+	})
+
+	for _, c := range []struct {
+		minCount int
+		expected []ip_port
+	}{
+		{3, []ip_port{{"1.1.1.1", "1"}}},
+		{2, []ip_port{{"1.1.1.1", "1"}, {"2.2.2.2", "2"}}},
+		{4, []ip_port{}},
+	} {
+		got, err := GetNodesSeenByCount(db, c.minCount)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(c.expected, got) {
+			t.Error("Seen by ", c.minCount, " expected ", c.expected, " got ", got)
+		}
 	}
-	n.tx.Rollback()
+}
 
-	// TEST: Existing neighbours, existing relation
-	n = &nodeDB{
-		dbInfo: dbNodeInfo{id: 1},
-		now:    222}
-	n.tx, err = db.Begin()
+func TestGetNodesWithOpenPort(t *testing.T) {
+	db := tempDB(t)
+	defer db.Close()
+
+	_, err := db.Exec(`INSERT INTO nodes (ip, port, success, updated_at) VALUES
+		('1.1.1.1', 8333, 1, 0),
+		('2.2.2.2', 18333, 1, 0),
+		('3.3.3.3', 8333, 0, 0), -- no handshake
+		('4.4.4.4', 8333, 1, 0)`)
 	if err != nil {
 		t.Fatal(err)
 	}
-	n.dbNeighbours = make(map[string]dbNeighbourInfo)
-	n.dbNeighbours["2.2.2.2:2"] = dbNeighbourInfo{id: 0, next_refresh: 666}
-	n.dbNeighbours["3.3.3.3:3"] = dbNeighbourInfo{id: 0, next_refresh: 777}
 
-	n.dbPutNeighbours()
+	for _, c := range []struct {
+		port     uint16
+		expected []ip_port
+	}{
+		{8333, []ip_port{{"1.1.1.1", "8333"}, {"4.4.4.4", "8333"}}},
+		{18333, []ip_port{{"2.2.2.2", "18333"}}},
+		{8334, []ip_port{}},
+	} {
+		got, err := GetNodesWithOpenPort(db, c.port)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(c.expected, got) {
+			t.Error("Port ", c.port, " expected ", c.expected, " got ", got)
+		}
+	}
+}
 
-	got_node = make([]node, 0)
-	rows, err = n.tx.Query(`SELECT id, ip, port, next_refresh, updated_at FROM nodes
-		WHERE ip='2.2.2.2' OR ip='3.3.3.3'
-		ORDER BY ip`)
+func TestGetNodesWithAbnormalPorts(t *testing.T) {
+	db := tempDB(t)
+	defer db.Close()
+
+	_, err := db.Exec(`INSERT INTO nodes (ip, port, success, updated_at) VALUES
+		('1.1.1.1', 8333, 1, 0),
+		('2.2.2.2', 18333, 1, 0),
+		('3.3.3.3', 8080, 0, 0), -- no handshake
+		('4.4.4.4', 0, 1, 0),    -- no port
+		('5.5.5.5', 8334, 1, 0)`)
 	if err != nil {
 		t.Fatal(err)
 	}
-	for rows.Next() {
-		n := node{}
-		rows.Scan(&(n.Id), &(n.Ip), &(n.Port), &(n.Next_refresh), &(n.Updated_at))
-		got_node = append(got_node, n)
-	}
 
-	expected_node = []node{
-		node{Id: 3, Ip: "2.2.2.2", Port: 2,
-			Next_refresh: 666, Updated_at: n.now},
-		node{Id: 4, Ip: "3.3.3.3", Port: 3,
-			Next_refresh: 777, Updated_at: n.now},
+	for _, c := range []struct {
+		port     uint16
+		expected []ip_port
+	}{
+		{8333, []ip_port{{"2.2.2.2", "18333"}, {"5.5.5.5", "8334"}}},
+		{18333, []ip_port{{"1.1.1.1", "8333"}, {"5.5.5.5", "8334"}}},
+	} {
+		got, err := GetNodesWithAbnormalPorts(db, c.port)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(c.expected, got) {
+			t.Error("Standard port ", c.port, " expected ", c.expected, " got ", got)
+		}
 	}
+}
 
-	if !reflect.DeepEqual(got_node, expected_node[:]) {
-		t.Error("Existing neighbours: nodes expected ", expected_node, " got ", got_node)
-	}
+func TestGetDuplicateIPs(t *testing.T) {
+	db := tempDB(t)
+	defer db.Close()
 
-	got_rel = make([]rel, 0)
-	rows, err = n.tx.Query(`SELECT id_source, id_known, nodes_known.updated_at 
-		FROM nodes_known 
-		LEFT JOIN nodes ON nodes_known.id_known=nodes.id
-		WHERE ip='2.2.2.2' OR ip='3.3.3.3'
-		ORDER BY nodes.ip`)
+	_, err := db.Exec(`INSERT INTO nodes (ip, port, updated_at) VALUES
+		('1.1.1.1', 8334, 0),
+		('1.1.1.1', 8333, 0),
+		('2.2.2.2', 8333, 0)`)
 	if err != nil {
 		t.Fatal(err)
 	}
-	for rows.Next() {
-		r := rel{}
-		rows.Scan(&(r.Id_source), &(r.Id_known), &(r.Updated_at))
-		got_rel = append(got_rel, r)
+
+	got, err := GetDuplicateIPs(db)
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	expected_rel = []rel{
-		rel{Id_source: 1, Id_known: got_node[0].Id, Updated_at: n.now},
-		rel{Id_source: 1, Id_known: got_node[1].Id, Updated_at: n.now},
+	expected := map[string][]uint16{"1.1.1.1": {8333, 8334}}
+	if !reflect.DeepEqual(expected, got) {
+		t.Error("Duplicate IPs expected ", expected, " got ", got)
 	}
+}
 
-	if !reflect.DeepEqual(got_rel, expected_rel[:]) {
-		t.Error(expected_rel)
-		t.Error(got_rel)
+func TestWatch(t *testing.T) {
+	db := tempDB(t)
+	defer db.Close()
+	// Watch and the inserts must share the in-memory DB
+	db.SetMaxOpenConns(1)
+
+	// Existing nodes are not sent
+	tempGraph(t, db, 2, nil)
+
+	out := make(chan dbNodeInfo)
+	stop := make(chan struct{})
+	defer close(stop)
+	go Watch(db, 10*time.Millisecond, out, stop)
+
+	go func() {
+		for i := 3; i <= 5; i++ {
+			time.Sleep(20 * time.Millisecond)
+			_, err := db.Exec("INSERT INTO nodes (id, ip, port, updated_at) VALUES (?, ?, ?, 0)",
+				i, net.IPv4(byte(i), byte(i), byte(i), byte(i)).String(), i)
+			if err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+
+	timeout := time.After(5 * time.Second)
+	for i := int64(3); i <= 5; i++ {
+		select {
+		case n := <-out:
+			if n.id != i || n.port != strconv.Itoa(int(i)) {
+				t.Error("Expected node ", i, " got ", n)
+			}
+		case <-timeout:
+			t.Fatal("Timed out waiting for node ", i)
+		}
 	}
-	n.tx.Rollback()
 }
 
 // Get a database which is based in a file. This is used for benchmarks in case
 // disk IO is the limiting factor
 func tempDBBench(b *testing.B) *sql.DB {
-	db, err := sql.Open("sqlite3", "/tmp/dbdb")
+	db, err := sql.Open(SQLITE_DRIVER, "/tmp/dbdb")
 	if err != nil {
 		b.Fatal(err)
 	}
@@ -623,3 +1829,220 @@ func BenchmarkDbGetNeighbours(b *testing.B) {
 
 	db.Exec("DELETE FROM nodes")
 }
+
+func BenchmarkDbPutNodeInsert(b *testing.B) {
+	var err error
+	db := tempDBBench(b)
+	defer db.Close()
+
+	n := &nodeDB{now: 222}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		n.tx, err = db.Begin()
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		n.dbInfo = dbNodeInfo{
+			id:         ID_NOT_IN_DB,
+			ip:         net.IPv4(byte(i>>24), byte(i>>16), byte(i>>8), byte(i)).String(),
+			port:       "8333",
+			protocol:   70001,
+			user_agent: "user_agent",
+		}
+		n.dbPutNode()
+
+		n.tx.Rollback()
+	}
+
+	db.Exec("DELETE FROM nodes")
+}
+
+func BenchmarkDbPutNodeUpdate(b *testing.B) {
+	var err error
+	db := tempDBBench(b)
+	defer db.Close()
+
+	res, err := db.Exec("INSERT INTO nodes (ip, port, updated_at) VALUES ('1.1.1.1', 8333, 0)")
+	if err != nil {
+		b.Fatal(err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	n := &nodeDB{now: 222}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		n.tx, err = db.Begin()
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		n.dbInfo = dbNodeInfo{
+			id:         id,
+			ip:         "1.1.1.1",
+			port:       "8333",
+			protocol:   70001,
+			user_agent: "user_agent",
+		}
+		n.dbPutNode()
+
+		n.tx.Rollback()
+	}
+
+	db.Exec("DELETE FROM nodes")
+}
+
+// Setup for the dbPutNeighbours benchmarks: a node knowing 400 neighbours, a
+// third of which are already in the DB
+func benchPutNeighboursSetup(b *testing.B, db *sql.DB) *nodeDB {
+	res, err := db.Exec("INSERT INTO nodes (ip, port, updated_at) VALUES ('0.0.0.0', 1, 0)")
+	if err != nil {
+		b.Fatal(err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	n := &nodeDB{
+		dbInfo:       dbNodeInfo{id: id},
+		now:          222,
+		dbNeighbours: make(map[string]dbNeighbourInfo),
+	}
+	for i := 0; i < 400; i++ {
+		ip := net.IPv4(byte((i+15)%256), byte((i+8)%256), byte((i)%256), byte((i+3)%256))
+		hostport := net.JoinHostPort(ip.String(), strconv.Itoa(i))
+
+		if i%3 == 0 {
+			_, err = db.Exec("INSERT INTO nodes (ip, port, updated_at) VALUES (?,?,?)",
+				ip.String(), i, 0)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+		n.dbNeighbours[hostport] = dbNeighbourInfo{id: ID_UNKNOWN}
+	}
+
+	return n
+}
+
+func benchmarkDbPutNeighbours(b *testing.B, cached bool) {
+	var err error
+	db := tempDBBench(b)
+	defer db.Close()
+	defer closeStmts(db)
+
+	n := benchPutNeighboursSetup(b, db)
+	if cached {
+		n.db = db
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		n.tx, err = db.Begin()
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		n.dbPutNeighbours()
+
+		n.tx.Rollback()
+	}
+
+	db.Exec("DELETE FROM nodes")
+}
+
+func BenchmarkDbPutNeighbours(b *testing.B) {
+	benchmarkDbPutNeighbours(b, false)
+}
+
+func BenchmarkDbPutNeighboursCachedStmt(b *testing.B) {
+	benchmarkDbPutNeighbours(b, true)
+}
+
+func TestDbSave_ConcurrentUpdate(t *testing.T) {
+	conn, other_conn := net.Pipe()
+	defer conn.Close()
+	defer other_conn.Close()
+
+	addr := NetAddr{IP: net.ParseIP("1.2.3.4"), Port: 8333}
+
+	for _, in_db := range []bool{true, false} {
+		db, other := tempSharedDB(t)
+		drainStats()
+
+		if in_db {
+			_, err := db.Exec(`INSERT INTO nodes (ip, port, next_refresh, updated_at) 
+				VALUES ('1.2.3.4', '8333', 0, 100)`)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		successful := &nodeDB{node: &Node{
+			NetAddr: addr,
+			Conn:    conn,
+			Version: &MsgVersion{Protocol: 70016, UserAgent: "/Satoshi:25.0.0/"},
+		}, db: db}
+		failed := &nodeDB{node: &Node{NetAddr: addr}, db: other}
+
+		// Both saves read the node before either writes it. The failed save is
+		// written last
+		for _, n := range []*nodeDB{successful, failed} {
+			n.dbInfo = dbNodeInfo{ip: "1.2.3.4", port: "8333"}
+			n.load(n.db)
+		}
+		for _, n := range []*nodeDB{successful, failed} {
+			err := n.store(n.db)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		drainStats()
+		closeStmts(db)
+		closeStmts(other)
+
+		var (
+			count                 int
+			protocol              int
+			user_agent            string
+			online                bool
+			online_at, success_at int64
+			next_refresh          int64
+		)
+		err := db.QueryRow(`SELECT COUNT(*), protocol, user_agent, online, online_at, 
+				success_at, next_refresh 
+			FROM nodes WHERE ip='1.2.3.4' AND port='8333'`).Scan(&count, &protocol,
+			&user_agent, &online, &online_at, &success_at, &next_refresh)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The connection and handshake of the successful save are kept
+		if count != 1 {
+			t.Fatal("Expected a single row for the node got ", count)
+		}
+		if protocol != 70016 || user_agent != "/Satoshi:25.0.0/" {
+			t.Error("Expected handshake results to be kept got ", protocol, " ", user_agent)
+		}
+		if !online || online_at != successful.now || success_at != successful.now {
+			t.Error("Expected online and success times ", successful.now, " to be kept got ",
+				online, " ", online_at, " ", success_at)
+		}
+		if next_refresh != successful.dbInfo.next_refresh {
+			t.Error("Expected next refresh ", successful.dbInfo.next_refresh,
+				" to be kept got ", next_refresh)
+		}
+	}
+}
@@ -0,0 +1,741 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Default buckets for the age of advertised addresses
+var ADDRESS_FRESHNESS_BUCKETS = []time.Duration{
+	time.Hour,
+	24 * time.Hour,
+	7 * 24 * time.Hour,
+}
+
+// Default buckets for when nodes were first seen, as ages from oldest to most
+// recent
+var NODE_AGE_BUCKETS = []time.Duration{
+	365 * 24 * time.Hour,
+	30 * 24 * time.Hour,
+	7 * 24 * time.Hour,
+}
+
+// Count successfully crawled nodes by user agent. User agents are grouped
+// using UserAgentBucket
+func GetUserAgentDistribution(db *sql.DB) (distribution map[string]int, err error) {
+	rows, err := db.Query(`SELECT user_agent, COUNT(*) 
+		FROM nodes 
+		WHERE success=1 
+		GROUP BY user_agent`)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	var (
+		ua    string
+		count int
+	)
+	distribution = make(map[string]int)
+
+	for rows.Next() {
+		err = rows.Scan(&ua, &count)
+		if err != nil {
+			return
+		}
+		distribution[UserAgentBucket(ua)] += count
+	}
+
+	return distribution, rows.Err()
+}
+
+// Count successfully crawled nodes by whether they relay transactions
+func GetRelayFlagDistribution(db *sql.DB) (on, off int, err error) {
+	rows, err := db.Query(`SELECT relay, COUNT(*) 
+		FROM nodes 
+		WHERE success=1 
+		GROUP BY relay`)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	var (
+		relay bool
+		count int
+	)
+	for rows.Next() {
+		err = rows.Scan(&relay, &count)
+		if err != nil {
+			return
+		}
+
+		if relay {
+			on = count
+		} else {
+			off = count
+		}
+	}
+
+	return on, off, rows.Err()
+}
+
+// Count advertised addresses by how old their timestamp was when they were
+// advertised. `buckets` are the increasing upper bounds of each group, an
+// additional group contains the older addresses. Groups are named after their
+// bounds (e.g. "< 1h", "1h-1d", "> 1w")
+func GetAddressTimestampDistribution(db *sql.DB, buckets []time.Duration) (distribution map[string]int, err error) {
+	if len(buckets) == 0 {
+		buckets = ADDRESS_FRESHNESS_BUCKETS
+	}
+
+	// Assign each address the index of its bucket
+	cases := make([]string, len(buckets))
+	args := make([]interface{}, len(buckets))
+	for i, b := range buckets {
+		cases[i] = fmt.Sprintf("WHEN age < ? THEN %d", i)
+		args[i] = int64(b / time.Second)
+	}
+
+	query := fmt.Sprintf(`SELECT CASE %s ELSE %d END AS bucket, COUNT(*)
+		FROM (SELECT seen_at - addr_timestamp AS age FROM addresses_seen)
+		GROUP BY bucket`, strings.Join(cases, " "), len(buckets))
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	var bucket, count int
+	distribution = make(map[string]int)
+
+	for rows.Next() {
+		err = rows.Scan(&bucket, &count)
+		if err != nil {
+			return
+		}
+		distribution[bucketName(buckets, bucket)] = count
+	}
+
+	return distribution, rows.Err()
+}
+
+// Name of the i-th group delimited by the given bounds
+func bucketName(buckets []time.Duration, i int) string {
+	switch {
+	case i == 0:
+		return "< " + shortDuration(buckets[0])
+	case i == len(buckets):
+		return "> " + shortDuration(buckets[i-1])
+	default:
+		return shortDuration(buckets[i-1]) + "-" + shortDuration(buckets[i])
+	}
+}
+
+// Format a duration using the largest of week, day or hour which divides it
+func shortDuration(d time.Duration) string {
+	const day = 24 * time.Hour
+
+	switch {
+	case d%(7*day) == 0:
+		return fmt.Sprintf("%dw", d/(7*day))
+	case d%day == 0:
+		return fmt.Sprintf("%dd", d/day)
+	case d%time.Hour == 0:
+		return fmt.Sprintf("%dh", d/time.Hour)
+	default:
+		return d.String()
+	}
+}
+
+// Time at which the node was first inserted in the DB. Returns ErrNodeNotFound
+// if the node is not in the DB
+func GetFirstSeenDate(db *sql.DB, ip, port string) (t time.Time, err error) {
+	var created_at int64
+	err = db.QueryRow(`SELECT CAST(created_at AS INTEGER) FROM nodes WHERE ip=? AND port=?`,
+		ip, port).Scan(&created_at)
+	if err == sql.ErrNoRows {
+		return t, ErrNodeNotFound
+	}
+	if err != nil {
+		return
+	}
+
+	return time.Unix(created_at, 0), nil
+}
+
+// Count nodes by when they were first seen. `buckets` are the increasing
+// bounds of each group, with an additional group for nodes seen after the
+// last one. Groups are named after their bounds (e.g. "< 2024-01-01",
+// "2024-01-01 - 2024-02-01", "> 2024-02-01")
+func GetNetworkAgeDistribution(db *sql.DB, buckets []time.Time) (distribution map[string]int, err error) {
+	if len(buckets) == 0 {
+		return nil, fmt.Errorf("No buckets given")
+	}
+
+	// Assign each node the index of its bucket
+	cases := make([]string, len(buckets))
+	args := make([]interface{}, len(buckets))
+	for i, b := range buckets {
+		cases[i] = fmt.Sprintf("WHEN created_at < ? THEN %d", i)
+		args[i] = b.Unix()
+	}
+
+	query := fmt.Sprintf(`SELECT CASE %s ELSE %d END AS bucket, COUNT(*)
+		FROM nodes
+		GROUP BY bucket`, strings.Join(cases, " "), len(buckets))
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	var bucket, count int
+	distribution = make(map[string]int)
+
+	for rows.Next() {
+		err = rows.Scan(&bucket, &count)
+		if err != nil {
+			return
+		}
+		distribution[dateBucketName(buckets, bucket)] = count
+	}
+
+	return distribution, rows.Err()
+}
+
+// Name of the i-th group delimited by the given dates
+func dateBucketName(buckets []time.Time, i int) string {
+	const layout = "2006-01-02"
+
+	switch {
+	case i == 0:
+		return "< " + buckets[0].Format(layout)
+	case i == len(buckets):
+		return "> " + buckets[i-1].Format(layout)
+	default:
+		return buckets[i-1].Format(layout) + " - " + buckets[i].Format(layout)
+	}
+}
+
+// Fraction of the refreshes of the given node which completed a handshake.
+// Returns 0 if the node was never refreshed
+func GetSuccessRate(db *sql.DB, ip, port string) (rate float64, err error) {
+	var total, success int
+
+	err = db.QueryRow(`SELECT COUNT(*), COALESCE(SUM(s.success), 0)
+		FROM node_sessions s
+		JOIN nodes n ON n.id = s.node_id
+		WHERE n.ip=? AND n.port=?`, ip, port).Scan(&total, &success)
+	if err != nil || total == 0 {
+		return
+	}
+
+	return float64(success) / float64(total), nil
+}
+
+// Average number of peers advertised by the nodes which advertised any
+func GetAverageAddressesPerNode(db *sql.DB) (average float64, err error) {
+	err = db.QueryRow(`SELECT COALESCE(AVG(degree), 0) FROM (
+			SELECT COUNT(*) AS degree 
+			FROM nodes_known 
+			GROUP BY id_source
+		)`).Scan(&average)
+	return
+}
+
+// Node which advertised the most peers, likely a superpeer. Returns
+// sql.ErrNoRows if no node advertised any peer
+func GetMaxDegreeNode(db *sql.DB) (ip, port string, degree int, err error) {
+	err = db.QueryRow(`SELECT n.ip, n.port, COUNT(*) 
+		FROM nodes_known nk 
+		JOIN nodes n ON n.id = nk.id_source 
+		GROUP BY nk.id_source 
+		ORDER BY COUNT(*) DESC 
+		LIMIT 1`).Scan(&ip, &port, &degree)
+	return
+}
+
+// Number of nodes with an IPv4 and IPv6 address. SQLite has no IP functions,
+// addresses containing a colon are considered to be IPv6
+func GetIPVersionDistribution(db *sql.DB) (ipv4, ipv6 int, err error) {
+	err = db.QueryRow(`SELECT COUNT(*), 
+			COALESCE(SUM(INSTR(ip, ':') > 0), 0)
+		FROM nodes`).Scan(&ipv4, &ipv6)
+	ipv4 -= ipv6
+	return
+}
+
+// Number of peers advertised by the given node (out degree) and number of
+// nodes which advertised it (in degree)
+func GetEdgeCount(db *sql.DB, ip, port string) (outDegree, inDegree int, err error) {
+	err = db.QueryRow(`SELECT COUNT(*) FROM nodes_known 
+		WHERE id_source=(SELECT id FROM nodes WHERE ip=? AND port=?)`,
+		ip, port).Scan(&outDegree)
+	if err != nil {
+		return
+	}
+
+	err = db.QueryRow(`SELECT COUNT(*) FROM nodes_known 
+		WHERE id_known=(SELECT id FROM nodes WHERE ip=? AND port=?)`,
+		ip, port).Scan(&inDegree)
+	return
+}
+
+// Fraction of all known nodes advertised by the given node. Returns 0 if no
+// node is known
+func PeerAdvertisementCoverage(db *sql.DB, ip, port string) (coverage float64, err error) {
+	outDegree, _, err := GetEdgeCount(db, ip, port)
+	if err != nil {
+		return
+	}
+
+	var total int
+	err = db.QueryRow("SELECT COUNT(*) FROM nodes").Scan(&total)
+	if err != nil || total == 0 {
+		return
+	}
+
+	return float64(outDegree) / float64(total), nil
+}
+
+// Count nodes by the combination of services they advertised in their last
+// successful handshake. Nodes which never completed a handshake are ignored
+func serviceDistribution() map[ServiceFlag]int {
+	db := acquireDBConn()
+	defer releaseDBConn(db)
+
+	query := `SELECT services, COUNT(*) 
+		FROM nodes 
+		WHERE success_at != 0 
+		GROUP BY services`
+
+	distribution := make(map[ServiceFlag]int)
+
+	rows, err := db.Query(query)
+	if err != nil {
+		logQueryError(query, err)
+		return distribution
+	}
+	defer rows.Close()
+
+	var (
+		services int64
+		count    int
+	)
+	for rows.Next() {
+		err = rows.Scan(&services, &count)
+		if err != nil {
+			logQueryError(query, err)
+			break
+		}
+		distribution[ServiceFlag(services)] = count
+	}
+
+	return distribution
+}
+
+// Count successfully crawled nodes by protocol version
+func GetProtocolDistribution(db *sql.DB) (distribution map[int]int, err error) {
+	return countNodesByProtocol(db, "success")
+}
+
+// Number of nodes online on their last refresh, by protocol version. Unlike
+// GetProtocolDistribution this counts nodes which accepted a connection, not
+// only those which completed the handshake
+func CountOnlineNodesByProtocol(db *sql.DB) (distribution map[int]int, err error) {
+	return countNodesByProtocol(db, "online")
+}
+
+// Count nodes by protocol version among those with the boolean column
+// `column` set
+func countNodesByProtocol(db *sql.DB, column string) (distribution map[int]int, err error) {
+	rows, err := db.Query(`SELECT protocol, COUNT(*) 
+		FROM nodes 
+		WHERE ` + column + `=1 
+		GROUP BY protocol`)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	var protocol, count int
+	distribution = make(map[int]int)
+
+	for rows.Next() {
+		err = rows.Scan(&protocol, &count)
+		if err != nil {
+			return
+		}
+		distribution[protocol] = count
+	}
+
+	return distribution, rows.Err()
+}
+
+// Number of nodes which completed a handshake on their last refresh, by
+// port. Shows nodes on non-standard ports and nodes without a port (e.g. Tor)
+func PortDistribution(db *sql.DB) (distribution map[uint16]int, err error) {
+	rows, err := db.Query(`SELECT port, COUNT(*) 
+		FROM nodes 
+		WHERE success=1 
+		GROUP BY port 
+		ORDER BY COUNT(*) DESC`)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	var (
+		port  uint16
+		count int
+	)
+	distribution = make(map[uint16]int)
+
+	for rows.Next() {
+		err = rows.Scan(&port, &count)
+		if err != nil {
+			return
+		}
+		distribution[port] = count
+	}
+
+	return distribution, rows.Err()
+}
+
+// Percentage of the refreshes of the given node since `since` during which it
+// was online. Returns 0 if the node was not refreshed since then
+func GetNodeUptimePercent(db *sql.DB, ip, port string, since time.Time) (percent float64, err error) {
+	err = db.QueryRow(`SELECT COALESCE(
+			SUM(CASE WHEN s.online=1 THEN 1 ELSE 0 END) * 100.0 / COUNT(*), 0)
+		FROM node_sessions s
+		JOIN nodes n ON n.id = s.node_id
+		WHERE n.ip=? AND n.port=? AND s.started_at >= ?`,
+		ip, port, since.Unix()).Scan(&percent)
+	return
+}
+
+// Longest outage of the given node: time from the first refresh during which
+// it was offline after being online to the next refresh during which it was
+// online again. Outages before the node was first seen online, or which did
+// not end yet, are ignored. Returns 0 if the node was never seen offline
+// between two online refreshes
+func GetLongestOfflineDuration(db *sql.DB, ip, port string) (longest time.Duration, err error) {
+	rows, err := db.Query(`SELECT s.started_at, s.online 
+		FROM node_sessions s 
+		JOIN nodes n ON n.id = s.node_id 
+		WHERE n.ip=? AND n.port=? 
+		ORDER BY s.started_at`, ip, port)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	var (
+		started_at, offline_at int64
+		online                 bool
+		seen_online, offline   bool
+	)
+	for rows.Next() {
+		err = rows.Scan(&started_at, &online)
+		if err != nil {
+			return
+		}
+
+		switch {
+		case online && offline:
+			gap := time.Duration(started_at-offline_at) * time.Second
+			if gap > longest {
+				longest = gap
+			}
+			offline = false
+		case !online && seen_online && !offline:
+			offline = true
+			offline_at = started_at
+		}
+		seen_online = seen_online || online
+	}
+
+	return longest, rows.Err()
+}
+
+// Percentage of the nodes refreshed since `since` which were online during at
+// least one of these refreshes. Returns 0 if no node was refreshed
+func GetNetworkOnlinePercent(db *sql.DB, since time.Time) (percent float64, err error) {
+	err = db.QueryRow(`SELECT COALESCE(SUM(online) * 100.0 / COUNT(*), 0) 
+		FROM (
+			SELECT MAX(online) AS online 
+			FROM node_sessions 
+			WHERE started_at >= ? 
+			GROUP BY node_id
+		)`, since.Unix()).Scan(&percent)
+	return
+}
+
+// Fraction of the nodes online at `now - window` which are now offline. A node
+// is online at a time if it was online during its last refresh before it, and
+// now if it was online during its last refresh. Returns 0 if no node was
+// online at `now - window`
+func GetNodeChurn(db *sql.DB, window time.Duration) (churn float64, err error) {
+	err = db.QueryRow(`SELECT COALESCE(SUM(CASE WHEN n.online=0 THEN 1 ELSE 0 END) * 1.0 / COUNT(*), 0) 
+		FROM node_sessions s 
+		JOIN nodes n ON n.id = s.node_id 
+		WHERE s.online=1 
+			AND s.started_at = (SELECT MAX(started_at) 
+				FROM node_sessions 
+				WHERE node_id = s.node_id AND started_at <= ?)`,
+		time.Now().Add(-window).Unix()).Scan(&churn)
+	return
+}
+
+// Average protocol version of the nodes online during a period
+type ProtocolCurvePoint struct {
+	Date        time.Time `json:"date"` // Start of the period
+	AvgProtocol float64   `json:"avg_protocol"`
+}
+
+// Average protocol version of online nodes over periods of bucketDays days,
+// oldest first. Sessions do not record the protocol, so the last known
+// protocol of each node is used
+func GetProtocolUpgradeCurve(db *sql.DB, bucketDays int) (curve []ProtocolCurvePoint, err error) {
+	if bucketDays < 1 {
+		return nil, fmt.Errorf("Invalid bucket size %d days", bucketDays)
+	}
+	bucket := int64(bucketDays) * 86400
+
+	rows, err := db.Query(`SELECT s.started_at / ? * ? AS day, AVG(n.protocol) 
+		FROM node_sessions s 
+		JOIN nodes n ON n.id = s.node_id 
+		WHERE s.online=1 AND n.protocol > 0 
+		GROUP BY day 
+		ORDER BY day`, bucket, bucket)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	var (
+		p   ProtocolCurvePoint
+		day int64
+	)
+	curve = make([]ProtocolCurvePoint, 0)
+
+	for rows.Next() {
+		err = rows.Scan(&day, &p.AvgProtocol)
+		if err != nil {
+			return
+		}
+
+		p.Date = time.Unix(day, 0).UTC()
+		curve = append(curve, p)
+	}
+
+	return curve, rows.Err()
+}
+
+// Median and 90th percentile protocol version of the nodes online during a
+// period
+type ProtocolTimelinePoint struct {
+	Time time.Time `json:"time"` // Start of the period
+	P50  int       `json:"p50"`
+	P90  int       `json:"p90"`
+}
+
+// Protocol version percentiles of online nodes over periods of bucketHours
+// hours, oldest first. Each node is counted once per period. Sessions do not
+// record the protocol, so the last known protocol of each node is used
+func GetProtocolVersionTimeline(db *sql.DB, bucketHours int) (timeline []ProtocolTimelinePoint, err error) {
+	if bucketHours < 1 {
+		return nil, fmt.Errorf("Invalid bucket size %d hours", bucketHours)
+	}
+	bucket := int64(bucketHours) * 3600
+
+	rows, err := db.Query(`SELECT DISTINCT s.started_at / ? * ? AS period, s.node_id, n.protocol 
+		FROM node_sessions s 
+		JOIN nodes n ON n.id = s.node_id 
+		WHERE s.online=1 AND n.protocol > 0 
+		ORDER BY period, n.protocol`, bucket, bucket)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	var (
+		period, last, node_id int64
+		protocol              int
+		protocols             []int // Sorted protocols of the current period
+	)
+	timeline = make([]ProtocolTimelinePoint, 0)
+
+	// Close the current period
+	flush := func() {
+		if len(protocols) > 0 {
+			timeline = append(timeline, ProtocolTimelinePoint{
+				Time: time.Unix(last, 0).UTC(),
+				P50:  intPercentile(protocols, 50),
+				P90:  intPercentile(protocols, 90),
+			})
+		}
+		protocols = protocols[:0]
+	}
+
+	for rows.Next() {
+		err = rows.Scan(&period, &node_id, &protocol)
+		if err != nil {
+			return
+		}
+
+		if period != last {
+			flush()
+			last = period
+		}
+		protocols = append(protocols, protocol)
+	}
+	flush()
+
+	return timeline, rows.Err()
+}
+
+// Number of nodes in an autonomous system
+type ASNCount struct {
+	ASN   int    `json:"asn"`
+	Count int    `json:"count"`
+	Name  string `json:"name"` // Empty if the name was not loaded
+}
+
+// Autonomous systems with the most nodes which completed a handshake on their
+// last refresh, most nodes first. Nodes with an unknown ASN are ignored.
+// Names are loaded with LoadASNNames
+func GetASNTopList(db *sql.DB, limit int) (top []ASNCount, err error) {
+	rows, err := db.Query(`SELECT n.asn, COUNT(*), COALESCE(a.name, '') 
+		FROM nodes n 
+		LEFT JOIN asn_names a ON a.asn = n.asn 
+		WHERE n.success=1 AND n.asn != 0 
+		GROUP BY n.asn 
+		ORDER BY COUNT(*) DESC, n.asn 
+		LIMIT ?`, limit)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	var c ASNCount
+	top = make([]ASNCount, 0)
+
+	for rows.Next() {
+		err = rows.Scan(&c.ASN, &c.Count, &c.Name)
+		if err != nil {
+			return
+		}
+		top = append(top, c)
+	}
+
+	return top, rows.Err()
+}
+
+// Nearest-rank p-th percentile of sorted values
+func intPercentile(sorted []int, p int) int {
+	rank := (p*len(sorted) + 99) / 100 // ceil(p/100 * n)
+	if rank < 1 {
+		rank = 1
+	}
+
+	return sorted[rank-1]
+}
+
+// Number of nodes discovered per day over the last `window`, counting only
+// nodes which completed a handshake
+func GetGrowthRate(db *sql.DB, window time.Duration) (nodesPerDay float64, err error) {
+	if window <= 0 {
+		return 0, fmt.Errorf("Invalid window %v", window)
+	}
+
+	var count int
+	err = db.QueryRow(`SELECT COUNT(*) 
+		FROM nodes 
+		WHERE created_at >= ? AND success=1`,
+		time.Now().Add(-window).Unix()).Scan(&count)
+	if err != nil {
+		return
+	}
+
+	return float64(count) / (window.Hours() / 24), nil
+}
+
+// Average uptime of the nodes of a user agent bucket
+type UserAgentUptime struct {
+	UserAgent string  `json:"user_agent"` // See UserAgentBucket
+	AvgUptime float64 `json:"avg_uptime"` // Fraction of sessions online
+}
+
+// User agent buckets whose nodes have the highest uptime, i.e. fraction of
+// their sessions during which they were online, averaged over the nodes of
+// each bucket. Returns at most limit entries, highest uptime first
+func GetTopUserAgentsByUptime(db *sql.DB, limit int) (top []UserAgentUptime, err error) {
+	rows, err := db.Query(`SELECT n.user_agent, AVG(s.online) 
+		FROM nodes n 
+		JOIN node_sessions s ON s.node_id = n.id 
+		WHERE n.user_agent != '' 
+		GROUP BY n.id`)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	var (
+		ua     string
+		uptime float64
+	)
+	sums := make(map[string]float64)
+	counts := make(map[string]int)
+
+	for rows.Next() {
+		err = rows.Scan(&ua, &uptime)
+		if err != nil {
+			return
+		}
+
+		bucket := UserAgentBucket(ua)
+		sums[bucket] += uptime
+		counts[bucket]++
+	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+
+	top = make([]UserAgentUptime, 0, len(sums))
+	for bucket, sum := range sums {
+		top = append(top, UserAgentUptime{bucket, sum / float64(counts[bucket])})
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].AvgUptime != top[j].AvgUptime {
+			return top[i].AvgUptime > top[j].AvgUptime
+		}
+		return top[i].UserAgent < top[j].UserAgent
+	})
+
+	if len(top) > limit {
+		top = top[:limit]
+	}
+
+	return top, nil
+}
+
+// Number of nodes with a private (RFC 1918) IPv4 address, which are likely
+// behind a NAT and unreachable
+func DetectNATedNodes(db *sql.DB) (count int, err error) {
+	// The second octet of 172.x.y.z addresses is between the first two dots
+	err = db.QueryRow(`SELECT COUNT(*) 
+		FROM nodes 
+		WHERE ip LIKE '10.%' 
+			OR ip LIKE '192.168.%' 
+			OR (ip LIKE '172.%' 
+				AND CAST(SUBSTR(ip, 5, INSTR(SUBSTR(ip, 5), '.') - 1) AS INTEGER) 
+					BETWEEN 16 AND 31)`).Scan(&count)
+	return
+}
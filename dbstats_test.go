@@ -0,0 +1,871 @@
+package main
+
+import (
+	"database/sql"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Insert sessions for node `node_id`. Each session is given as
+// {started_at, online, success}
+func tempSessions(t *testing.T, db *sql.DB, node_id int64, sessions [][3]int64) {
+	stmt, err := db.Prepare(`INSERT INTO node_sessions (node_id, started_at, online, success) 
+		VALUES (?, ?, ?, ?)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stmt.Close()
+
+	for _, s := range sessions {
+		_, err = stmt.Exec(node_id, s[0], s[1], s[2])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestGetUserAgentDistribution(t *testing.T) {
+	db := tempDB(t)
+	defer db.Close()
+
+	_, err := db.Exec(`INSERT INTO nodes (ip, port, user_agent, success, updated_at) VALUES
+		('1.1.1.1', 1, '/Satoshi:25.0.0/', 1, 0),
+		('2.2.2.2', 2, '/Satoshi:25.1.0/', 1, 0),
+		('3.3.3.3', 3, '/Satoshi:24.0.1/', 1, 0),
+		('4.4.4.4', 4, 'weird', 1, 0),
+		('5.5.5.5', 5, '/Satoshi:25.0.0/', 0, 0)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := GetUserAgentDistribution(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]int{
+		"/Satoshi:25/": 2,
+		"/Satoshi:24/": 1,
+		"Other":        1,
+	}
+	if !reflect.DeepEqual(expected, got) {
+		t.Error("User agent distribution expected ", expected, " got ", got)
+	}
+}
+
+func TestGetRelayFlagDistribution(t *testing.T) {
+	db := tempDB(t)
+	defer db.Close()
+
+	_, err := db.Exec(`INSERT INTO nodes (ip, port, relay, success, updated_at) VALUES
+		('1.1.1.1', 1, 1, 1, 0),
+		('2.2.2.2', 2, 1, 1, 0),
+		('3.3.3.3', 3, 1, 1, 0),
+		('4.4.4.4', 4, 0, 1, 0),
+		('5.5.5.5', 5, 0, 1, 0),
+		('6.6.6.6', 6, 1, 0, 0)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	on, off, err := GetRelayFlagDistribution(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if on != 3 || off != 2 {
+		t.Error("Relay distribution expected 3/2 got ", on, "/", off)
+	}
+}
+
+func TestGetAddressTimestampDistribution(t *testing.T) {
+	db := tempDB(t)
+	defer db.Close()
+
+	// Addresses advertised with ages 10m, 30m, 2h, 3d and 30d
+	stmt, err := db.Prepare(`INSERT INTO addresses_seen (id_source, ip, port, addr_timestamp, seen_at) 
+		VALUES (1, '1.1.1.1', 1, ?, ?)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen_at := int64(100000000)
+	for _, age := range []time.Duration{
+		10 * time.Minute,
+		30 * time.Minute,
+		2 * time.Hour,
+		3 * 24 * time.Hour,
+		30 * 24 * time.Hour,
+	} {
+		_, err = stmt.Exec(seen_at-int64(age/time.Second), seen_at)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	stmt.Close()
+
+	got, err := GetAddressTimestampDistribution(db, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]int{
+		"< 1h":  2,
+		"1h-1d": 1,
+		"1d-1w": 1,
+		"> 1w":  1,
+	}
+	if !reflect.DeepEqual(expected, got) {
+		t.Error("Address freshness expected ", expected, " got ", got)
+	}
+
+	// TEST: Custom buckets
+	got, err = GetAddressTimestampDistribution(db, []time.Duration{20 * time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected = map[string]int{
+		"< 20m0s": 1,
+		"> 20m0s": 4,
+	}
+	if !reflect.DeepEqual(expected, got) {
+		t.Error("Address freshness expected ", expected, " got ", got)
+	}
+}
+
+func TestGetFirstSeenDate(t *testing.T) {
+	db := tempDB(t)
+	defer db.Close()
+
+	_, err := db.Exec(`INSERT INTO nodes (ip, port, created_at, updated_at) 
+		VALUES ('1.1.1.1', 1, 1600000000, 0)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := GetFirstSeenDate(db, "1.1.1.1", "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Equal(time.Unix(1600000000, 0)) {
+		t.Error("Expected first seen at 1600000000 got ", got.Unix())
+	}
+
+	// TEST: Unknown node
+	_, err = GetFirstSeenDate(db, "2.2.2.2", "2")
+	if err != ErrNodeNotFound {
+		t.Error("Expected ErrNodeNotFound got ", err)
+	}
+}
+
+func TestGetNetworkAgeDistribution(t *testing.T) {
+	db := tempDB(t)
+	defer db.Close()
+
+	jan := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	feb := time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)
+
+	_, err := db.Exec(`INSERT INTO nodes (ip, port, created_at, updated_at) VALUES
+		('1.1.1.1', 1, ?, 0),
+		('2.2.2.2', 2, ?, 0),
+		('3.3.3.3', 3, ?, 0),
+		('4.4.4.4', 4, ?, 0),
+		('5.5.5.5', 5, ?, 0)`,
+		jan.Unix()-1, jan.Unix(), jan.Unix()+86400, feb.Unix(), feb.Unix()+86400)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := GetNetworkAgeDistribution(db, []time.Time{jan, feb})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]int{
+		"< 2024-01-01":            1,
+		"2024-01-01 - 2024-02-01": 2,
+		"> 2024-02-01":            2,
+	}
+	if !reflect.DeepEqual(expected, got) {
+		t.Error("Age distribution expected ", expected, " got ", got)
+	}
+
+	// TEST: No buckets
+	_, err = GetNetworkAgeDistribution(db, nil)
+	if err == nil {
+		t.Error("Expected error without buckets")
+	}
+}
+
+func TestGetSuccessRate(t *testing.T) {
+	db := tempDB(t)
+	defer db.Close()
+
+	tempGraph(t, db, 3, nil)
+	tempSessions(t, db, 2, [][3]int64{{100, 1, 1}, {200, 1, 1}})
+	tempSessions(t, db, 3, [][3]int64{{100, 1, 1}, {200, 0, 0}, {300, 1, 0}, {400, 1, 1}})
+
+	for _, c := range []struct {
+		ip, port string
+		expected float64
+	}{
+		{"1.1.1.1", "1", 0},   // No sessions
+		{"2.2.2.2", "2", 1},   // All successes
+		{"3.3.3.3", "3", 0.5}, // Mixed
+		{"9.9.9.9", "9", 0},   // Unknown node
+	} {
+		got, err := GetSuccessRate(db, c.ip, c.port)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != c.expected {
+			t.Error(c.ip, " success rate expected ", c.expected, " got ", got)
+		}
+	}
+}
+
+func TestGetAverageAddressesPerNode(t *testing.T) {
+	db := tempDB(t)
+	defer db.Close()
+
+	// TEST: No relations
+	average, err := GetAverageAddressesPerNode(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if average != 0 {
+		t.Error("Expected average 0 got ", average)
+	}
+
+	// TEST: Nodes 1, 2 and 3 advertise 10, 20 and 30 peers
+	edges := make([][2]int64, 0)
+	for source, count := range map[int64]int64{1: 10, 2: 20, 3: 30} {
+		for known := int64(4); known < 4+count; known++ {
+			edges = append(edges, [2]int64{source, known})
+		}
+	}
+	tempGraph(t, db, 33, edges)
+
+	average, err = GetAverageAddressesPerNode(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if average != 20 {
+		t.Error("Expected average 20 got ", average)
+	}
+}
+
+func TestGetMaxDegreeNode(t *testing.T) {
+	db := tempDB(t)
+	defer db.Close()
+
+	// TEST: No relations
+	_, _, _, err := GetMaxDegreeNode(db)
+	if err != sql.ErrNoRows {
+		t.Error("Expected ErrNoRows got ", err)
+	}
+
+	// TEST: Node 3 advertises the most peers
+	tempGraph(t, db, 4, [][2]int64{
+		{1, 2},
+		{2, 1}, {2, 3},
+		{3, 1}, {3, 2}, {3, 4},
+		{4, 1},
+	})
+
+	ip, port, degree, err := GetMaxDegreeNode(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip != "3.3.3.3" || port != "3" || degree != 3 {
+		t.Error("Expected 3.3.3.3:3 with degree 3 got ", ip, ":", port, " with degree ", degree)
+	}
+}
+
+func TestGetIPVersionDistribution(t *testing.T) {
+	db := tempDB(t)
+	defer db.Close()
+
+	// TEST: Empty DB
+	ipv4, ipv6, err := GetIPVersionDistribution(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ipv4 != 0 || ipv6 != 0 {
+		t.Error("Expected 0/0 got ", ipv4, "/", ipv6)
+	}
+
+	// TEST: Mix of versions
+	tempGraph(t, db, 3, nil)
+	for i, ip := range []string{"2001:db8::1", "::1"} {
+		_, err = db.Exec("INSERT INTO nodes (ip, port, updated_at) VALUES (?, ?, 0)", ip, i)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ipv4, ipv6, err = GetIPVersionDistribution(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ipv4 != 3 || ipv6 != 2 {
+		t.Error("Expected 3/2 got ", ipv4, "/", ipv6)
+	}
+}
+
+func TestGetEdgeCount(t *testing.T) {
+	db := tempDB(t)
+	defer db.Close()
+
+	// Node 1 is a hub advertising 5 peers, 2 of which advertise it back
+	tempGraph(t, db, 6, [][2]int64{
+		{1, 2}, {1, 3}, {1, 4}, {1, 5}, {1, 6},
+		{2, 1}, {3, 1},
+		{4, 5},
+	})
+
+	for _, c := range []struct {
+		ip, port string
+		out, in  int
+	}{
+		{"1.1.1.1", "1", 5, 2}, // Hub
+		{"4.4.4.4", "4", 1, 1},
+		{"6.6.6.6", "6", 0, 1}, // Leaf
+		{"9.9.9.9", "9", 0, 0}, // Unknown node
+	} {
+		out, in, err := GetEdgeCount(db, c.ip, c.port)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out != c.out || in != c.in {
+			t.Error(c.ip, " expected out/in ", c.out, "/", c.in, " got ", out, "/", in)
+		}
+	}
+}
+
+func TestPeerAdvertisementCoverage(t *testing.T) {
+	db := tempDB(t)
+	defer db.Close()
+
+	// TEST: No known nodes
+	coverage, err := PeerAdvertisementCoverage(db, "1.1.1.1", "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if coverage != 0 {
+		t.Error("Expected coverage 0 without nodes got ", coverage)
+	}
+
+	tempGraph(t, db, 4, [][2]int64{{1, 2}, {1, 3}, {1, 4}, {2, 1}})
+
+	for _, c := range []struct {
+		ip, port string
+		expected float64
+	}{
+		{"1.1.1.1", "1", 0.75},
+		{"2.2.2.2", "2", 0.25},
+		{"3.3.3.3", "3", 0},
+		{"9.9.9.9", "9", 0}, // Unknown node
+	} {
+		coverage, err := PeerAdvertisementCoverage(db, c.ip, c.port)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if coverage != c.expected {
+			t.Error(c.ip, " expected coverage ", c.expected, " got ", coverage)
+		}
+	}
+}
+
+func TestCountOnlineNodesByProtocol(t *testing.T) {
+	db := tempDB(t)
+	defer db.Close()
+
+	_, err := db.Exec(`INSERT INTO nodes (ip, port, protocol, online, updated_at) VALUES
+		('1.1.1.1', 1, 70015, 1, 0),
+		('2.2.2.2', 2, 70015, 1, 0),
+		('3.3.3.3', 3, 70015, 1, 0),
+		('4.4.4.4', 4, 70016, 1, 0),
+		('5.5.5.5', 5, 60001, 1, 0),
+		('6.6.6.6', 6, 70016, 0, 0) -- offline`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := CountOnlineNodesByProtocol(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[int]int{70015: 3, 70016: 1, 60001: 1}
+	if !reflect.DeepEqual(expected, got) {
+		t.Error("Expected distribution ", expected, " got ", got)
+	}
+}
+
+func TestPortDistribution(t *testing.T) {
+	db := tempDB(t)
+	defer db.Close()
+
+	// TEST: Empty DB
+	got, err := PortDistribution(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 0 {
+		t.Error("Expected empty distribution got ", got)
+	}
+
+	// TEST: Mix of ports
+	_, err = db.Exec(`INSERT INTO nodes (ip, port, success, updated_at) VALUES
+		('1.1.1.1', 8333, 1, 0),
+		('2.2.2.2', 8333, 1, 0),
+		('3.3.3.3', 8333, 1, 0),
+		('4.4.4.4', 18333, 1, 0),
+		('5.5.5.5', 0, 1, 0),
+		('6.6.6.6', 8334, 0, 0) -- no handshake`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err = PortDistribution(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[uint16]int{8333: 3, 18333: 1, 0: 1}
+	if !reflect.DeepEqual(expected, got) {
+		t.Error("Expected distribution ", expected, " got ", got)
+	}
+}
+
+func TestGetNodeUptimePercent(t *testing.T) {
+	db := tempDB(t)
+	defer db.Close()
+
+	tempGraph(t, db, 2, nil)
+	tempSessions(t, db, 1, [][3]int64{
+		{50, 0, 0}, // Before since
+		{100, 1, 1}, {200, 0, 0}, {300, 1, 0}, {400, 0, 0}, {500, 1, 1},
+	})
+
+	for _, c := range []struct {
+		ip, port string
+		since    int64
+		expected float64
+	}{
+		{"1.1.1.1", "1", 100, 60},
+		{"1.1.1.1", "1", 450, 100},
+		{"1.1.1.1", "1", 1000, 0}, // No sessions since
+		{"2.2.2.2", "2", 0, 0},    // Never refreshed
+	} {
+		got, err := GetNodeUptimePercent(db, c.ip, c.port, time.Unix(c.since, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != c.expected {
+			t.Error(c.ip, " since ", c.since, " expected ", c.expected, "% got ", got)
+		}
+	}
+}
+
+func TestGetLongestOfflineDuration(t *testing.T) {
+	db := tempDB(t)
+	defer db.Close()
+
+	tempGraph(t, db, 4, nil)
+	day := int64(86400)
+	// Offline for 3 days between two online periods, and 1 day later
+	tempSessions(t, db, 1, [][3]int64{
+		{0, 0, 0}, // Before it was first seen online
+		{5 * day, 1, 1}, {6 * day, 1, 1},
+		{7 * day, 0, 0}, {8 * day, 0, 0}, {9 * day, 0, 0},
+		{10 * day, 1, 1}, {11 * day, 1, 0},
+		{12 * day, 0, 0}, {13 * day, 1, 1},
+		{14 * day, 0, 0}, // Still offline
+	})
+	// Online only once
+	tempSessions(t, db, 2, [][3]int64{{0, 1, 1}, {day, 0, 0}})
+	// Always online, refreshed every day
+	tempSessions(t, db, 4, [][3]int64{
+		{0, 1, 1}, {day, 1, 1}, {2 * day, 1, 1}, {3 * day, 1, 0},
+	})
+
+	for _, c := range []struct {
+		ip, port string
+		expected time.Duration
+	}{
+		{"1.1.1.1", "1", 3 * 24 * time.Hour},
+		{"2.2.2.2", "2", 0},
+		{"3.3.3.3", "3", 0}, // Never refreshed
+		{"4.4.4.4", "4", 0}, // Never offline
+		{"9.9.9.9", "9", 0}, // Unknown node
+	} {
+		got, err := GetLongestOfflineDuration(db, c.ip, c.port)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != c.expected {
+			t.Error(c.ip, " expected ", c.expected, " got ", got)
+		}
+	}
+}
+
+func TestGetNetworkOnlinePercent(t *testing.T) {
+	db := tempDB(t)
+	defer db.Close()
+
+	// TEST: No sessions
+	percent, err := GetNetworkOnlinePercent(db, time.Unix(0, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if percent != 0 {
+		t.Error("Expected 0% got ", percent)
+	}
+
+	// TEST: 10 nodes, 7 of which were online at least once
+	tempGraph(t, db, 10, nil)
+	for id := int64(1); id <= 10; id++ {
+		online := int64(0)
+		if id <= 7 {
+			online = 1
+		}
+		tempSessions(t, db, id, [][3]int64{{100, 0, 0}, {200, online, 0}})
+	}
+	// Online before since
+	tempSessions(t, db, 8, [][3]int64{{50, 1, 1}})
+
+	percent, err = GetNetworkOnlinePercent(db, time.Unix(100, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if percent != 70 {
+		t.Error("Expected 70% got ", percent)
+	}
+}
+
+func TestGetNodeChurn(t *testing.T) {
+	db := tempDB(t)
+	defer db.Close()
+
+	now := time.Now().Unix()
+	day := int64(86400)
+	_, err := db.Exec(`INSERT INTO nodes (id, ip, port, online, updated_at) VALUES
+		(1, '1.1.1.1', 1, 1, 0),
+		(2, '2.2.2.2', 2, 0, 0),
+		(3, '3.3.3.3', 3, 0, 0),
+		(4, '4.4.4.4', 4, 0, 0),
+		(5, '5.5.5.5', 5, 0, 0)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Online 7 days ago: 1 (still online), 2 and 3 (now offline)
+	tempSessions(t, db, 1, [][3]int64{{now - 8*day, 1, 1}, {now, 1, 1}})
+	tempSessions(t, db, 2, [][3]int64{{now - 9*day, 0, 0}, {now - 8*day, 1, 1}, {now, 0, 0}})
+	tempSessions(t, db, 3, [][3]int64{{now - 10*day, 1, 1}, {now, 0, 0}})
+	// Offline on its last refresh before 7 days ago
+	tempSessions(t, db, 4, [][3]int64{{now - 9*day, 1, 1}, {now - 8*day, 0, 0}, {now, 0, 0}})
+	// Discovered since
+	tempSessions(t, db, 5, [][3]int64{{now - day, 1, 1}, {now, 0, 0}})
+
+	churn, err := GetNodeChurn(db, 7*24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if churn != 2.0/3 {
+		t.Error("Expected churn 2/3 got ", churn)
+	}
+
+	// TEST: No node online at the start of the window
+	churn, err = GetNodeChurn(db, 30*24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if churn != 0 {
+		t.Error("Expected churn 0 got ", churn)
+	}
+}
+
+func TestGetProtocolUpgradeCurve(t *testing.T) {
+	db := tempDB(t)
+	defer db.Close()
+
+	_, err := db.Exec(`INSERT INTO nodes (id, ip, port, protocol, updated_at) VALUES
+		(1, '1.1.1.1', 1, 70001, 0),
+		(2, '2.2.2.2', 2, 70015, 0),
+		(3, '3.3.3.3', 3, 70016, 0),
+		(4, '4.4.4.4', 4, 0, 0) -- never completed handshake`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	day := int64(86400)
+	tempSessions(t, db, 1, [][3]int64{{0, 1, 1}, {8 * day, 1, 1}})
+	tempSessions(t, db, 2, [][3]int64{{day, 1, 1}, {9 * day, 0, 0}})
+	tempSessions(t, db, 3, [][3]int64{{10 * day, 1, 1}})
+	tempSessions(t, db, 4, [][3]int64{{day, 1, 0}})
+
+	curve, err := GetProtocolUpgradeCurve(db, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []ProtocolCurvePoint{
+		{time.Unix(0, 0).UTC(), 70008},
+		{time.Unix(7*day, 0).UTC(), 70008.5},
+	}
+	if !reflect.DeepEqual(expected, curve) {
+		t.Error("Expected curve ", expected, " got ", curve)
+	}
+
+	// TEST: Invalid bucket size
+	_, err = GetProtocolUpgradeCurve(db, 0)
+	if err == nil {
+		t.Error("Expected error for empty buckets")
+	}
+}
+
+func TestGetProtocolVersionTimeline(t *testing.T) {
+	db := tempDB(t)
+	defer db.Close()
+
+	_, err := db.Exec(`INSERT INTO nodes (id, ip, port, protocol, updated_at) VALUES
+		(1, '1.1.1.1', 1, 70001, 0),
+		(2, '2.2.2.2', 2, 70015, 0),
+		(3, '3.3.3.3', 3, 70016, 0),
+		(4, '4.4.4.4', 4, 70016, 0),
+		(5, '5.5.5.5', 5, 0, 0) -- never completed handshake`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hour := int64(3600)
+	// Node 1 has two sessions in the first period and is counted once
+	tempSessions(t, db, 1, [][3]int64{{0, 1, 1}, {hour, 1, 1}, {7 * hour, 1, 1}})
+	tempSessions(t, db, 2, [][3]int64{{2 * hour, 1, 1}, {8 * hour, 0, 0}})
+	tempSessions(t, db, 3, [][3]int64{{3 * hour, 1, 1}, {9 * hour, 1, 1}})
+	tempSessions(t, db, 4, [][3]int64{{13 * hour, 1, 1}})
+	tempSessions(t, db, 5, [][3]int64{{hour, 1, 0}})
+
+	timeline, err := GetProtocolVersionTimeline(db, 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []ProtocolTimelinePoint{
+		{time.Unix(0, 0).UTC(), 70015, 70016},
+		{time.Unix(6*hour, 0).UTC(), 70001, 70016},
+		{time.Unix(12*hour, 0).UTC(), 70016, 70016},
+	}
+	if !reflect.DeepEqual(expected, timeline) {
+		t.Error("Expected timeline ", expected, " got ", timeline)
+	}
+
+	// TEST: Invalid bucket size
+	_, err = GetProtocolVersionTimeline(db, 0)
+	if err == nil {
+		t.Error("Expected error for empty buckets")
+	}
+}
+
+func TestGetASNTopList(t *testing.T) {
+	db := tempDB(t)
+	defer db.Close()
+
+	_, err := db.Exec(`INSERT INTO nodes (ip, port, asn, success, updated_at) VALUES
+		('1.1.1.1', 1, 15169, 1, 0),
+		('2.2.2.2', 2, 15169, 1, 0),
+		('3.3.3.3', 3, 16509, 1, 0),
+		('4.4.4.4', 4, 16509, 0, 0), -- no handshake
+		('5.5.5.5', 5, 3215, 1, 0),
+		('6.6.6.6', 6, 0, 1, 0),     -- unknown ASN
+		('7.7.7.7', 7, 0, 1, 0)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = LoadASNNames(db, strings.NewReader(
+		"1.0.0.0\t1.0.0.255\t15169\tUS\tGOOGLE\n"+
+			"8.8.8.0\t8.8.8.255\t15169\tUS\tGOOGLE\n"+
+			"2.0.0.0\t2.0.0.255\t3215\tFR\tOrange\n"+
+			"3.0.0.0\t3.0.0.255\t0\tNone\tNot routed\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	top, err := GetASNTopList(db, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []ASNCount{
+		{15169, 2, "GOOGLE"},
+		{3215, 1, "Orange"},
+		{16509, 1, ""},
+	}
+	if !reflect.DeepEqual(expected, top) {
+		t.Error("Expected ", expected, " got ", top)
+	}
+
+	top, err = GetASNTopList(db, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(top) != 1 || top[0].ASN != 15169 {
+		t.Error("Expected only the top ASN got ", top)
+	}
+}
+
+func TestGetGrowthRate(t *testing.T) {
+	db := tempDB(t)
+	defer db.Close()
+
+	stmt, err := db.Prepare(`INSERT INTO nodes (ip, port, success, created_at, updated_at) 
+		VALUES (?, ?, ?, ?, 0)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stmt.Close()
+
+	// 70 nodes discovered over the last 7 days, plus older and unreachable
+	// nodes which are not counted
+	now := time.Now().Unix()
+	for i := 0; i < 70; i++ {
+		_, err = stmt.Exec("1.1.1.1", i, 1, now-int64(i)*7*86400/70)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = stmt.Exec("2.2.2.2", 1, 1, now-8*86400)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = stmt.Exec("3.3.3.3", 1, 0, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rate, err := GetGrowthRate(db, 7*24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rate != 10 {
+		t.Error("Expected 10 nodes per day got ", rate)
+	}
+}
+
+func TestGetTopUserAgentsByUptime(t *testing.T) {
+	db := tempDB(t)
+	defer db.Close()
+
+	_, err := db.Exec(`INSERT INTO nodes (id, ip, port, user_agent, updated_at) VALUES
+		(1, '1.1.1.1', 1, '/Satoshi:25.0.0/', 0),
+		(2, '2.2.2.2', 2, '/Satoshi:25.1.0/', 0),
+		(3, '3.3.3.3', 3, '/btcd:0.23.4/', 0),
+		(4, '4.4.4.4', 4, '/bcoin:2.2.0/', 0),
+		(5, '5.5.5.5', 5, '', 0) -- never completed handshake`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tempSessions(t, db, 1, [][3]int64{{1, 1, 1}, {2, 1, 1}})                       // 1
+	tempSessions(t, db, 2, [][3]int64{{1, 1, 1}, {2, 0, 0}})                       // 0.5
+	tempSessions(t, db, 3, [][3]int64{{1, 1, 1}, {2, 0, 0}, {3, 0, 0}, {4, 0, 0}}) // 0.25
+	tempSessions(t, db, 4, [][3]int64{{1, 0, 0}})
+	tempSessions(t, db, 5, [][3]int64{{1, 1, 0}})
+
+	top, err := GetTopUserAgentsByUptime(db, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []UserAgentUptime{
+		{"/Satoshi:25/", 0.75},
+		{"/btcd:0/", 0.25},
+	}
+	if !reflect.DeepEqual(expected, top) {
+		t.Error("Expected ", expected, " got ", top)
+	}
+}
+
+func TestDetectNATedNodes(t *testing.T) {
+	db := tempDB(t)
+	defer db.Close()
+
+	for i, ip := range []string{
+		"10.0.0.1",     // private
+		"192.168.1.20", // private
+		"172.16.0.1",   // private
+		"172.31.255.1", // private
+		"172.32.0.1",
+		"172.15.0.1",
+		"8.8.8.8",
+		"110.0.0.1",
+		"2001:db8::10",
+	} {
+		_, err := db.Exec("INSERT INTO nodes (ip, port, updated_at) VALUES (?, ?, 0)", ip, i)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	count, err := DetectNATedNodes(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 4 {
+		t.Error("Expected 4 NATed nodes got ", count)
+	}
+}
+
+func TestServiceDistribution(t *testing.T) {
+	db := tempDB(t)
+	defer db.Close()
+	tempDBPool(db)
+
+	for i, services := range []ServiceFlag{NODE_NETWORK, NODE_NETWORK, 1033, 1 << 63} {
+		node := Node{
+			NetAddr: NetAddr{IP: net.IPv4(1, 1, 1, byte(i)), Port: 8333},
+			Version: &MsgVersion{Services: services, StartHeight: int32(800000 + i)},
+		}
+		err := node.Save(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Never completed a handshake
+	err := (&Node{NetAddr: NetAddr{IP: net.IPv4(2, 2, 2, 2), Port: 8333}}).Save(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	drainStats()
+
+	var start_height int32
+	err = db.QueryRow("SELECT start_height FROM nodes WHERE ip='1.1.1.2'").Scan(&start_height)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if start_height != 800002 {
+		t.Error("Expected start height 800002 got ", start_height)
+	}
+
+	// Saving again reads back the stored services
+	node := Node{
+		NetAddr: NetAddr{IP: net.IPv4(1, 1, 1, 3), Port: 8333},
+		Version: &MsgVersion{Services: 1 << 63},
+	}
+	err = node.Save(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	drainStats()
+
+	expected := map[ServiceFlag]int{NODE_NETWORK: 2, 1033: 1, 1 << 63: 1}
+	got := serviceDistribution()
+	if !reflect.DeepEqual(expected, got) {
+		t.Error("Service distribution expected ", expected, " got ", got)
+	}
+}
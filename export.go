@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+)
+
+// Write the graph of nodes and the relations between them as a GraphML
+// document (http://graphml.graphdrawing.org), e.g. for Gephi or yEd. Nodes
+// carry their ip, port, user_agent and protocol. Edges go from the node
+// advertising an address to the advertised node.
+func ExportGraphML(db *sql.DB, w io.Writer) (err error) {
+	bw := bufio.NewWriter(w)
+
+	io.WriteString(bw, xml.Header)
+	io.WriteString(bw, `<graphml xmlns="http://graphml.graphdrawing.org/xmlns">
+  <key id="ip" for="node" attr.name="ip" attr.type="string"/>
+  <key id="port" for="node" attr.name="port" attr.type="int"/>
+  <key id="user_agent" for="node" attr.name="user_agent" attr.type="string"/>
+  <key id="protocol" for="node" attr.name="protocol" attr.type="int"/>
+  <graph id="nodes" edgedefault="directed">
+`)
+
+	rows, err := db.Query(`SELECT id, ip, port, COALESCE(user_agent, ''), protocol 
+		FROM nodes 
+		ORDER BY id`)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	var (
+		id, protocol int64
+		ip, port, ua string
+	)
+	for rows.Next() {
+		err = rows.Scan(&id, &ip, &port, &ua, &protocol)
+		if err != nil {
+			return
+		}
+
+		fmt.Fprintf(bw, `    <node id="n%d">
+      <data key="ip">%s</data>
+      <data key="port">%s</data>
+      <data key="user_agent">%s</data>
+      <data key="protocol">%d</data>
+    </node>
+`, id, xmlEscape(ip), xmlEscape(port), xmlEscape(ua), protocol)
+	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+
+	// Edges must refer to exported nodes
+	rows, err = db.Query(`SELECT id, id_source, id_known 
+		FROM nodes_known 
+		WHERE id_source IN (SELECT id FROM nodes) 
+			AND id_known IN (SELECT id FROM nodes) 
+		ORDER BY id`)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	var source, known int64
+	for rows.Next() {
+		err = rows.Scan(&id, &source, &known)
+		if err != nil {
+			return
+		}
+
+		fmt.Fprintf(bw, "    <edge id=\"e%d\" source=\"n%d\" target=\"n%d\"/>\n", id, source, known)
+	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+
+	io.WriteString(bw, "  </graph>\n</graphml>\n")
+
+	return bw.Flush()
+}
+
+// Escape s for use as XML text or attribute value
+func xmlEscape(s string) string {
+	var buf bytes.Buffer
+	xml.EscapeText(&buf, []byte(s))
+	return buf.String()
+}
+
+// Write the graph of nodes and the relations between them as a dynamic GEXF
+// 1.3 document (https://gexf.net) for Gephi. Each edge spans from the creation
+// of the relation to its last update.
+func ExportGEXF(db *sql.DB, w io.Writer) (err error) {
+	bw := bufio.NewWriter(w)
+
+	io.WriteString(bw, xml.Header)
+	io.WriteString(bw, `<gexf xmlns="http://gexf.net/1.3" version="1.3">
+  <graph mode="dynamic" defaultedgetype="directed" timeformat="dateTime">
+    <nodes>
+`)
+
+	rows, err := db.Query("SELECT id, ip, port FROM nodes ORDER BY id")
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	var (
+		id       int64
+		ip, port string
+	)
+	for rows.Next() {
+		err = rows.Scan(&id, &ip, &port)
+		if err != nil {
+			return
+		}
+
+		fmt.Fprintf(bw, "      <node id=\"n%d\" label=\"%s\"/>\n", id,
+			xmlEscape(net.JoinHostPort(ip, port)))
+	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+
+	io.WriteString(bw, "    </nodes>\n    <edges>\n")
+
+	// Edges must refer to exported nodes
+	rows, err = db.Query(`SELECT id, id_source, id_known, 
+			CAST(created_at AS INTEGER), CAST(updated_at AS INTEGER) 
+		FROM nodes_known 
+		WHERE id_source IN (SELECT id FROM nodes) 
+			AND id_known IN (SELECT id FROM nodes) 
+		ORDER BY id`)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	var (
+		source, known          int64
+		created_at, updated_at sql.NullInt64
+	)
+	for rows.Next() {
+		err = rows.Scan(&id, &source, &known, &created_at, &updated_at)
+		if err != nil {
+			return
+		}
+
+		fmt.Fprintf(bw, "      <edge id=\"e%d\" source=\"n%d\" target=\"n%d\"%s%s/>\n",
+			id, source, known, gexfTime("start", created_at), gexfTime("end", updated_at))
+	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+
+	io.WriteString(bw, "    </edges>\n  </graph>\n</gexf>\n")
+
+	return bw.Flush()
+}
+
+// Time attribute of a GEXF element, empty if the time is unknown
+func gexfTime(name string, t sql.NullInt64) string {
+	if !t.Valid {
+		return ""
+	}
+
+	return fmt.Sprintf(" %s=\"%s\"", name, time.Unix(t.Int64, 0).UTC().Format(time.RFC3339))
+}
+
+// Write the graph of nodes as GEXF to the given file
+func writeGEXF(db *sql.DB, filename string) (err error) {
+	f, err := os.Create(filename)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	err = ExportGEXF(db, f)
+	if err != nil {
+		return
+	}
+
+	return f.Close()
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"testing"
+)
+
+// Count the elements of the XML document by local name. Fails if the
+// document is not well-formed
+func countXMLElements(t *testing.T, doc []byte) map[string]int {
+	counts := make(map[string]int)
+
+	decoder := xml.NewDecoder(bytes.NewReader(doc))
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return counts
+		}
+		if err != nil {
+			t.Fatal("Invalid XML: ", err, "\n", string(doc))
+		}
+
+		if start, ok := token.(xml.StartElement); ok {
+			counts[start.Name.Local]++
+		}
+	}
+}
+
+func TestExportGraphML(t *testing.T) {
+	db := tempDB(t)
+	defer db.Close()
+
+	// Relation to node 9 which is not in the nodes table is not exported
+	tempGraph(t, db, 3, [][2]int64{{1, 2}, {2, 3}, {3, 1}, {1, 9}})
+	_, err := db.Exec(`UPDATE nodes SET user_agent='/Satoshi:25.0.0/<&>', protocol=70016 WHERE id=1`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	err = ExportGraphML(db, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	counts := countXMLElements(t, buf.Bytes())
+	if counts["graphml"] != 1 || counts["graph"] != 1 {
+		t.Error("Expected a single graphml and graph element got ", counts)
+	}
+	if counts["node"] != 3 {
+		t.Error("Expected 3 nodes got ", counts["node"])
+	}
+	if counts["edge"] != 3 {
+		t.Error("Expected 3 edges got ", counts["edge"])
+	}
+	if counts["data"] != 3*4 {
+		t.Error("Expected 4 attributes per node got ", counts["data"])
+	}
+	if !bytes.Contains(buf.Bytes(), []byte("/Satoshi:25.0.0/&lt;&amp;&gt;")) {
+		t.Error("Expected escaped user agent in\n", buf.String())
+	}
+}
+
+func TestExportGEXF(t *testing.T) {
+	db := tempDB(t)
+	defer db.Close()
+
+	tempGraph(t, db, 4, [][2]int64{{1, 2}, {2, 3}, {3, 1}, {4, 1}, {1, 9}})
+	_, err := db.Exec("UPDATE nodes_known SET created_at=1600000000, updated_at=1700000000")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	err = ExportGEXF(db, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var doc struct {
+		XMLName xml.Name `xml:"gexf"`
+		Version string   `xml:"version,attr"`
+		Graph   struct {
+			Mode  string `xml:"mode,attr"`
+			Nodes []struct {
+				ID    string `xml:"id,attr"`
+				Label string `xml:"label,attr"`
+			} `xml:"nodes>node"`
+			Edges []struct {
+				Source string `xml:"source,attr"`
+				Target string `xml:"target,attr"`
+				Start  string `xml:"start,attr"`
+				End    string `xml:"end,attr"`
+			} `xml:"edges>edge"`
+		} `xml:"graph"`
+	}
+	err = xml.Unmarshal(buf.Bytes(), &doc)
+	if err != nil {
+		t.Fatal("Invalid XML: ", err, "\n", buf.String())
+	}
+
+	if doc.Version != "1.3" || doc.Graph.Mode != "dynamic" {
+		t.Error("Expected dynamic GEXF 1.3 graph got ", doc.Version, " ", doc.Graph.Mode)
+	}
+	if len(doc.Graph.Nodes) != 4 {
+		t.Error("Expected 4 nodes got ", len(doc.Graph.Nodes))
+	}
+	if len(doc.Graph.Edges) != 4 {
+		t.Fatal("Expected 4 edges got ", len(doc.Graph.Edges))
+	}
+	if doc.Graph.Nodes[0].Label != "1.1.1.1:1" {
+		t.Error("Expected label 1.1.1.1:1 got ", doc.Graph.Nodes[0].Label)
+	}
+
+	edge := doc.Graph.Edges[0]
+	if edge.Source != "n1" || edge.Target != "n2" {
+		t.Error("Expected edge n1 -> n2 got ", edge.Source, " -> ", edge.Target)
+	}
+	if edge.Start != "2020-09-13T12:26:40Z" || edge.End != "2023-11-14T22:13:20Z" {
+		t.Error("Unexpected edge interval ", edge.Start, " ", edge.End)
+	}
+}
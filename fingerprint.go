@@ -0,0 +1,81 @@
+package main
+
+import (
+	"database/sql"
+)
+
+// Characteristics of the version message of a node which differ between
+// client implementations
+type NodeFingerprint struct {
+	HasRelay        bool        `json:"has_relay"`         // Relay field included
+	UserAgentBucket string      `json:"user_agent_bucket"` // See UserAgentBucket
+	ProtocolBand    string      `json:"protocol_band"`     // See protocolBand
+	ServiceFlags    ServiceFlag `json:"services"`
+}
+
+// Compute the fingerprint of the node which sent the given version message
+func ComputeFingerprint(ver MsgVersion) NodeFingerprint {
+	return NodeFingerprint{
+		HasRelay:        ver.HasRelay,
+		UserAgentBucket: UserAgentBucket(ver.UserAgent),
+		ProtocolBand:    protocolBand(ver.Protocol),
+		ServiceFlags:    ver.Services,
+	}
+}
+
+// Range of protocol versions the given version belongs to, delimited by the
+// versions which changed the handshake
+func protocolBand(protocol uint32) string {
+	switch {
+	case protocol < VERSION_TIME_IN_NETADDR:
+		return "<31402"
+	case protocol < VERSION_BIP_0031:
+		return "31402-60000"
+	case protocol < VERSION_BIP_0037:
+		return "60001-70000"
+	case protocol < VERSION_BIP_0130:
+		return "70001-70011"
+	case protocol < VERSION_WTXID_RELAY:
+		return "70012-70015"
+	default:
+		return ">=70016"
+	}
+}
+
+// Number of nodes sharing a fingerprint
+type ClientCount struct {
+	NodeFingerprint
+	Count int `json:"count"`
+}
+
+// Number of nodes with each fingerprint, most common first
+func GetClientDistribution(db *sql.DB) (distribution []ClientCount, err error) {
+	rows, err := db.Query(`SELECT has_relay, user_agent_bucket, protocol_band, 
+			services, COUNT(*) 
+		FROM node_fingerprints 
+		GROUP BY has_relay, user_agent_bucket, protocol_band, services 
+		ORDER BY COUNT(*) DESC, user_agent_bucket`)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	var (
+		c        ClientCount
+		services int64
+	)
+	distribution = make([]ClientCount, 0)
+
+	for rows.Next() {
+		err = rows.Scan(&c.HasRelay, &c.UserAgentBucket, &c.ProtocolBand,
+			&services, &c.Count)
+		if err != nil {
+			return
+		}
+
+		c.ServiceFlags = ServiceFlag(services)
+		distribution = append(distribution, c)
+	}
+
+	return distribution, rows.Err()
+}
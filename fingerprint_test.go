@@ -0,0 +1,100 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestComputeFingerprint(t *testing.T) {
+	ver := MsgVersion{
+		Protocol:  70015,
+		Services:  NODE_NETWORK,
+		UserAgent: "/Satoshi:0.21.1/",
+		HasRelay:  true,
+	}
+
+	expected := NodeFingerprint{
+		HasRelay:        true,
+		UserAgentBucket: "/Satoshi:0/",
+		ProtocolBand:    "70012-70015",
+		ServiceFlags:    NODE_NETWORK,
+	}
+	got := ComputeFingerprint(ver)
+	if got != expected {
+		t.Error("Expected fingerprint ", expected, " got ", got)
+	}
+}
+
+func TestProtocolBand(t *testing.T) {
+	for _, c := range []struct {
+		protocol uint32
+		expected string
+	}{
+		{209, "<31402"},
+		{31402, "31402-60000"},
+		{60001, "60001-70000"},
+		{70001, "70001-70011"},
+		{70015, "70012-70015"},
+		{70016, ">=70016"},
+	} {
+		got := protocolBand(c.protocol)
+		if got != c.expected {
+			t.Error(c.protocol, " expected band ", c.expected, " got ", got)
+		}
+	}
+}
+
+func TestGetClientDistribution(t *testing.T) {
+	db := tempDB(t)
+	defer db.Close()
+
+	_, err := db.Exec(`INSERT INTO node_fingerprints 
+			(node_id, has_relay, user_agent_bucket, protocol_band, services, updated_at)
+		VALUES (1, 1, '/Satoshi:25/', '>=70016', 1, 0),
+			(2, 1, '/Satoshi:25/', '>=70016', 1, 0),
+			(3, 0, '/btcd:0/', '70012-70015', 1, 0)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := GetClientDistribution(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []ClientCount{
+		{NodeFingerprint{true, "/Satoshi:25/", ">=70016", NODE_NETWORK}, 2},
+		{NodeFingerprint{false, "/btcd:0/", "70012-70015", NODE_NETWORK}, 1},
+	}
+	if !reflect.DeepEqual(expected, got) {
+		t.Error("Expected distribution ", expected, " got ", got)
+	}
+}
+
+func TestGetClientDistributionHighServiceBit(t *testing.T) {
+	var err error
+	db := tempDB(t)
+	defer db.Close()
+
+	n := &nodeDB{dbInfo: dbNodeInfo{id: 1}}
+	n.tx, err = db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := NodeFingerprint{true, "/Satoshi:25/", ">=70016", 1 << 63}
+	n.dbPutFingerprint(f)
+	err = n.tx.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := GetClientDistribution(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []ClientCount{{f, 1}}
+	if !reflect.DeepEqual(expected, got) {
+		t.Error("Expected distribution ", expected, " got ", got)
+	}
+}
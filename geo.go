@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// Location of an IP address
+type GeoInfo struct {
+	CountryCode string // ISO 3166-1 code, empty if unknown
+	ASN         int    // Autonomous system number, 0 if unknown
+}
+
+// Fields read from MaxMind DB records. Country and ASN databases each fill
+// only their own fields
+type mmdbRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	ASN uint `maxminddb:"autonomous_system_number"`
+}
+
+// Look up the location of the given IPs in a MaxMind DB. The result is keyed
+// by IP as a string and only contains IPs found in the DB. IPv6 addresses are
+// skipped with IPv4 only DBs
+func BulkLookupIPs(ips []net.IP, mmdb *maxminddb.Reader) (map[string]GeoInfo, error) {
+	geo := make(map[string]GeoInfo, len(ips))
+
+	for _, ip := range ips {
+		if ip.To4() == nil && mmdb.Metadata.IPVersion == 4 {
+			continue
+		}
+
+		var record mmdbRecord
+		err := mmdb.Lookup(ip, &record)
+		if err != nil {
+			return nil, err
+		}
+
+		info := GeoInfo{CountryCode: record.Country.ISOCode, ASN: int(record.ASN)}
+		if info != (GeoInfo{}) {
+			geo[ip.String()] = info
+		}
+	}
+
+	return geo, nil
+}
+
+// Fill in the country and ASN of the nodes without a country, in batches of
+// GEO_BACKFILL_BATCH nodes. Returns the number of nodes updated. Nodes which
+// are not found in the MaxMind DB are left unchanged
+func BackfillGeolocation(crawlerDB *sql.DB, mmdb *maxminddb.Reader) (count int, err error) {
+	var last int64 // Id of the last node of the previous batch
+
+	for {
+		ids, ips, err := nodesWithoutCountry(crawlerDB, last, GEO_BACKFILL_BATCH)
+		if err != nil {
+			return count, err
+		}
+		if len(ids) == 0 {
+			return count, nil
+		}
+		last = ids[len(ids)-1]
+
+		geo, err := BulkLookupIPs(ips, mmdb)
+		if err != nil {
+			return count, err
+		}
+
+		n, err := updateGeolocation(crawlerDB, ids, ips, geo)
+		count += n
+		if err != nil {
+			return count, err
+		}
+	}
+}
+
+// Ids and IPs of up to `limit` nodes without a country, with ids above `after`
+func nodesWithoutCountry(db *sql.DB, after int64, limit int) (ids []int64, ips []net.IP, err error) {
+	rows, err := db.Query(`SELECT id, ip 
+		FROM nodes 
+		WHERE country_code='' AND id > ? 
+		ORDER BY id 
+		LIMIT ?`, after, limit)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	var (
+		id int64
+		ip string
+	)
+	for rows.Next() {
+		err = rows.Scan(&id, &ip)
+		if err != nil {
+			return
+		}
+
+		ids = append(ids, id)
+		ips = append(ips, net.ParseIP(ip))
+	}
+
+	return ids, ips, rows.Err()
+}
+
+// Store the location of the nodes found in `geo` in a single transaction
+func updateGeolocation(db *sql.DB, ids []int64, ips []net.IP, geo map[string]GeoInfo) (count int, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare("UPDATE nodes SET country_code=?, asn=? WHERE id=?")
+	if err != nil {
+		return
+	}
+	defer stmt.Close()
+
+	for i, id := range ids {
+		info, ok := geo[ips[i].String()]
+		if !ok {
+			continue
+		}
+
+		_, err = stmt.Exec(info.CountryCode, info.ASN, id)
+		if err != nil {
+			return 0, err
+		}
+		count++
+	}
+
+	return count, tx.Commit()
+}
+
+// Store the names of autonomous systems from an ip2asn-combined.tsv file
+// (https://iptoasn.com). Each line is a range of IPs:
+//
+//	range_start	range_end	AS_number	country_code	AS_description
+//
+// Ranges which are not routed (AS 0) are ignored. Returns the number of
+// distinct autonomous systems stored
+func LoadASNNames(db *sql.DB, r io.Reader) (count int, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare("INSERT OR REPLACE INTO asn_names (asn, name) VALUES (?, ?)")
+	if err != nil {
+		return
+	}
+	defer stmt.Close()
+
+	seen := make(map[int]bool)
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) < 5 {
+			return 0, fmt.Errorf("Line %d: expected 5 fields got %d", line, len(fields))
+		}
+
+		asn, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return 0, fmt.Errorf("Line %d: invalid AS number %q", line, fields[2])
+		}
+		if asn == 0 || seen[asn] {
+			continue
+		}
+		seen[asn] = true
+
+		_, err = stmt.Exec(asn, fields[4])
+		if err != nil {
+			return 0, err
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return
+	}
+
+	return len(seen), tx.Commit()
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// Encode a MaxMind DB string, map header or unsigned integer of the given
+// type (5: uint16, 6: uint32)
+func mmdbString(s string) []byte {
+	return append([]byte{0x40 | byte(len(s))}, s...)
+}
+
+func mmdbMap(size int) []byte {
+	return []byte{0xE0 | byte(size)}
+}
+
+func mmdbUint(typ byte, v uint32) []byte {
+	var b []byte
+	for ; v > 0; v >>= 8 {
+		b = append([]byte{byte(v)}, b...)
+	}
+	return append([]byte{typ<<5 | byte(len(b))}, b...)
+}
+
+// Build an IPv4 MaxMind DB with 24 bit records where 1.0.0.0/8 is in FR with
+// ASN 3215 and 2.0.0.0/8 in DE without ASN
+func tempMMDB(t *testing.T) *maxminddb.Reader {
+	const nodeCount = 9
+	const empty = nodeCount
+
+	var data bytes.Buffer
+	france := uint32(data.Len())
+	data.Write(mmdbMap(2))
+	data.Write(mmdbString("country"))
+	data.Write(mmdbMap(1))
+	data.Write(mmdbString("iso_code"))
+	data.Write(mmdbString("FR"))
+	data.Write(mmdbString("autonomous_system_number"))
+	data.Write(mmdbUint(6, 3215))
+
+	germany := uint32(data.Len())
+	data.Write(mmdbMap(1))
+	data.Write(mmdbString("country"))
+	data.Write(mmdbMap(1))
+	data.Write(mmdbString("iso_code"))
+	data.Write(mmdbString("DE"))
+
+	// Records pointing to data are offset by the node count and separator
+	pointer := func(offset uint32) uint32 { return nodeCount + 16 + offset }
+
+	// Nodes 0-5 follow the leading zero bits of 1.x and 2.x, node 6 splits
+	// 0000000x from 0000001x, node 7 is reached by 0.x and 1.x and node 8 by
+	// 2.x and 3.x
+	records := [nodeCount][2]uint32{
+		{1, empty}, {2, empty}, {3, empty}, {4, empty}, {5, empty}, {6, empty},
+		{7, 8},
+		{empty, pointer(france)},
+		{pointer(germany), empty},
+	}
+
+	var db bytes.Buffer
+	for _, r := range records {
+		for _, v := range r {
+			db.Write([]byte{byte(v >> 16), byte(v >> 8), byte(v)})
+		}
+	}
+	db.Write(make([]byte, 16))
+	db.Write(data.Bytes())
+
+	db.WriteString("\xAB\xCD\xEFMaxMind.com")
+	db.Write(mmdbMap(5))
+	db.Write(mmdbString("node_count"))
+	db.Write(mmdbUint(6, nodeCount))
+	db.Write(mmdbString("record_size"))
+	db.Write(mmdbUint(5, 24))
+	db.Write(mmdbString("ip_version"))
+	db.Write(mmdbUint(5, 4))
+	db.Write(mmdbString("binary_format_major_version"))
+	db.Write(mmdbUint(5, 2))
+	db.Write(mmdbString("database_type"))
+	db.Write(mmdbString("Test"))
+
+	mmdb, err := maxminddb.FromBytes(db.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mmdb
+}
+
+func TestBulkLookupIPs(t *testing.T) {
+	mmdb := tempMMDB(t)
+
+	got, err := BulkLookupIPs([]net.IP{
+		net.ParseIP("1.2.3.4"),
+		net.ParseIP("2.3.4.5"),
+		net.ParseIP("3.4.5.6"), // not in DB
+		net.ParseIP("2001:db8::1"),
+	}, mmdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]GeoInfo{
+		"1.2.3.4": {"FR", 3215},
+		"2.3.4.5": {"DE", 0},
+	}
+	if !reflect.DeepEqual(expected, got) {
+		t.Error("Expected ", expected, " got ", got)
+	}
+}
+
+func TestBackfillGeolocation(t *testing.T) {
+	db := tempDB(t)
+	defer db.Close()
+	mmdb := tempMMDB(t)
+
+	_, err := db.Exec(`INSERT INTO nodes (id, ip, port, country_code, asn, updated_at) VALUES
+		(1, '1.1.1.1', 1, '', 0, 0),
+		(2, '2.2.2.2', 2, '', 0, 0),
+		(3, '3.3.3.3', 3, '', 0, 0),   -- not in DB
+		(4, '1.4.4.4', 4, 'US', 1, 0), -- already located
+		(5, '2001:db8::1', 5, '', 0, 0)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	count, err := BackfillGeolocation(db, mmdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Error("Expected 2 nodes geolocated got ", count)
+	}
+
+	expected := map[int64]GeoInfo{
+		1: {"FR", 3215},
+		2: {"DE", 0},
+		3: {"", 0},
+		4: {"US", 1},
+		5: {"", 0},
+	}
+	for id, info := range expected {
+		var got GeoInfo
+		err = db.QueryRow("SELECT country_code, asn FROM nodes WHERE id=?", id).Scan(
+			&got.CountryCode, &got.ASN)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != info {
+			t.Error("Node ", id, " expected ", info, " got ", got)
+		}
+	}
+}
+
+func TestLoadASNNames(t *testing.T) {
+	db := tempDB(t)
+	defer db.Close()
+
+	count, err := LoadASNNames(db, strings.NewReader(
+		"1.0.0.0\t1.0.0.255\t13335\tUS\tCLOUDFLARENET\n"+
+			"1.0.1.0\t1.0.3.255\t0\tNone\tNot routed\n"+
+			"1.1.1.0\t1.1.1.255\t13335\tUS\tCLOUDFLARENET\n"+
+			"2.0.0.0\t2.0.0.255\t3215\tFR\tOrange S.A.\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Error("Expected 2 autonomous systems got ", count)
+	}
+
+	var name string
+	err = db.QueryRow("SELECT name FROM asn_names WHERE asn=3215").Scan(&name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "Orange S.A." {
+		t.Error("Expected name Orange S.A. got ", name)
+	}
+
+	// TEST: Invalid file
+	_, err = LoadASNNames(db, strings.NewReader("1.0.0.0\t1.0.0.255\tAS1\n"))
+	if err == nil {
+		t.Error("Expected error for invalid line")
+	}
+}
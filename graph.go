@@ -0,0 +1,388 @@
+package main
+
+import (
+	"database/sql"
+	"strings"
+)
+
+// Part of the graph of relations between nodes. Edges are pairs of indexes in
+// Nodes, from the node advertising the address to the advertised node
+type Graph struct {
+	Nodes []ip_port
+	Edges [][2]int
+}
+
+// Load the ids of all nodes and the relations between them
+func loadGraph(db *sql.DB) (ids []int64, edges [][2]int64, err error) {
+	rows, err := db.Query("SELECT id FROM nodes")
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	var id int64
+	for rows.Next() {
+		err = rows.Scan(&id)
+		if err != nil {
+			return
+		}
+		ids = append(ids, id)
+	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+
+	rows, err = db.Query("SELECT id_source, id_known FROM nodes_known")
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	var e [2]int64
+	for rows.Next() {
+		err = rows.Scan(&e[0], &e[1])
+		if err != nil {
+			return
+		}
+		edges = append(edges, e)
+	}
+
+	return ids, edges, rows.Err()
+}
+
+// Number of nodes in the largest connected component of the graph of
+// relations between nodes, ignoring the direction of relations. Nodes without
+// relations are components of their own.
+// The whole graph is loaded in memory and traversed by BFS in O(N+E).
+func GetLargestConnectedComponent(db *sql.DB) (largest int, err error) {
+	ids, edges, err := loadGraph(db)
+	if err != nil {
+		return
+	}
+
+	known := make(map[int64]bool, len(ids))
+	for _, id := range ids {
+		known[id] = true
+	}
+
+	neighbours := make(map[int64][]int64, len(ids))
+	for _, e := range edges {
+		// Ignore relations to nodes missing from the nodes table
+		if !known[e[0]] || !known[e[1]] {
+			continue
+		}
+
+		neighbours[e[0]] = append(neighbours[e[0]], e[1])
+		neighbours[e[1]] = append(neighbours[e[1]], e[0])
+	}
+
+	visited := make(map[int64]bool, len(ids))
+	for _, start := range ids {
+		if visited[start] {
+			continue
+		}
+
+		// BFS from a node without component
+		size := 0
+		queue := []int64{start}
+		visited[start] = true
+
+		for len(queue) > 0 {
+			id := queue[0]
+			queue = queue[1:]
+			size++
+
+			for _, n := range neighbours[id] {
+				if !visited[n] {
+					visited[n] = true
+					queue = append(queue, n)
+				}
+			}
+		}
+
+		if size > largest {
+			largest = size
+		}
+	}
+
+	return
+}
+
+// Number of weakly connected components of the graph of relations between
+// nodes, i.e. ignoring the direction of relations. Nodes without relations
+// are components of their own.
+// The whole graph is loaded in memory and merged with union-find.
+func GraphPartitionCount(db *sql.DB) (count int, err error) {
+	ids, edges, err := loadGraph(db)
+	if err != nil {
+		return
+	}
+
+	parent := make(map[int64]int64, len(ids))
+	for _, id := range ids {
+		parent[id] = id
+	}
+
+	// Root of the set of id, compressing the path on the way
+	var find func(id int64) int64
+	find = func(id int64) int64 {
+		if parent[id] != id {
+			parent[id] = find(parent[id])
+		}
+		return parent[id]
+	}
+
+	count = len(ids)
+	for _, e := range edges {
+		// Ignore relations to nodes missing from the nodes table
+		if _, ok := parent[e[0]]; !ok {
+			continue
+		}
+		if _, ok := parent[e[1]]; !ok {
+			continue
+		}
+
+		a, b := find(e[0]), find(e[1])
+		if a != b {
+			parent[a] = b
+			count--
+		}
+	}
+
+	return
+}
+
+// Relations between the given nodes. matrix[i][j] is true if node nodeIDs[i]
+// advertised node nodeIDs[j]. Ids are queried in chunks so that each query
+// stays under SQLITE_MAX_VARIABLE_NUMBER parameters.
+func GetConnectivityMatrix(db *sql.DB, nodeIDs []int64) (matrix [][]bool, err error) {
+	matrix = make([][]bool, len(nodeIDs))
+	for i := range matrix {
+		matrix[i] = make([]bool, len(nodeIDs))
+	}
+
+	// Positions of each id in nodeIDs
+	index := make(map[int64][]int, len(nodeIDs))
+	for i, id := range nodeIDs {
+		index[id] = append(index[id], i)
+	}
+
+	// Half of the parameters for sources and half for known nodes
+	chunk := SQLITE_MAX_VARIABLE_NUMBER / 2
+	for s := 0; s < len(nodeIDs); s += chunk {
+		sources := nodeIDs[s:]
+		if len(sources) > chunk {
+			sources = sources[:chunk]
+		}
+
+		for k := 0; k < len(nodeIDs); k += chunk {
+			known := nodeIDs[k:]
+			if len(known) > chunk {
+				known = known[:chunk]
+			}
+
+			err = fillConnectivity(db, matrix, index, sources, known)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return
+}
+
+// Set the entries of the matrix for relations from `sources` to `known`
+func fillConnectivity(db *sql.DB, matrix [][]bool, index map[int64][]int, sources, known []int64) error {
+	args := make([]interface{}, 0, len(sources)+len(known))
+	for _, id := range sources {
+		args = append(args, id)
+	}
+	for _, id := range known {
+		args = append(args, id)
+	}
+
+	rows, err := db.Query(`SELECT id_source, id_known 
+		FROM nodes_known 
+		WHERE id_source IN (`+placeholders(len(sources))+`) 
+			AND id_known IN (`+placeholders(len(known))+`)`, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var source, dest int64
+	for rows.Next() {
+		err = rows.Scan(&source, &dest)
+		if err != nil {
+			return err
+		}
+
+		for _, i := range index[source] {
+			for _, j := range index[dest] {
+				matrix[i][j] = true
+			}
+		}
+	}
+
+	return rows.Err()
+}
+
+// List of n query parameters: ?,?,...
+func placeholders(n int) string {
+	if n <= 0 {
+		return ""
+	}
+	return strings.Repeat("?,", n-1) + "?"
+}
+
+// Neighbourhood of a node: nodes reachable by following advertised addresses
+// for at most `depth` hops, and the relations found on the way. The subgraph
+// is limited to SUBGRAPH_MAX_NODES nodes. Returns ErrNodeNotFound if the node
+// is not in the DB.
+func SubgraphBFS(db *sql.DB, ip, port string, depth int) (graph *Graph, err error) {
+	var start int64
+	err = db.QueryRow("SELECT id FROM nodes WHERE ip=? AND port=?", ip, port).Scan(&start)
+	if err == sql.ErrNoRows {
+		return nil, ErrNodeNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	graph = &Graph{Nodes: []ip_port{{ip, port}}}
+	index := map[int64]int{start: 0} // Position of each node in graph.Nodes
+
+	frontier := []int64{start}
+	for d := 0; d < depth && len(frontier) > 0; d++ {
+		var next []int64
+
+		for c := 0; c < len(frontier); c += SQLITE_MAX_VARIABLE_NUMBER {
+			sources := frontier[c:]
+			if len(sources) > SQLITE_MAX_VARIABLE_NUMBER {
+				sources = sources[:SQLITE_MAX_VARIABLE_NUMBER]
+			}
+
+			next, err = expandSubgraph(db, graph, index, sources, next)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		frontier = next
+	}
+
+	return graph, nil
+}
+
+// Add the nodes advertised by `sources` and the relations to them to the
+// graph. Returns `next` with the ids of the added nodes appended
+func expandSubgraph(db *sql.DB, graph *Graph, index map[int64]int, sources, next []int64) ([]int64, error) {
+	args := make([]interface{}, len(sources))
+	for i, id := range sources {
+		args[i] = id
+	}
+
+	rows, err := db.Query(`SELECT k.id_source, n.id, n.ip, n.port 
+		FROM nodes_known k 
+		JOIN nodes n ON n.id = k.id_known 
+		WHERE k.id_source IN (`+placeholders(len(sources))+`) 
+		ORDER BY k.id_source, n.id`, args...)
+	if err != nil {
+		return next, err
+	}
+	defer rows.Close()
+
+	var (
+		source, id int64
+		addr       ip_port
+	)
+	for rows.Next() {
+		err = rows.Scan(&source, &id, &addr.ip, &addr.port)
+		if err != nil {
+			return next, err
+		}
+
+		i, ok := index[id]
+		if !ok {
+			if len(graph.Nodes) >= SUBGRAPH_MAX_NODES {
+				continue
+			}
+
+			i = len(graph.Nodes)
+			index[id] = i
+			graph.Nodes = append(graph.Nodes, addr)
+			next = append(next, id)
+		}
+
+		graph.Edges = append(graph.Edges, [2]int{index[source], i})
+	}
+
+	return next, rows.Err()
+}
+
+// Siblings of a node: nodes advertised by at least one of the nodes which
+// advertise it. At most `limit` siblings are returned, and no more than
+// SIBLINGS_MAX_NODES.
+func GetSiblingNodes(db *sql.DB, ip, port string, limit int) (siblings []ip_port, err error) {
+	if limit <= 0 || limit > SIBLINGS_MAX_NODES {
+		limit = SIBLINGS_MAX_NODES
+	}
+
+	var node int64
+	err = db.QueryRow("SELECT id FROM nodes WHERE ip=? AND port=?", ip, port).Scan(&node)
+	if err == sql.ErrNoRows {
+		return nil, ErrNodeNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(`SELECT DISTINCT n.ip, n.port 
+		FROM nodes_known nk1 
+		JOIN nodes_known nk2 ON nk1.id_source = nk2.id_source 
+		JOIN nodes n ON n.id = nk2.id_known 
+		WHERE nk1.id_known = ? AND nk2.id_known != ? 
+		ORDER BY n.id 
+		LIMIT ?`, node, node, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var addr ip_port
+	for rows.Next() {
+		err = rows.Scan(&addr.ip, &addr.port)
+		if err != nil {
+			return nil, err
+		}
+		siblings = append(siblings, addr)
+	}
+
+	return siblings, rows.Err()
+}
+
+// Nodes which advertise both of the given nodes, ordered by address
+func GetCommonParents(db *sql.DB, ip1, port1, ip2, port2 string) (parents []ip_port, err error) {
+	const parentsQuery = `SELECT n.ip, n.port 
+		FROM nodes_known nk 
+		JOIN nodes n ON n.id = nk.id_source 
+		WHERE nk.id_known = (SELECT id FROM nodes WHERE ip=? AND port=?)`
+
+	rows, err := db.Query(parentsQuery+" INTERSECT "+parentsQuery+" ORDER BY 1, 2",
+		ip1, port1, ip2, port2)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var addr ip_port
+	for rows.Next() {
+		err = rows.Scan(&addr.ip, &addr.port)
+		if err != nil {
+			return nil, err
+		}
+		parents = append(parents, addr)
+	}
+
+	return parents, rows.Err()
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestGetLargestConnectedComponent(t *testing.T) {
+	db := tempDB(t)
+	defer db.Close()
+
+	// TEST: Empty DB
+	largest, err := GetLargestConnectedComponent(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if largest != 0 {
+		t.Error("Expected 0 got ", largest)
+	}
+
+	// TEST: Components {1, 2, 3, 4} linked regardless of direction, {5, 6}
+	// and {7}
+	tempGraph(t, db, 7, [][2]int64{
+		{1, 2}, {3, 2}, {4, 3},
+		{5, 6}, {6, 5},
+	})
+
+	largest, err = GetLargestConnectedComponent(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if largest != 4 {
+		t.Error("Expected largest component of 4 nodes got ", largest)
+	}
+
+	// TEST: Relations to nodes missing from the nodes table are ignored
+	_, err = db.Exec(`INSERT INTO nodes_known (id_source, id_known, updated_at) 
+		VALUES (7, 8, 0), (8, 9, 0), (9, 10, 0), (10, 11, 0)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	largest, err = GetLargestConnectedComponent(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if largest != 4 {
+		t.Error("Expected largest component of 4 nodes got ", largest)
+	}
+}
+
+func TestGraphPartitionCount(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		edges    [][2]int64
+		expected int
+	}{
+		{"1 component", [][2]int64{{1, 2}, {2, 3}, {4, 1}, {5, 4}, {6, 5}}, 1},
+		{"2 components", [][2]int64{{1, 2}, {3, 2}, {4, 5}, {6, 4}}, 2},
+		{"3 components", [][2]int64{{1, 2}, {2, 1}, {3, 4}, {5, 6}}, 3},
+	} {
+		db := tempDB(t)
+		tempGraph(t, db, 6, c.edges)
+
+		count, err := GraphPartitionCount(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != c.expected {
+			t.Error(c.name, ": expected ", c.expected, " got ", count)
+		}
+
+		db.Close()
+	}
+}
+
+func TestGetConnectivityMatrix(t *testing.T) {
+	db := tempDB(t)
+	defer db.Close()
+
+	// Clique of nodes 1..5, node 6 only knows node 1
+	var edges [][2]int64
+	for i := int64(1); i <= 5; i++ {
+		for j := int64(1); j <= 5; j++ {
+			if i != j {
+				edges = append(edges, [2]int64{i, j})
+			}
+		}
+	}
+	edges = append(edges, [2]int64{6, 1})
+	tempGraph(t, db, 6, edges)
+
+	// TEST: Clique
+	matrix, err := GetConnectivityMatrix(db, []int64{1, 2, 3, 4, 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matrix) != 5 {
+		t.Fatal("Expected 5 rows got ", len(matrix))
+	}
+	for i := range matrix {
+		if len(matrix[i]) != 5 {
+			t.Fatal("Expected 5 columns got ", len(matrix[i]))
+		}
+		for j := range matrix[i] {
+			if matrix[i][j] != (i != j) {
+				t.Error("Unexpected relation ", i, " -> ", j, ": ", matrix[i][j])
+			}
+		}
+	}
+
+	// TEST: Relations are directed
+	matrix, err = GetConnectivityMatrix(db, []int64{1, 6})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if matrix[0][1] || !matrix[1][0] {
+		t.Error("Expected only 6 -> 1 got ", matrix)
+	}
+
+	// TEST: More ids than parameters allowed in a query
+	ids := []int64{1}
+	for i := int64(1000); len(ids) < SQLITE_MAX_VARIABLE_NUMBER; i++ {
+		ids = append(ids, i)
+	}
+	ids = append(ids, 5)
+
+	matrix, err = GetConnectivityMatrix(db, ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := len(ids) - 1
+	if !matrix[0][last] || !matrix[last][0] {
+		t.Error("Expected relations between 1 and 5 across chunks")
+	}
+	if matrix[0][1] {
+		t.Error("Unexpected relation to unknown node")
+	}
+}
+
+func TestSubgraphBFS(t *testing.T) {
+	db := tempDB(t)
+	defer db.Close()
+
+	// Chain 1 -> 2 -> 3 -> 4, with 4 -> 2 back and 5 -> 1 unreachable from 1
+	tempGraph(t, db, 5, [][2]int64{{1, 2}, {2, 3}, {3, 4}, {4, 2}, {5, 1}})
+
+	// TEST: Unknown node
+	_, err := SubgraphBFS(db, "9.9.9.9", "9", 2)
+	if err != ErrNodeNotFound {
+		t.Error("Expected ErrNodeNotFound got ", err)
+	}
+
+	for _, c := range []struct {
+		depth int
+		nodes []ip_port
+		edges [][2]int
+	}{
+		{0, []ip_port{{"1.1.1.1", "1"}}, nil},
+		{2, []ip_port{{"1.1.1.1", "1"}, {"2.2.2.2", "2"}, {"3.3.3.3", "3"}},
+			[][2]int{{0, 1}, {1, 2}}},
+		{3, []ip_port{{"1.1.1.1", "1"}, {"2.2.2.2", "2"}, {"3.3.3.3", "3"}, {"4.4.4.4", "4"}},
+			[][2]int{{0, 1}, {1, 2}, {2, 3}}},
+		{10, []ip_port{{"1.1.1.1", "1"}, {"2.2.2.2", "2"}, {"3.3.3.3", "3"}, {"4.4.4.4", "4"}},
+			[][2]int{{0, 1}, {1, 2}, {2, 3}, {3, 1}}},
+	} {
+		graph, err := SubgraphBFS(db, "1.1.1.1", "1", c.depth)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(c.nodes, graph.Nodes) {
+			t.Error("Depth ", c.depth, " expected nodes ", c.nodes, " got ", graph.Nodes)
+		}
+		if !reflect.DeepEqual(c.edges, graph.Edges) {
+			t.Error("Depth ", c.depth, " expected edges ", c.edges, " got ", graph.Edges)
+		}
+	}
+}
+
+func TestGetSiblingNodes(t *testing.T) {
+	db := tempDB(t)
+	defer db.Close()
+
+	// 1 advertises 2, 3 and 4; 5 advertises 2 and 6; 7 advertises 3 only
+	tempGraph(t, db, 7, [][2]int64{{1, 2}, {1, 3}, {1, 4}, {5, 2}, {5, 6}, {7, 3}})
+
+	// TEST: Unknown node
+	_, err := GetSiblingNodes(db, "9.9.9.9", "9", 10)
+	if err != ErrNodeNotFound {
+		t.Error("Expected ErrNodeNotFound got ", err)
+	}
+
+	for _, c := range []struct {
+		ip, port string
+		limit    int
+		expected []ip_port
+	}{
+		{"2.2.2.2", "2", 10, []ip_port{{"3.3.3.3", "3"}, {"4.4.4.4", "4"}, {"6.6.6.6", "6"}}},
+		{"2.2.2.2", "2", 2, []ip_port{{"3.3.3.3", "3"}, {"4.4.4.4", "4"}}},
+		{"6.6.6.6", "6", 0, []ip_port{{"2.2.2.2", "2"}}},
+		{"1.1.1.1", "1", 10, nil}, // Never advertised
+	} {
+		got, err := GetSiblingNodes(db, c.ip, c.port, c.limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(c.expected, got) {
+			t.Error("Siblings of ", c.ip, " limit ", c.limit, " expected ", c.expected, " got ", got)
+		}
+	}
+}
+
+func TestGetCommonParents(t *testing.T) {
+	db := tempDB(t)
+	defer db.Close()
+
+	// 1 advertises 2 and 3; 4 advertises 2 only
+	tempGraph(t, db, 4, [][2]int64{{1, 2}, {1, 3}, {4, 2}})
+
+	got, err := GetCommonParents(db, "2.2.2.2", "2", "3.3.3.3", "3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []ip_port{{"1.1.1.1", "1"}}
+	if !reflect.DeepEqual(expected, got) {
+		t.Error("Expected common parents ", expected, " got ", got)
+	}
+
+	// TEST: No common parent
+	got, err = GetCommonParents(db, "1.1.1.1", "1", "2.2.2.2", "2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 0 {
+		t.Error("Expected no common parents got ", got)
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"database/sql"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Recent connection times by subnet
+type subnetLatencies struct {
+	mu      sync.Mutex
+	history map[string][]time.Duration
+}
+
+var latencies = &subnetLatencies{history: make(map[string][]time.Duration)}
+
+// Subnet of the given IP for which latencies are grouped: /16 for IPv4, /32
+// for IPv6. Returns the IP unchanged if it cannot be parsed
+func subnetOf(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ip
+	}
+
+	subnet := net.IPNet{IP: parsed, Mask: net.CIDRMask(32, 128)}
+	if v4 := parsed.To4(); v4 != nil {
+		subnet = net.IPNet{IP: v4, Mask: net.CIDRMask(16, 32)}
+	}
+	subnet.IP = subnet.IP.Mask(subnet.Mask)
+
+	return subnet.String()
+}
+
+// Record the time taken to connect to the given IP. Only the last
+// SUBNET_LATENCY_HISTORY durations are kept for each subnet
+func (l *subnetLatencies) Add(ip string, d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	subnet := subnetOf(ip)
+	history := append(l.history[subnet], d)
+	if len(history) > SUBNET_LATENCY_HISTORY {
+		history = history[len(history)-SUBNET_LATENCY_HISTORY:]
+	}
+	l.history[subnet] = history
+}
+
+// Record a connection attempt to the given IP which timed out after
+// `timeout`. It is counted as taking twice as long, so that the timeout of a
+// subnet whose nodes are slower than its history grows up to -connect-timeout
+// instead of only shrinking
+func (l *subnetLatencies) AddTimeout(ip string, timeout time.Duration) {
+	l.Add(ip, 2*timeout)
+}
+
+// Copy of the recent connection times of the subnet of the given IP
+func (l *subnetLatencies) History(ip string) []time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return append([]time.Duration(nil), l.history[subnetOf(ip)]...)
+}
+
+// Timeout for connecting to the given IP, given the past connection times
+// to its subnet. This is the 90th percentile of the history, clamped to
+// [MIN_CONNECT_TIMEOUT, -connect-timeout]. Uses -connect-timeout if there is
+// no history.
+func adaptiveTimeout(ip string, history []time.Duration) time.Duration {
+	if len(history) == 0 {
+		return flagConnectTimeout
+	}
+
+	timeout := percentile(history, 90)
+	if timeout < MIN_CONNECT_TIMEOUT {
+		timeout = MIN_CONNECT_TIMEOUT
+	}
+	if timeout > flagConnectTimeout {
+		timeout = flagConnectTimeout
+	}
+
+	return timeout
+}
+
+// Nearest-rank percentile p (0-100] of the given durations, which must not
+// be empty
+func percentile(durations []time.Duration, p int) time.Duration {
+	sorted := append([]time.Duration(nil), durations...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	rank := (p*len(sorted) + 99) / 100 // ceil(p/100 * n)
+	if rank < 1 {
+		rank = 1
+	}
+
+	return sorted[rank-1]
+}
+
+// Store the connection time percentiles of each subnet
+func saveSubnetLatency(db *sql.DB) (err error) {
+	latencies.mu.Lock()
+	defer latencies.mu.Unlock()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return
+	}
+
+	stmt, err := tx.Prepare(`INSERT OR REPLACE INTO subnet_latency 
+		(subnet, p50, p90, samples, updated_at) VALUES (?, ?, ?, ?, ?)`)
+	if err != nil {
+		tx.Rollback()
+		return
+	}
+	defer stmt.Close()
+
+	now := time.Now().Unix()
+	for subnet, history := range latencies.history {
+		if len(history) == 0 {
+			continue
+		}
+
+		_, err = stmt.Exec(subnet,
+			percentile(history, 50)/time.Millisecond,
+			percentile(history, 90)/time.Millisecond,
+			len(history), now)
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Seed the connection times of each subnet with its stored 90th percentile,
+// so that timeouts adapt from the first connection
+func loadSubnetLatency(db *sql.DB) (err error) {
+	rows, err := db.Query("SELECT subnet, p90 FROM subnet_latency")
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	latencies.mu.Lock()
+	defer latencies.mu.Unlock()
+
+	var (
+		subnet string
+		p90    int64
+	)
+	for rows.Next() {
+		err = rows.Scan(&subnet, &p90)
+		if err != nil {
+			return
+		}
+
+		latencies.history[subnet] = []time.Duration{time.Duration(p90) * time.Millisecond}
+	}
+
+	return rows.Err()
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSubnetOf(t *testing.T) {
+	for _, c := range []struct{ ip, expected string }{
+		{"1.2.3.4", "1.2.0.0/16"},
+		{"::ffff:1.2.3.4", "1.2.0.0/16"},
+		{"2001:db8:1::1", "2001:db8::/32"},
+		{"invalid", "invalid"},
+	} {
+		got := subnetOf(c.ip)
+		if got != c.expected {
+			t.Error(c.ip, " expected subnet ", c.expected, " got ", got)
+		}
+	}
+}
+
+func TestAdaptiveTimeout(t *testing.T) {
+	saved := flagConnectTimeout
+	defer func() { flagConnectTimeout = saved }()
+	flagConnectTimeout = 30 * time.Second
+
+	ms := time.Millisecond
+
+	history := make([]time.Duration, 0)
+	for i := 10; i >= 1; i-- {
+		history = append(history, time.Duration(i)*time.Second)
+	}
+
+	for _, c := range []struct {
+		history  []time.Duration
+		expected time.Duration
+	}{
+		{nil, flagConnectTimeout},                              // No history
+		{history, 9 * time.Second},                             // 90th percentile
+		{[]time.Duration{100 * ms, 200 * ms}, 2 * time.Second}, // Clamped low
+		{[]time.Duration{time.Minute}, 30 * time.Second},       // Clamped high
+	} {
+		got := adaptiveTimeout("1.1.1.1", c.history)
+		if got != c.expected {
+			t.Error("History ", c.history, " expected timeout ", c.expected, " got ", got)
+		}
+	}
+
+	// TEST: -connect-timeout is the upper bound
+	flagConnectTimeout = 5 * time.Second
+	if got := adaptiveTimeout("1.1.1.1", history); got != 5*time.Second {
+		t.Error("Expected timeout clamped to -connect-timeout got ", got)
+	}
+}
+
+func TestAdaptiveTimeoutGrowsOnTimeouts(t *testing.T) {
+	l := subnetLatencies{history: make(map[string][]time.Duration)}
+	for i := 0; i < SUBNET_LATENCY_HISTORY; i++ {
+		l.Add("1.2.3.4", 100*time.Millisecond)
+	}
+
+	// Every connection attempt times out
+	timeout := adaptiveTimeout("1.2.3.4", l.History("1.2.3.4"))
+	for i := 0; i < SUBNET_LATENCY_HISTORY; i++ {
+		l.AddTimeout("1.2.3.4", timeout)
+		timeout = adaptiveTimeout("1.2.3.4", l.History("1.2.3.4"))
+	}
+
+	if timeout != flagConnectTimeout {
+		t.Error("Expected timeout to grow to ", flagConnectTimeout, " got ", timeout)
+	}
+}
+
+func TestSubnetLatencies(t *testing.T) {
+	l := subnetLatencies{history: make(map[string][]time.Duration)}
+
+	for i := 0; i < SUBNET_LATENCY_HISTORY+10; i++ {
+		l.Add("1.2.3.4", time.Duration(i))
+	}
+	l.Add("1.2.200.200", time.Hour)
+
+	history := l.History("1.2.0.1")
+	if len(history) != SUBNET_LATENCY_HISTORY {
+		t.Fatal("Expected ", SUBNET_LATENCY_HISTORY, " durations got ", len(history))
+	}
+	if history[0] != 11 || history[len(history)-1] != time.Hour {
+		t.Error("Expected oldest durations to be dropped, got ", history[0], " ... ", history[len(history)-1])
+	}
+
+	if len(l.History("1.3.3.4")) != 0 {
+		t.Error("Expected no history for other subnet")
+	}
+}
+
+func TestSubnetLatencyDB(t *testing.T) {
+	db := tempDB(t)
+	defer db.Close()
+
+	saved := latencies
+	defer func() { latencies = saved }()
+
+	latencies = &subnetLatencies{history: map[string][]time.Duration{
+		"1.2.0.0/16": {time.Second, 2 * time.Second, 3 * time.Second},
+	}}
+
+	err := saveSubnetLatency(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var p50, p90, samples int
+	err = db.QueryRow("SELECT p50, p90, samples FROM subnet_latency WHERE subnet='1.2.0.0/16'").
+		Scan(&p50, &p90, &samples)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p50 != 2000 || p90 != 3000 || samples != 3 {
+		t.Error("Unexpected percentiles p50=", p50, " p90=", p90, " samples=", samples)
+	}
+
+	latencies = &subnetLatencies{history: make(map[string][]time.Duration)}
+	err = loadSubnetLatency(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	history := latencies.History("1.2.3.4")
+	if len(history) != 1 || history[0] != 3*time.Second {
+		t.Error("Expected history seeded with p90 got ", history)
+	}
+}
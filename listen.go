@@ -0,0 +1,219 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/binary"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// Reply to getaddr shared by all inbound nodes until it expires, so that
+// inbound nodes do not cause a query each
+type addrResponseCache struct {
+	mu      sync.Mutex
+	msg     Message
+	expires time.Time
+}
+
+var addrResponses = &addrResponseCache{}
+
+// Get the current reply to getaddr, creating a new sample of online nodes if
+// it is older than ADDR_RESPONSE_CACHE_TTL
+func (c *addrResponseCache) Get() (msg Message, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if now.Before(c.expires) {
+		return c.msg, nil
+	}
+
+	db := acquireDBConn()
+	msg, err = makeAddrResponse(db, ADDR_RESPONSE_SIZE)
+	releaseDBConn(db)
+	if err != nil {
+		return
+	}
+
+	c.msg = msg
+	c.expires = now.Add(ADDR_RESPONSE_CACHE_TTL)
+	return
+}
+
+// Accept connections from nodes on the given address, acting as a seed node:
+// nodes connecting are recorded to be crawled, and their getaddr are answered
+// with known online nodes. Calls os.Exit(1) on failure
+func ListenAndServe(addr string) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Print("Accepting node connections on ", addr)
+
+	log.Fatal(serveInbound(l, MAX_INBOUND_CONNECTIONS))
+}
+
+// Handle each connection accepted by l until it fails. Connections beyond
+// max_conns simultaneous ones are closed right away
+func serveInbound(l net.Listener, max_conns int) error {
+	slots := make(chan bool, max_conns)
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+
+		select {
+		case slots <- true:
+			go func() {
+				handleInbound(conn)
+				<-slots
+			}()
+		default:
+			chstatcounter <- Stat{"inbound_rejected", 1}
+			conn.Close()
+		}
+	}
+}
+
+// Complete a handshake as responder with a node connecting to us, then answer
+// its messages until the connection ends or times out. Only the first getaddr
+// is answered
+func handleInbound(conn net.Conn) {
+	defer conn.Close()
+
+	node := Node{Conn: conn}
+	remote := conn.RemoteAddr().String()
+
+	_, err := receiveVersion(node)
+	if err != nil {
+		if verbose {
+			log.Printf("Receiving version (inbound %s): %v", remote, err)
+		}
+		return
+	}
+
+	err = sendVersion(node)
+	if err == nil {
+		err = sendVerack(node)
+	}
+	if err != nil {
+		if verbose {
+			log.Printf("Sending handshake (inbound %s): %v", remote, err)
+		}
+		return
+	}
+	chstatcounter <- Stat{"inbound", 1}
+
+	// The port the node listens on is unknown, assume it is the default one
+	if tcpRemote, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		db := acquireDBConn()
+		err = recordInboundNode(db, tcpRemote.IP.String(), PORT_CURRENT)
+		releaseDBConn(db)
+		if err != nil {
+			log.Print("Could not record inbound node: ", err)
+		}
+	}
+
+	answered_getaddr := false
+	for {
+		msg, err := receiveMessage(node)
+		if err != nil {
+			return
+		}
+
+		switch msg.Type {
+		case "getaddr":
+			if answered_getaddr {
+				break
+			}
+			answered_getaddr = true
+
+			msg, err = addrResponses.Get()
+			if err != nil {
+				log.Print("Could not answer getaddr: ", err)
+				return
+			}
+
+			err = sendMessage(node, msg)
+		case "ping":
+			err = sendMessage(node, Message{Type: "pong", Payload: msg.Payload})
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Add a node which connected to us, so that it is crawled. Known nodes are left
+// unchanged
+func recordInboundNode(db *sql.DB, ip string, port uint16) error {
+	now := time.Now().Unix()
+	_, err := db.Exec(`INSERT OR IGNORE INTO nodes (ip, port, next_refresh, updated_at) 
+		VALUES (?, ?, ?, ?)`, ip, port, now, now)
+	return err
+}
+
+// Create an addr message with a random sample of at most `count` online nodes,
+// and no more than ADDR_RESPONSE_SIZE. Nodes are advertised with the time they
+// were last online and their last known services
+func makeAddrResponse(db *sql.DB, count int) (msg Message, err error) {
+	if count > ADDR_RESPONSE_SIZE {
+		count = ADDR_RESPONSE_SIZE
+	}
+
+	rows, err := db.Query(`SELECT ip, port, CAST(online_at AS INTEGER), services 
+		FROM nodes 
+		WHERE online=1 AND port != 0 
+		ORDER BY RANDOM() 
+		LIMIT ?`, count)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	var (
+		addresses []byte
+		num_addr  int
+
+		ip        string
+		port      uint16
+		online_at int64
+		services  int64
+	)
+
+	for rows.Next() {
+		err = rows.Scan(&ip, &port, &online_at, &services)
+		if err != nil {
+			return
+		}
+
+		parsed := net.ParseIP(ip)
+		if parsed == nil {
+			continue
+		}
+
+		// Layout described above parseNetAddr
+		var na [SIZE_NETADDR_WITH_TIME]byte
+		binary.LittleEndian.PutUint32(na[0:4], uint32(online_at))
+		binary.LittleEndian.PutUint64(na[4:12], uint64(services))
+		copy(na[12:28], parsed.To16())
+		binary.BigEndian.PutUint16(na[28:30], port)
+
+		addresses = append(addresses, na[:]...)
+		num_addr++
+	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+
+	msg.Type = "addr"
+	msg.Payload = append(encodeVarInt(uint64(num_addr)), addresses...)
+
+	return
+}
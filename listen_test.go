@@ -0,0 +1,237 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMakeAddrResponse(t *testing.T) {
+	db := tempDB(t)
+	defer db.Close()
+	drainStats()
+	defer drainStats()
+
+	// Services of node 2 are stored with the high bit set, as a negative int64
+	_, err := db.Exec(`INSERT INTO nodes (id, ip, port, online, online_at, services, updated_at) VALUES
+		(1, '1.1.1.1', 8333, 1, 1600000000, 1033, 0),
+		(2, '2001:db8::1', 8333, 1, 1600000000, ?, 0),
+		(3, '3.3.3.3', 8333, 0, 1500000000, 0, 0), -- offline
+		(4, '4.4.4.4', 0, 1, 1600000000, 0, 0)     -- no port`, int64(-1<<63))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := makeAddrResponse(db, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Type != "addr" {
+		t.Error("Expected addr message got ", msg.Type)
+	}
+
+	addresses, err := parseAddr(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addresses) != 2 {
+		t.Fatal("Expected 2 online nodes got ", addresses)
+	}
+	for _, na := range addresses {
+		var services uint64
+		switch na.IP.String() {
+		case "1.1.1.1":
+			services = 1033
+		case "2001:db8::1":
+			services = 1 << 63
+		default:
+			t.Error("Unexpected address ", na)
+		}
+
+		if na.Port != 8333 || na.Services != services || na.Timestamp.Unix() != 1600000000 {
+			t.Error("Unexpected address ", na)
+		}
+	}
+
+	// TEST: Sample smaller than the online nodes
+	msg, err = makeAddrResponse(db, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addresses, err = parseAddr(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addresses) != 1 {
+		t.Error("Expected 1 address got ", addresses)
+	}
+}
+
+func TestHandleInbound(t *testing.T) {
+	db := tempDB(t)
+	defer db.Close()
+	tempDBPool(db)
+	addrResponses = &addrResponseCache{}
+	drainStats()
+	defer drainStats()
+
+	_, err := db.Exec(`INSERT INTO nodes (ip, port, online, online_at, updated_at) 
+		VALUES ('1.1.1.1', 8333, 1, 1600000000, 0)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go serveInbound(l, MAX_INBOUND_CONNECTIONS)
+
+	// Connect as a node looking for peers
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	node := Node{Conn: conn}
+
+	err = sendVersion(node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	version, err := receiveVersion(node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version.UserAgent != USER_AGENT {
+		t.Error("Unexpected version ", version)
+	}
+	msg, err := receiveMessage(node)
+	if err != nil || msg.Type != "verack" {
+		t.Fatal("Expected verack got ", msg.Type, " ", err)
+	}
+
+	err = sendGetAddr(node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err = receiveMessage(node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addresses, err := parseAddr(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addresses) != 1 || addresses[0].IP.String() != "1.1.1.1" {
+		t.Error("Expected known online node got ", addresses)
+	}
+
+	// TEST: Only the first getaddr is answered
+	err = sendGetAddr(node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = sendMessage(node, Message{Type: "ping", Payload: make([]byte, 8)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err = receiveMessage(node)
+	if err != nil || msg.Type != "pong" {
+		t.Error("Expected pong after second getaddr got ", msg.Type, " ", err)
+	}
+
+	// The connecting node was added to be crawled before the reply
+	var next_refresh int64
+	err = db.QueryRow(`SELECT next_refresh FROM nodes WHERE ip='127.0.0.1' AND port=?`,
+		PORT_CURRENT).Scan(&next_refresh)
+	if err != nil {
+		t.Fatal("Inbound node not recorded: ", err)
+	}
+	if next_refresh > time.Now().Unix() {
+		t.Error("Expected inbound node to be crawled soon got ", time.Unix(next_refresh, 0))
+	}
+}
+
+func TestServeInboundLimit(t *testing.T) {
+	drainStats()
+	defer drainStats()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go serveInbound(l, 1)
+
+	// The first connection waits for a version and holds the only slot
+	first, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+
+	second, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+
+	second.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = second.Read(make([]byte, 1))
+	if err == nil {
+		t.Error("Expected connection beyond the limit to be closed")
+	} else if net_err, ok := err.(net.Error); ok && net_err.Timeout() {
+		t.Error("Expected connection beyond the limit to be closed, timed out")
+	}
+}
+
+func TestAddrResponseCache(t *testing.T) {
+	db := tempDB(t)
+	defer db.Close()
+	tempDBPool(db)
+	drainStats()
+	defer drainStats()
+
+	_, err := db.Exec(`INSERT INTO nodes (ip, port, online, online_at, updated_at) 
+		VALUES ('1.1.1.1', 8333, 1, 1600000000, 0)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cache := &addrResponseCache{}
+	first, err := cache.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Nodes coming online are not sent until the sample expires
+	_, err = db.Exec(`INSERT INTO nodes (ip, port, online, online_at, updated_at) 
+		VALUES ('2.2.2.2', 8333, 1, 1600000000, 0)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cached, err := cache.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(first, cached) {
+		t.Error("Expected cached reply ", first, " got ", cached)
+	}
+
+	cache.expires = time.Now()
+	msg, err := cache.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	addresses, err := parseAddr(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addresses) != 2 {
+		t.Error("Expected new sample of 2 nodes after expiry got ", addresses)
+	}
+}
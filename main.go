@@ -5,28 +5,100 @@ import (
 	"log"
 	"net"
 	"os"
+	"os/signal"
 	"runtime/pprof"
 	"sync"
+	"syscall"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
 )
 
 var flagBootstrap string // Bootstrap from the given host
 var flagConnect string   // Connect only to the given address
+var flagNetwork string   // Name of the network to crawl
+
+var flagAutoBootstrap bool    // Bootstrap from the best known nodes
+var flagWriteBootstrap string // Write the best bootstrap nodes to file and exit
+var flagExportGEXF string     // Write the graph of nodes as GEXF and exit
+var flagBackfillGeo string    // Geolocate nodes from a MaxMind DB and exit
+var flagLoadASNNames string   // Load names of autonomous systems and exit
+var flagRandomSample bool     // Fetch addresses to update in random order
+var flagOnce bool             // Refresh a single batch of nodes and exit
+
+var flagExcludeUserAgent string // Do not crawl nodes with these user agents
+
+var flagPruneEdges time.Duration // Drop relations older than this on startup
+var flagAutoBan int              // Ban nodes with at least this many protocol errors
+var flagCrawlRate int            // Maximum connections attempted per minute
+
+var flagConnectTimeout time.Duration // Timeout for connecting to a node
+var flagMessageTimeout time.Duration // Timeout for receiving a message
+
+var flagNumConnectionGoroutines int // Number of simultaneous connection attempts
+var flagNumUpdateGoroutines int     // Number of nodes refreshed simultaneously
+
+var flagGraphGCInterval time.Duration // Interval between deletions of old relations
+var flagGraphEdgeTTL time.Duration    // Age after which relations are deleted
+
+var flagReportInterval time.Duration // Interval between summary reports
+var flagReportFile string            // Write summary reports to the given file
+
+var flagTag string         // Tag recorded with the crawler session
+var flagHTTP string        // Serve the HTTP API on the given address
+var flagListen string      // Accept connections from nodes on the given address
+var flagMetricsAddr string // Serve Prometheus metrics on the given address
+var flagMessageLog string  // Record all messages to the given file
+var flagReplay string      // Print the messages of a message log and exit
 
 var cpuprofile string  // Profile CPU
 var heapprofile string // Profile Memory
 var memusage string    // Memory usage over time
 var verbose bool       // Verbose logging
 
+var heapprofileInterval time.Duration // Interval between heap profiles
+var memusageInterval time.Duration    // Interval between memory usage writes
+
 var fcpu, fheap, fmem *os.File
 
 func init() {
 	flag.StringVar(&flagBootstrap, "bootstrap", "", "Node to bootstrap from if none are known")
 	flag.StringVar(&flagConnect, "connect", "", "Connect only to the given node")
+	flag.StringVar(&flagNetwork, "network", "main", "Network to crawl: main, testnet, testnet3 or namecoin")
+	flag.BoolVar(&flagAutoBootstrap, "auto-bootstrap", false, "Bootstrap from the best known nodes if -bootstrap is not given")
+	flag.StringVar(&flagWriteBootstrap, "write-bootstrap", "", "Write a list of the best bootstrap nodes to file and exit")
+	flag.StringVar(&flagExportGEXF, "export-gexf", "", "Write the graph of nodes and relations to file as GEXF and exit")
+	flag.StringVar(&flagBackfillGeo, "backfill-geo", "", "Fill in the country and ASN of nodes missing them from the given MaxMind DB file and exit")
+	flag.StringVar(&flagLoadASNNames, "load-asn-names", "", "Load the names of autonomous systems from an ip2asn-combined.tsv file and exit")
+	flag.BoolVar(&flagOnce, "once", false, "Refresh a single batch of nodes and exit")
+	flag.BoolVar(&flagRandomSample, "random-sample", false, "Fetch nodes to update in random order instead of by next refresh")
+	flag.StringVar(&flagExcludeUserAgent, "exclude-user-agent", "", "Comma separated glob patterns of user agents whose peers are not fetched (e.g. '/Bitcoin ABC:*')")
+	flag.DurationVar(&flagPruneEdges, "prune-edges-older-than", 0, "Drop relations between nodes not seen for this long on startup")
+	flag.DurationVar(&flagGraphGCInterval, "graph-gc-interval", GRAPH_GC_INTERVAL, "Interval between deletions of old relations between nodes (0 to disable)")
+	flag.DurationVar(&flagGraphEdgeTTL, "graph-edge-ttl", GRAPH_EDGE_TTL, "Delete relations between nodes not seen for this long")
+	flag.IntVar(&flagCrawlRate, "crawl-rate", 0, "Maximum number of connections attempted per minute (0 for unlimited)")
+	flag.DurationVar(&flagConnectTimeout, "connect-timeout", NODE_CONNECT_TIMEOUT, "Maximum timeout for connecting to a node. Lower timeouts are used for subnets whose nodes answered faster")
+	flag.DurationVar(&flagMessageTimeout, "message-timeout", MESSAGE_TIMEOUT, "Timeout for receiving each message from a node")
+	flag.IntVar(&flagNumConnectionGoroutines, "num-connection-goroutines", NUM_CONNECTION_GOROUTINES, "Number of simultaneous connection attempts")
+	flag.IntVar(&flagNumUpdateGoroutines, "num-update-goroutines", NUM_UPDATE_GOROUTINES, "Number of nodes refreshed simultaneously")
+	flag.IntVar(&flagAutoBan, "auto-ban", 0, "Ban nodes which caused at least this many protocol errors (0 to disable)")
+
+	flag.DurationVar(&flagReportInterval, "report-interval", 0, "Interval between summary reports written to -report-file (0 to disable)")
+	flag.StringVar(&flagReportFile, "report-file", "report.txt", "Write summary reports to file. Previous reports are renamed with a timestamp suffix")
+
+	flag.StringVar(&flagTag, "tag", "", "Tag recorded with this crawler session")
+	flag.StringVar(&flagHTTP, "http", "", "Serve the HTTP API on the given address (e.g. :8080)")
+	flag.StringVar(&flagMetricsAddr, "metrics-addr", "", "Serve counters and memory stats as Prometheus metrics on the given address (e.g. :9090)")
+	flag.StringVar(&flagListen, "listen", "", "Accept connections from nodes on the given address and answer them as a seed node (e.g. :8333)")
+	flag.StringVar(&flagMessageLog, "message-log", "", "Record all messages exchanged with nodes to file")
+	flag.StringVar(&flagReplay, "replay", "", "Print the messages recorded in a message log and exit")
 
 	flag.StringVar(&cpuprofile, "cpuprofile", "", "Write CPU profile to file")
 	flag.StringVar(&heapprofile, "heapprofile", "", "Write heap profile to file")
+	flag.DurationVar(&heapprofileInterval, "heap-profile-interval", time.Second, "Interval between heap profile writes")
 
-	flag.StringVar(&memusage, "memusage", "", "Write memory usage to file on every node refresh")
+	flag.StringVar(&memusage, "memusage", "", "Write memory usage to file periodically, as CSV")
+	flag.DurationVar(&memusageInterval, "memusage-interval", MEMUSAGE_INTERVAL, "Interval between memory usage writes")
 
 	verboseFlag := flag.Bool("v", false, "Verbose output")
 
@@ -43,6 +115,33 @@ func init() {
 
 func main() {
 	var err error
+
+	err = setNetwork(flagNetwork)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if flagConnectTimeout <= 0 {
+		log.Fatal("-connect-timeout must be positive")
+	}
+	if flagMessageTimeout <= 0 {
+		log.Fatal("-message-timeout must be positive")
+	}
+	if flagNumConnectionGoroutines < 1 || flagNumConnectionGoroutines > MAX_GOROUTINES {
+		log.Fatal("-num-connection-goroutines must be between 1 and ", MAX_GOROUTINES)
+	}
+	if flagNumUpdateGoroutines < 1 || flagNumUpdateGoroutines > MAX_GOROUTINES {
+		log.Fatal("-num-update-goroutines must be between 1 and ", MAX_GOROUTINES)
+	}
+
+	if flagReplay != "" {
+		err = replayMessageLog(flagReplay, os.Stdout)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	if cpuprofile != "" {
 		fcpu, err = os.Create(cpuprofile)
 		if err != nil {
@@ -59,7 +158,7 @@ func main() {
 		if err != nil {
 			log.Fatal(err)
 		}
-		go UpdateHeapProfile()
+		go UpdateHeapProfile(fheap, heapprofileInterval, nil)
 
 		defer fheap.Close()
 		defer pprof.WriteHeapProfile(fheap)
@@ -73,16 +172,148 @@ func main() {
 		defer fmem.Close()
 	}
 
+	if flagMessageLog != "" {
+		messageLogger, err = NewMessageLogger(flagMessageLog)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer messageLogger.Close()
+	}
+
 	err = initDB()
 	if err != nil {
 		log.Fatal(err)
 	}
+	defer cleanDB()
+
+	db := acquireDBConn()
+	err = loadSubnetLatency(db)
+	releaseDBConn(db)
+	if err != nil {
+		log.Print("Could not load subnet latencies: ", err)
+	}
+
+	if flagPruneEdges > 0 {
+		db := acquireDBConn()
+		count, err := DropEdgesOlderThan(db, time.Now().Add(-flagPruneEdges))
+		releaseDBConn(db)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		log.Print("Dropped ", count, " relations older than ", flagPruneEdges)
+	}
+
+	if flagWriteBootstrap != "" {
+		db := acquireDBConn()
+		err = writeBootstrapList(db, flagWriteBootstrap, BOOTSTRAP_LIST_SIZE)
+		releaseDBConn(db)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		log.Print("Bootstrap list written to ", flagWriteBootstrap)
+		return
+	}
+
+	if flagBackfillGeo != "" {
+		mmdb, err := maxminddb.Open(flagBackfillGeo)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer mmdb.Close()
+
+		db := acquireDBConn()
+		count, err := BackfillGeolocation(db, mmdb)
+		releaseDBConn(db)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		log.Print("Geolocated ", count, " nodes")
+		return
+	}
+
+	if flagLoadASNNames != "" {
+		f, err := os.Open(flagLoadASNNames)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+
+		db := acquireDBConn()
+		count, err := LoadASNNames(db, f)
+		releaseDBConn(db)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		log.Print("Loaded names of ", count, " autonomous systems")
+		return
+	}
+
+	if flagExportGEXF != "" {
+		db := acquireDBConn()
+		err = writeGEXF(db, flagExportGEXF)
+		releaseDBConn(db)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		log.Print("Graph written to ", flagExportGEXF)
+		return
+	}
+
+	db = acquireDBConn()
+	session_id, err := startCrawlSession(db, flagTag, networkName(NETWORK_CURRENT), crawlConfig())
+	releaseDBConn(db)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer func() {
+		db := acquireDBConn()
+		defer releaseDBConn(db)
+
+		err := endCrawlSession(db, session_id)
+		if err != nil {
+			log.Print("Could not record end of crawler session: ", err)
+		}
+
+		err = saveSubnetLatency(db)
+		if err != nil {
+			log.Print("Could not save subnet latencies: ", err)
+		}
+	}()
+
+	if flagHTTP != "" {
+		go serveAPI(flagHTTP)
+	}
+
+	if flagMetricsAddr != "" {
+		go serveMetrics(flagMetricsAddr)
+	}
 
-	addresses := make(chan ip_port, 2*ADDRESSES_NUM)
+	if flagListen != "" {
+		go ListenAndServe(flagListen)
+	}
+
+	addresses := NewAddressManager()
 	nodes := make(chan Node, NODE_BUFFER_SIZE)
 	save := make(chan Node, NODE_BUFFER_SIZE)
 	wg := &sync.WaitGroup{}
 
+	// Stop fetching addresses on SIGINT/SIGTERM and let the nodes already
+	// queued be refreshed and saved. A second signal exits immediately
+	stop := make(chan bool)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		s := <-signals
+		signal.Stop(signals)
+		log.Print("Received ", s, ", stopping after the queued nodes are saved")
+		close(stop)
+	}()
+
 	if flagConnect != "" {
 		ip, port, err := net.SplitHostPort(flagConnect)
 		if err != nil {
@@ -94,12 +325,12 @@ func main() {
 		}
 
 		log.Print("Connecting to ", flagConnect)
-		addresses <- ip_port{ip, port}
+		addresses.Push(ip_port{ip, port}, PRIORITY_BOOTSTRAP)
 
-		close(addresses)
+		addresses.Close()
 	} else {
 		wg.Add(1)
-		go getNodes(addresses, wg)
+		go getNodes(addresses, stop, wg)
 	}
 	wg.Add(3)
 	go connectNodes(addresses, nodes, wg)
@@ -108,8 +339,24 @@ func main() {
 
 	go stats(60, true)
 
+	if flagReportInterval > 0 {
+		go UpdateReport(flagReportFile, flagReportInterval, nil)
+	}
+
+	if flagGraphGCInterval > 0 {
+		go graphGC(flagGraphGCInterval, flagGraphEdgeTTL, nil)
+	}
+
 	// Wait for all three main goroutines to end
 	wg.Wait()
+}
+
+// Configuration of the crawler, as the value of each flag
+func crawlConfig() map[string]string {
+	config := make(map[string]string)
+	flag.VisitAll(func(f *flag.Flag) {
+		config[f.Name] = f.Value.String()
+	})
 
-	cleanDB()
+	return config
 }
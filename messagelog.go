@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Directions of logged messages
+const (
+	DIRECTION_RECV = "recv"
+	DIRECTION_SEND = "send"
+)
+
+// Records messages exchanged with nodes to a file. Each entry has the format
+//
+//	timestamp   0.. 7    int64    UNIX time in nanoseconds
+//	direction   8..11    [4]byte  recv or send
+//	command    12..23    [12]byte command of the message
+//	addr_len   24..24    uint8    length of the node address
+//	addr       25..??    string   address of the node (ip:port)
+//	length   ??+1..??+4  uint32   size of payload
+//	payload  ??+5..      []byte
+type MessageLogger struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+// Logger used by sendMessage and receiveMessage. Messages are not logged if
+// nil
+var messageLogger *MessageLogger
+
+// Create a logger writing to the given file
+func NewMessageLogger(filename string) (l *MessageLogger, err error) {
+	f, err := os.Create(filename)
+	if err != nil {
+		return
+	}
+
+	return &MessageLogger{f: f}, nil
+}
+
+// Record a message exchanged with the node at nodeAddr
+func (l *MessageLogger) Log(nodeAddr string, msg Message, direction string) {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	_, err := l.f.Write(encodeLogEntry(time.Now(), nodeAddr, msg, direction))
+	if err != nil {
+		log.Print("Message log: ", err)
+	}
+}
+
+// Close the underlying file
+func (l *MessageLogger) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.f.Close()
+}
+
+// Encode a single log entry
+func encodeLogEntry(t time.Time, nodeAddr string, msg Message, direction string) []byte {
+	if len(nodeAddr) > 0xff {
+		nodeAddr = nodeAddr[:0xff]
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, 29+len(nodeAddr)+len(msg.Payload)))
+
+	var header [25]byte
+	binary.LittleEndian.PutUint64(header[0:8], uint64(t.UnixNano()))
+	copy(header[8:12], direction)
+	copy(header[12:24], msg.Type)
+	header[24] = byte(len(nodeAddr))
+	buf.Write(header[:])
+
+	buf.WriteString(nodeAddr)
+
+	var length [4]byte
+	binary.LittleEndian.PutUint32(length[:], uint32(len(msg.Payload)))
+	buf.Write(length[:])
+
+	buf.Write(msg.Payload)
+
+	return buf.Bytes()
+}
+
+// A message read from a message log
+type LogEntry struct {
+	Time      time.Time
+	Direction string
+	NodeAddr  string
+	Message   Message
+}
+
+// Read the entries of a log written by MessageLogger. The first entry is read
+// before returning so that invalid logs are detected. The channel is closed
+// at the end of the log or on the first error.
+func ReadMessageLog(r io.Reader) (<-chan LogEntry, error) {
+	first, err := readLogEntry(r)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	entries := make(chan LogEntry)
+	go func() {
+		defer close(entries)
+
+		if err == io.EOF {
+			return
+		}
+		entries <- first
+
+		for {
+			entry, err := readLogEntry(r)
+			if err != nil {
+				if err != io.EOF {
+					log.Print("Message log: ", err)
+				}
+				return
+			}
+			entries <- entry
+		}
+	}()
+
+	return entries, nil
+}
+
+// Read a single log entry. Returns io.EOF if the log ended before the entry
+func readLogEntry(r io.Reader) (entry LogEntry, err error) {
+	var header [25]byte
+	_, err = io.ReadFull(r, header[:])
+	if err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = fmt.Errorf("readLogEntry: Truncated entry")
+		}
+		return
+	}
+
+	entry.Time = time.Unix(0, int64(binary.LittleEndian.Uint64(header[0:8])))
+	entry.Direction = string(bytes.TrimRight(header[8:12], string(byte(0))))
+	entry.Message.Type = string(bytes.TrimRight(header[12:24], string(byte(0))))
+
+	data := make([]byte, int(header[24])+4)
+	_, err = io.ReadFull(r, data)
+	if err != nil {
+		err = fmt.Errorf("readLogEntry: Truncated entry")
+		return
+	}
+	entry.NodeAddr = string(data[:header[24]])
+
+	length := binary.LittleEndian.Uint32(data[header[24]:])
+	if length > MAX_PAYLOAD {
+		err = fmt.Errorf("readLogEntry: Payload too big %d", length)
+		return
+	}
+
+	entry.Message.Payload = make([]byte, length)
+	_, err = io.ReadFull(r, entry.Message.Payload)
+	if err != nil {
+		err = fmt.Errorf("readLogEntry: Truncated entry")
+		return
+	}
+
+	return
+}
+
+// Print the messages of the given log, decoding those which can be parsed
+func replayMessageLog(filename string, w io.Writer) (err error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	entries, err := ReadMessageLog(f)
+	if err != nil {
+		return
+	}
+
+	for entry := range entries {
+		fmt.Fprintf(w, "%s %s %s %s (%d bytes)\n",
+			entry.Time.Format("2006/01/02 15:04:05.000000"), entry.Direction,
+			entry.NodeAddr, entry.Message.Type, len(entry.Message.Payload))
+
+		switch entry.Message.Type {
+		case "version":
+			ver, err := parseVersion(entry.Message)
+			if err != nil {
+				fmt.Fprintf(w, "\t%v\n", err)
+				continue
+			}
+			fmt.Fprintf(w, "\t%+v\n", ver)
+		case "addr":
+			addresses, err := parseAddr(entry.Message)
+			if err != nil {
+				fmt.Fprintf(w, "\t%v\n", err)
+				continue
+			}
+			for _, addr := range addresses {
+				fmt.Fprintf(w, "\t%v\n", addr)
+			}
+		}
+	}
+
+	return
+}
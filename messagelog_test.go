@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEncodeLogEntry(t *testing.T) {
+	msg := Message{Type: "verack", Payload: []byte{1, 2, 3}}
+	entry := encodeLogEntry(time.Unix(0, 42), "1.2.3.4:8333", msg, DIRECTION_RECV)
+
+	if ts := binary.LittleEndian.Uint64(entry[0:8]); ts != 42 {
+		t.Error("Timestamp expected 42 got ", ts)
+	}
+	if dir := string(entry[8:12]); dir != DIRECTION_RECV {
+		t.Error("Direction expected ", DIRECTION_RECV, " got ", dir)
+	}
+	if cmd := string(bytes.TrimRight(entry[12:24], string(byte(0)))); cmd != "verack" {
+		t.Error("Command expected verack got ", cmd)
+	}
+	if l := int(entry[24]); l != len("1.2.3.4:8333") {
+		t.Fatal("Address length expected ", len("1.2.3.4:8333"), " got ", l)
+	}
+	if addr := string(entry[25:37]); addr != "1.2.3.4:8333" {
+		t.Error("Address expected 1.2.3.4:8333 got ", addr)
+	}
+	if l := binary.LittleEndian.Uint32(entry[37:41]); l != 3 {
+		t.Error("Payload length expected 3 got ", l)
+	}
+	if !bytes.Equal(entry[41:], msg.Payload) {
+		t.Error("Payload expected ", msg.Payload, " got ", entry[41:])
+	}
+}
+
+func TestMessageLogRoundTrip(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "messages.log")
+	l, err := NewMessageLogger(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logged := []LogEntry{
+		LogEntry{Direction: DIRECTION_SEND, NodeAddr: "1.2.3.4:8333",
+			Message: Message{Type: "getaddr", Payload: []byte{}}},
+		LogEntry{Direction: DIRECTION_RECV, NodeAddr: "[::1]:8333",
+			Message: Message{Type: "addr", Payload: []byte{0}}},
+		LogEntry{Direction: DIRECTION_RECV, NodeAddr: "1.2.3.4:8333",
+			Message: Message{Type: "version", Payload: versionPayload(70001, "/test:1.0/", 5, nil)}},
+	}
+	before := time.Now()
+	for _, e := range logged {
+		l.Log(e.NodeAddr, e.Message, e.Direction)
+	}
+	l.Close()
+
+	f, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	entries, err := ReadMessageLog(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	i := 0
+	for entry := range entries {
+		if i >= len(logged) {
+			t.Fatal("Too many entries, got ", entry)
+		}
+		if entry.Time.Before(before) {
+			t.Error("Entry time ", entry.Time, " before ", before)
+		}
+
+		entry.Time = time.Time{}
+		if !reflect.DeepEqual(logged[i], entry) {
+			t.Error("Entry expected ", logged[i], " got ", entry)
+		}
+		i++
+	}
+	if i != len(logged) {
+		t.Error("Expected ", len(logged), " entries got ", i)
+	}
+
+	// TEST: Replay decodes the messages
+	w := &bytes.Buffer{}
+	err = replayMessageLog(filename, w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(w.String(), "UserAgent:/test:1.0/") {
+		t.Error("Replay did not decode version message: ", w.String())
+	}
+}
+
+func TestReadMessageLogTruncated(t *testing.T) {
+	entry := encodeLogEntry(time.Now(), "1.2.3.4:8333",
+		Message{Type: "ping", Payload: []byte{1, 2, 3, 4}}, DIRECTION_RECV)
+
+	_, err := ReadMessageLog(bytes.NewReader(entry[:len(entry)-1]))
+	if err == nil {
+		t.Error("Truncated log should fail")
+	}
+
+	// TEST: Empty log
+	entries, err := ReadMessageLog(bytes.NewReader(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := <-entries; ok {
+		t.Error("Empty log should have no entries")
+	}
+}
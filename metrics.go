@@ -0,0 +1,108 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// Prefix of the names of all exported metrics
+const METRICS_PREFIX = "btccrawler_"
+
+func init() {
+	expvar.Publish("counters", expvar.Func(func() interface{} {
+		return StatSnapshot()
+	}))
+}
+
+// Serve the counters and memory stats on the given address: /metrics in the
+// Prometheus text format and /debug/vars as expvar JSON. Calls os.Exit(1) on
+// failure
+func serveMetrics(addr string) {
+	log.Print("Serving metrics on ", addr)
+
+	log.Fatal(http.ListenAndServe(addr, metricsHandler()))
+}
+
+// Create the handler for the metrics endpoints
+func metricsHandler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/metrics", handleMetrics)
+	mux.Handle("/debug/vars", expvar.Handler())
+
+	return mux
+}
+
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	m := runtime.MemStats{}
+	runtime.ReadMemStats(&m)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeMetrics(w, StatSnapshot(), &m)
+}
+
+// Write the counters and cumulative memory stats as Prometheus counters and
+// the other memory stats as gauges, in the Prometheus text exposition format
+func writeMetrics(w io.Writer, counters map[string]int, m *runtime.MemStats) {
+	names := make([]string, 0, len(counters))
+	for name := range counters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		writeMetric(w, metricName(name)+"_total", "counter", counters[name])
+	}
+
+	totals := []struct {
+		name  string
+		value uint64
+	}{
+		{"memstats_mallocs_total", m.Mallocs},
+		{"memstats_frees_total", m.Frees},
+		{"memstats_num_gc_total", uint64(m.NumGC)},
+	}
+	for _, c := range totals {
+		writeMetric(w, METRICS_PREFIX+c.name, "counter", c.value)
+	}
+
+	gauges := []struct {
+		name  string
+		value uint64
+	}{
+		{"memstats_alloc_bytes", m.Alloc},
+		{"memstats_sys_bytes", m.Sys},
+		{"memstats_heap_alloc_bytes", m.HeapAlloc},
+		{"memstats_heap_sys_bytes", m.HeapSys},
+		{"memstats_heap_idle_bytes", m.HeapIdle},
+		{"memstats_heap_inuse_bytes", m.HeapInuse},
+		{"memstats_heap_released_bytes", m.HeapReleased},
+		{"memstats_heap_objects", m.HeapObjects},
+		{"memstats_stack_sys_bytes", m.StackSys},
+		{"memstats_next_gc_bytes", m.NextGC},
+	}
+	for _, g := range gauges {
+		writeMetric(w, METRICS_PREFIX+g.name, "gauge", g.value)
+	}
+}
+
+func writeMetric(w io.Writer, name, kind string, value interface{}) {
+	fmt.Fprintf(w, "# TYPE %s %s\n%s %v\n", name, kind, name, value)
+}
+
+// Name of the metric for the given counter. Characters not allowed in
+// Prometheus metric names are replaced with underscores
+func metricName(counter string) string {
+	return METRICS_PREFIX + strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' {
+			return r
+		}
+		return '_'
+	}, counter)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetricName(t *testing.T) {
+	cases := map[string]string{
+		"refr":                 "btccrawler_refr",
+		"msg_addr":             "btccrawler_msg_addr",
+		"timer_refresh_1-10ms": "btccrawler_timer_refresh_1_10ms",
+	}
+
+	for counter, expected := range cases {
+		if name := metricName(counter); name != expected {
+			t.Error("Expected ", expected, " for ", counter, " got ", name)
+		}
+	}
+}
+
+func TestHandleMetrics(t *testing.T) {
+	resetCounters()
+	defer resetCounters()
+
+	ch := make(chan Stat, 2)
+	done := make(chan bool)
+	go func() {
+		accumulateStats(ch)
+		done <- true
+	}()
+	ch <- Stat{"refr", 3}
+	ch <- Stat{"timer_refresh_lt1ms", 2}
+	close(ch)
+	<-done
+
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	w := httptest.NewRecorder()
+	metricsHandler().ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatal("Expected 200 got ", w.Code)
+	}
+
+	body := w.Body.String()
+	for _, line := range []string{
+		"# TYPE btccrawler_refr_total counter\n",
+		"btccrawler_refr_total 3\n",
+		"btccrawler_timer_refresh_lt1ms_total 2\n",
+		"# TYPE btccrawler_memstats_heap_alloc_bytes gauge\n",
+		"# TYPE btccrawler_memstats_mallocs_total counter\n",
+		"# TYPE btccrawler_memstats_frees_total counter\n",
+		"# TYPE btccrawler_memstats_num_gc_total counter\n",
+	} {
+		if !strings.Contains(body, line) {
+			t.Errorf("Missing %q in metrics:\n%s", line, body)
+		}
+	}
+	for _, name := range []string{"mallocs", "frees", "num_gc"} {
+		if strings.Contains(body, "btccrawler_memstats_"+name+" gauge") {
+			t.Error("Expected cumulative ", name, " not to be a gauge")
+		}
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/debug/vars", nil)
+	w = httptest.NewRecorder()
+	metricsHandler().ServeHTTP(w, req)
+
+	var vars struct {
+		Counters map[string]int `json:"counters"`
+	}
+	err := json.Unmarshal(w.Body.Bytes(), &vars)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vars.Counters["refr"] != 3 {
+		t.Error("Expected refr 3 in expvar counters got ", vars.Counters)
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
 	"log"
@@ -21,7 +22,8 @@ type MsgVersion struct {
 	UserAgent   string  //
 	StartHeight int32   // Last known block
 
-	Relay bool // Whether the remote peer should relay transactions
+	Relay    bool // Whether the remote peer should relay transactions
+	HasRelay bool // Whether the relay field was included in the message
 }
 
 // Service flags
@@ -88,6 +90,7 @@ func parseVersion(msg Message) (ver MsgVersion, err error) {
 	}
 
 	ver.StartHeight = int32(binary.LittleEndian.Uint32(data[:4]))
+	ver.HasRelay = len(data) == 5
 
 	if ver.Protocol >= VERSION_BIP_0037 {
 		if len(data) == 5 {
@@ -115,6 +118,7 @@ func parseVersion(msg Message) (ver MsgVersion, err error) {
 //   user_agent     80..??    varstr
 //   start_height ??+1..??+4  int32
 //   relay        ??+5..??+5  bool (version > VERSION_BIP_0037)
+// Addresses are left empty on connections which are not TCP (e.g. net.Pipe)
 func makeVersion(node Node) (msg Message) {
 	if len(USER_AGENT) >= 0xfd {
 		log.Fatal("Cannot create version message: USER_AGENT too long")
@@ -128,23 +132,19 @@ func makeVersion(node Node) (msg Message) {
 
 	// addr_recv
 	addr_recv := msg.Payload[20:46]
-	tcpRemote, ok := node.Conn.RemoteAddr().(*net.TCPAddr)
-	if !ok {
-		log.Fatal("Not a TCP connection")
+	binary.LittleEndian.PutUint64(addr_recv[0:8], 1) // services
+	if tcpRemote, ok := node.Conn.RemoteAddr().(*net.TCPAddr); ok {
+		copy(addr_recv[8:24], []byte(tcpRemote.IP))                          // ip
+		binary.BigEndian.PutUint16(addr_recv[24:26], uint16(tcpRemote.Port)) //port
 	}
-	binary.LittleEndian.PutUint64(addr_recv[0:8], 1)                     // services
-	copy(addr_recv[8:24], []byte(tcpRemote.IP))                          // ip
-	binary.BigEndian.PutUint16(addr_recv[24:26], uint16(tcpRemote.Port)) //port
 
 	//addr_send
 	addr_send := msg.Payload[46:72]
-	tcpLocal, ok := node.Conn.LocalAddr().(*net.TCPAddr)
-	if !ok {
-		log.Fatal("Not a TCP connection")
-	}
 	binary.LittleEndian.PutUint64(addr_send[0:8], 0) // services
-	copy(addr_send[8:24], []byte(tcpLocal.IP))       // ip
-	binary.BigEndian.PutUint16(addr_send[24:26], 0)  //port
+	if tcpLocal, ok := node.Conn.LocalAddr().(*net.TCPAddr); ok {
+		copy(addr_send[8:24], []byte(tcpLocal.IP)) // ip
+	}
+	binary.BigEndian.PutUint16(addr_send[24:26], 0) //port
 
 	// nonce
 	// Secure randomness not needed
@@ -161,7 +161,8 @@ func makeVersion(node Node) (msg Message) {
 }
 
 // Parse an addr message. The format is a var_int with the number of addresses
-// followed by the list net_addr.
+// followed by the list net_addr. Duplicate addresses are dropped, keeping the
+// first one.
 // Assumes protocol version > VERSION_TIME_IN_NETADDR
 func parseAddr(msg Message) (addresses []NetAddr, err error) {
 	length, n, err := varInt(msg.Payload)
@@ -176,21 +177,47 @@ func parseAddr(msg Message) (addresses []NetAddr, err error) {
 
 	var num_addr = int(length)
 
-	addresses = make([]NetAddr, num_addr)
+	addresses = make([]NetAddr, 0, num_addr)
+	seen := make(map[string]bool, num_addr)
 
 	for i := 0; i < num_addr; i++ {
 		start := n + i*SIZE_NETADDR_WITH_TIME
 		end := n + (i+1)*SIZE_NETADDR_WITH_TIME
-		addresses[i], err = parseNetAddr(msg.Payload[start:end], true)
+		na, err := parseNetAddr(msg.Payload[start:end], true)
 
 		if err != nil {
-			return
+			return addresses, err
+		}
+
+		key := CanonicalNetAddr(na)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		addresses = append(addresses, na)
+	}
+
+	// Don't block if nothing reads the stats, e.g. when replaying a log
+	if dropped := num_addr - len(addresses); dropped > 0 {
+		select {
+		case chstatcounter <- Stat{"addr_dedup", dropped}:
+		default:
 		}
 	}
 
 	return
 }
 
+// Number of entries announced by an addr message, including duplicates. 0 if
+// the message is invalid
+func addrMessageCount(msg Message) int {
+	length, _, err := varInt(msg.Payload)
+	if err != nil {
+		return 0
+	}
+	return int(length)
+}
+
 // Parse a network address from the given slice. The slice is assumed to
 // contain only the net_addr and fails otherwise
 // Time indicates whether the NA contains the time or not
@@ -221,3 +248,54 @@ func parseNetAddr(data []byte, time_field bool) (na NetAddr, err error) {
 func (na NetAddr) String() string {
 	return fmt.Sprintf("<NetAddr: <%v>:%v  %v  %v>", na.IP, na.Port, na.Services, na.Timestamp)
 }
+
+// Parse a headers message and return the number of headers it contains. The
+// format is a var_int with the number of headers followed by the headers,
+// each being
+//   version       0.. 3  int32
+//   prev_block    4..35  [32]byte
+//   merkle_root  36..67  [32]byte
+//   timestamp    68..71  uint32
+//   bits         72..75  uint32
+//   nonce        76..79  uint32
+//   txn_count    80..80  var_int, always 0
+func parseHeadersMessage(msg Message) (count int, err error) {
+	length, n, err := varInt(msg.Payload)
+	if err != nil {
+		return
+	}
+
+	if length > MAX_HEADERS {
+		err = fmt.Errorf("parseHeaders: Too many headers (%d)", length)
+		return
+	}
+
+	count = int(length)
+	expected := n + count*(SIZE_HEADER+1)
+	if len(msg.Payload) != expected {
+		err = fmt.Errorf("parseHeaders: Payload size mismatch (%d, expected %d) for %d headers",
+			len(msg.Payload), expected, count)
+		return 0, err
+	}
+
+	for i := 0; i < count; i++ {
+		txn_count := msg.Payload[n+i*(SIZE_HEADER+1)+SIZE_HEADER]
+		if txn_count != 0 {
+			err = fmt.Errorf("parseHeaders: Header %d has transactions (%d)", i, txn_count)
+			return 0, err
+		}
+	}
+
+	return
+}
+
+// Whether the first header of a valid headers message follows the genesis
+// block, in which case the number of headers is the height of the last one
+func headersFromGenesis(msg Message) bool {
+	_, n, err := varInt(msg.Payload)
+	if err != nil || len(msg.Payload) < n+SIZE_HEADER {
+		return false
+	}
+
+	return bytes.Equal(msg.Payload[n+4:n+36], GENESIS_CURRENT)
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+// Build a version payload with the given protocol and user agent, followed by
+// start_height and `tail`
+func versionPayload(protocol uint32, ua string, start_height int32, tail []byte) []byte {
+	payload := make([]byte, 80, 80+1+len(ua)+4+len(tail))
+	binary.LittleEndian.PutUint32(payload[0:4], protocol)
+
+	payload = append(payload, byte(len(ua)))
+	payload = append(payload, ua...)
+
+	var height [4]byte
+	binary.LittleEndian.PutUint32(height[:], uint32(start_height))
+	payload = append(payload, height[:]...)
+
+	return append(payload, tail...)
+}
+
+// Build an addr payload with the given addresses, all at the same time
+func addrPayload(addresses ...NetAddr) []byte {
+	payload := encodeVarInt(uint64(len(addresses)))
+	for _, na := range addresses {
+		entry := make([]byte, SIZE_NETADDR_WITH_TIME)
+		binary.LittleEndian.PutUint32(entry[0:4], 1600000000)
+		binary.LittleEndian.PutUint64(entry[4:12], na.Services)
+		copy(entry[12:28], na.IP.To16())
+		binary.BigEndian.PutUint16(entry[28:30], na.Port)
+
+		payload = append(payload, entry...)
+	}
+
+	return payload
+}
+
+func TestParseAddrDeduplicates(t *testing.T) {
+	drainStats()
+	defer drainStats()
+
+	a := NetAddr{IP: net.ParseIP("1.2.3.4"), Port: 8333}
+	b := NetAddr{IP: net.ParseIP("1.2.3.4"), Port: 8334}
+	c := NetAddr{IP: net.ParseIP("2001:db8::1"), Port: 8333}
+	msg := Message{Type: "addr", Payload: addrPayload(a, b, a, c, b)}
+
+	addresses, err := parseAddr(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addresses) != 3 {
+		t.Fatal("Expected 3 addresses got ", len(addresses))
+	}
+	for i, expected := range []NetAddr{a, b, c} {
+		if !addresses[i].IP.Equal(expected.IP) || addresses[i].Port != expected.Port {
+			t.Error("Address ", i, " expected ", expected, " got ", addresses[i])
+		}
+	}
+	if count := addrMessageCount(msg); count != 5 {
+		t.Error("Expected 5 entries in the message got ", count)
+	}
+
+	select {
+	case s := <-chstatcounter:
+		if s.name != "addr_dedup" || s.value != 2 {
+			t.Error("Expected 2 dropped duplicates got ", s)
+		}
+	default:
+		t.Error("Expected addr_dedup stat")
+	}
+
+	// TEST: Nothing reads the stats
+	for len(chstatcounter) < cap(chstatcounter) {
+		chstatcounter <- Stat{"fill", 1}
+	}
+
+	done := make(chan bool)
+	go func() {
+		parseAddr(msg)
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("parseAddr blocked on the stats")
+	}
+}
+
+func TestParseVersionRelay(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		protocol uint32
+		tail     []byte
+		relay    bool
+		hasRelay bool
+	}{
+		{"not present", VERSION_BIP_0037, []byte{}, false, false},
+		{"present and set", VERSION_BIP_0037, []byte{1}, true, true},
+		{"present and not set", VERSION_BIP_0037, []byte{0}, false, true},
+		{"longer than expected", VERSION_BIP_0037, []byte{1, 0, 0}, false, false},
+		{"before BIP 0037", VERSION_BIP_0037 - 1, []byte{1}, false, true},
+	} {
+		msg := Message{
+			Type:    "version",
+			Payload: versionPayload(c.protocol, "/test:1.0/", 1234, c.tail),
+		}
+
+		ver, err := parseVersion(msg)
+		if err != nil {
+			t.Error(c.name, ": unexpected error ", err)
+			continue
+		}
+		if ver.Relay != c.relay {
+			t.Error(c.name, ": relay expected ", c.relay, " got ", ver.Relay)
+		}
+		if ver.HasRelay != c.hasRelay {
+			t.Error(c.name, ": relay field presence expected ", c.hasRelay, " got ", ver.HasRelay)
+		}
+		if ver.StartHeight != 1234 {
+			t.Error(c.name, ": start_height expected 1234 got ", ver.StartHeight)
+		}
+	}
+}
+
+// Place a distinct sentinel value in each field of a version payload and check
+// that each one ends up in the corresponding field of MsgVersion
+func TestParseVersionFieldOffsets(t *testing.T) {
+	payload := make([]byte, 80)
+	binary.LittleEndian.PutUint32(payload[0:4], 0xDEADBEEF)           // protocol
+	binary.LittleEndian.PutUint64(payload[4:12], 0x0102030405060708)  // services
+	binary.LittleEndian.PutUint64(payload[12:20], 0x11223344)         // timestamp
+	binary.LittleEndian.PutUint64(payload[20:28], 0x2122232425262728) // addr_recv services
+	copy(payload[28:44], net.ParseIP("10.20.30.40"))                  // addr_recv ip
+	binary.BigEndian.PutUint16(payload[44:46], 0x3132)                // addr_recv port
+	binary.LittleEndian.PutUint64(payload[46:54], 0x4142434445464748) // addr_send services
+	copy(payload[54:70], net.ParseIP("50.60.70.80"))                  // addr_send ip
+	binary.BigEndian.PutUint16(payload[70:72], 0x5152)                // addr_send port
+	binary.LittleEndian.PutUint64(payload[72:80], 0xCAFEBABEF00DFACE) // nonce
+
+	payload = append(payload, 6)                            // user_agent length
+	payload = append(payload, "/UA:1/"...)                  // user_agent
+	payload = append(payload, 0x78, 0x56, 0x34, 0x12, 0x01) // start_height, relay
+
+	ver, err := parseVersion(Message{Type: "version", Payload: payload})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		field         string
+		got, expected interface{}
+	}{
+		{"Protocol", ver.Protocol, uint32(0xDEADBEEF)},
+		{"Services", ver.Services, ServiceFlag(0x0102030405060708)},
+		{"Timestamp", ver.Timestamp.Unix(), int64(0x11223344)},
+		{"AddrLocal.Services", ver.AddrLocal.Services, uint64(0x2122232425262728)},
+		{"AddrLocal.IP", ver.AddrLocal.IP.String(), "10.20.30.40"},
+		{"AddrLocal.Port", ver.AddrLocal.Port, uint16(0x3132)},
+		{"AddrRemote.Services", ver.AddrRemote.Services, uint64(0x4142434445464748)},
+		{"AddrRemote.IP", ver.AddrRemote.IP.String(), "50.60.70.80"},
+		{"AddrRemote.Port", ver.AddrRemote.Port, uint16(0x5152)},
+		{"Nonce", ver.Nonce, uint64(0xCAFEBABEF00DFACE)},
+		{"UserAgent", ver.UserAgent, "/UA:1/"},
+		{"StartHeight", ver.StartHeight, int32(0x12345678)},
+		{"Relay", ver.Relay, true},
+	} {
+		if c.got != c.expected {
+			t.Errorf("%s expected %#v got %#v", c.field, c.expected, c.got)
+		}
+	}
+}
+
+// Build a headers payload with count headers, the first one following prev
+func headersPayload(count int, prev []byte) []byte {
+	payload := []byte{0xfd, byte(count), byte(count >> 8)}
+	for i := 0; i < count; i++ {
+		header := make([]byte, SIZE_HEADER+1) // txn_count is 0
+		binary.LittleEndian.PutUint32(header[0:4], 1)
+		if i == 0 {
+			copy(header[4:36], prev)
+		} else {
+			header[4] = byte(i) // Not an actual hash
+		}
+
+		payload = append(payload, header...)
+	}
+
+	return payload
+}
+
+func TestParseHeadersMessage(t *testing.T) {
+	other := make([]byte, 32)
+	other[0] = 1
+
+	with_txns := headersPayload(2, GENESIS_CURRENT)
+	with_txns[len(with_txns)-1] = 1
+
+	for _, c := range []struct {
+		name    string
+		payload []byte
+		count   int
+		genesis bool
+		fail    bool
+	}{
+		{"1 header from genesis", headersPayload(1, GENESIS_CURRENT), 1, true, false},
+		{"10 headers from genesis", headersPayload(10, GENESIS_CURRENT), 10, true, false},
+		{"2000 headers", headersPayload(2000, other), 2000, false, false},
+		{"too many headers", headersPayload(2001, other), 0, false, true},
+		{"truncated", headersPayload(2, other)[:100], 0, false, true},
+		{"trailing data", append(headersPayload(2, other), 0), 0, false, true},
+		{"header with transactions", with_txns, 0, true, true},
+		{"empty", []byte{0}, 0, false, false},
+	} {
+		msg := Message{Type: "headers", Payload: c.payload}
+
+		count, err := parseHeadersMessage(msg)
+		if (err != nil) != c.fail {
+			t.Error(c.name, ": expected failure ", c.fail, " got ", err)
+		}
+		if count != c.count {
+			t.Error(c.name, ": expected ", c.count, " headers got ", count)
+		}
+		if headersFromGenesis(msg) != c.genesis {
+			t.Error(c.name, ": expected from genesis ", c.genesis)
+		}
+	}
+
+	// TEST: Size mismatches report both lengths
+	for _, c := range []struct {
+		payload  []byte
+		expected string
+	}{
+		{headersPayload(2, other)[:100], "parseHeaders: Payload size mismatch (100, expected 165) for 2 headers"},
+		{append(headersPayload(2, other), 0), "parseHeaders: Payload size mismatch (166, expected 165) for 2 headers"},
+	} {
+		_, err := parseHeadersMessage(Message{Type: "headers", Payload: c.payload})
+		if err == nil || err.Error() != c.expected {
+			t.Errorf("Expected %q got %v", c.expected, err)
+		}
+	}
+}
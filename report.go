@@ -0,0 +1,160 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Write a text summary of the crawled network: node counts, most common user
+// agents and protocol versions
+func writeReport(w io.Writer, db *sql.DB, t time.Time) (err error) {
+	stats, err := GetNetworkStats(db)
+	if err != nil {
+		return
+	}
+	userAgents, err := GetUserAgentDistribution(db)
+	if err != nil {
+		return
+	}
+	protocols, err := GetProtocolDistribution(db)
+	if err != nil {
+		return
+	}
+
+	online := 0.0
+	if stats.TotalNodes > 0 {
+		online = 100 * float64(stats.OnlineNodes) / float64(stats.TotalNodes)
+	}
+
+	fmt.Fprintf(w, "Report %s\n\n", t.Format("2006/01/02 15:04:05"))
+
+	fmt.Fprintf(w, "Network\n")
+	fmt.Fprintf(w, "  Known nodes:   %d\n", stats.TotalNodes)
+	fmt.Fprintf(w, "  Online nodes:  %d (%.1f%%)\n", stats.OnlineNodes, online)
+	fmt.Fprintf(w, "  Crawled nodes: %d\n", stats.SuccessNodes)
+	fmt.Fprintf(w, "  IPv4/IPv6:     %d/%d\n", stats.IPv4Nodes, stats.IPv6Nodes)
+	fmt.Fprintf(w, "  Relations:     %d\n\n", stats.TotalEdges)
+
+	// Most common first, by name on ties
+	agents := make([]string, 0, len(userAgents))
+	for ua := range userAgents {
+		agents = append(agents, ua)
+	}
+	sort.Slice(agents, func(i, j int) bool {
+		if userAgents[agents[i]] != userAgents[agents[j]] {
+			return userAgents[agents[i]] > userAgents[agents[j]]
+		}
+		return agents[i] < agents[j]
+	})
+	if len(agents) > REPORT_TOP_USER_AGENTS {
+		agents = agents[:REPORT_TOP_USER_AGENTS]
+	}
+
+	fmt.Fprintf(w, "Top user agents\n")
+	for _, ua := range agents {
+		fmt.Fprintf(w, "  %-30s %d\n", ua, userAgents[ua])
+	}
+	fmt.Fprintf(w, "\n")
+
+	// Newest version first
+	versions := make([]int, 0, len(protocols))
+	for p := range protocols {
+		versions = append(versions, p)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(versions)))
+
+	fmt.Fprintf(w, "Protocol versions\n")
+	for _, p := range versions {
+		fmt.Fprintf(w, "  %-30d %d\n", p, protocols[p])
+	}
+
+	return
+}
+
+// Format of the suffix appended to the name of previous reports
+const REPORT_ROTATE_FORMAT = "20060102-150405"
+
+// Write a report to `filename`. An existing report is first renamed by
+// appending the time it was written to its name, and only the
+// REPORT_KEEP_ROTATED most recent previous reports are kept
+func writeReportFile(db *sql.DB, filename string, t time.Time) (err error) {
+	if info, err := os.Stat(filename); err == nil {
+		suffix := info.ModTime().In(t.Location()).Format(REPORT_ROTATE_FORMAT)
+		err = os.Rename(filename, filename+"."+suffix)
+		if err != nil {
+			return err
+		}
+
+		err = pruneReports(filename, REPORT_KEEP_ROTATED)
+		if err != nil {
+			return err
+		}
+	}
+
+	f, err := os.Create(filename)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	return writeReport(f, db, t)
+}
+
+// Remove previous reports of `filename` beyond the `keep` most recent ones
+func pruneReports(filename string, keep int) error {
+	matches, err := filepath.Glob(filename + ".*")
+	if err != nil {
+		return err
+	}
+
+	// Only files named by writeReportFile, oldest first
+	rotated := make([]string, 0, len(matches))
+	for _, name := range matches {
+		suffix := strings.TrimPrefix(name, filename+".")
+		if _, err := time.Parse(REPORT_ROTATE_FORMAT, suffix); err == nil {
+			rotated = append(rotated, name)
+		}
+	}
+	sort.Strings(rotated)
+
+	for len(rotated) > keep {
+		err = os.Remove(rotated[0])
+		if err != nil {
+			return err
+		}
+		rotated = rotated[1:]
+	}
+
+	return nil
+}
+
+// Periodically write a report to `filename` every `interval` until `stop` is
+// closed
+func UpdateReport(filename string, interval time.Duration, stop <-chan bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case t := <-ticker.C:
+			db := acquireDBConn()
+			err := writeReportFile(db, filename, t)
+			releaseDBConn(db)
+			if err != nil {
+				log.Print("Could not write report: ", err)
+				continue
+			}
+
+			chstatcounter <- Stat{"report_writes", 1}
+		case <-stop:
+			return
+		}
+	}
+}
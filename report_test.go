@@ -0,0 +1,115 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteReportFile(t *testing.T) {
+	db := tempDB(t)
+	defer db.Close()
+
+	_, err := db.Exec(`INSERT INTO nodes (ip, port, user_agent, protocol, online, success, updated_at) VALUES
+		('1.1.1.1', 1, '/Satoshi:25.0.0/', 70016, 1, 1, 0),
+		('2.2.2.2', 2, '/Satoshi:25.1.0/', 70016, 1, 1, 0),
+		('3.3.3.3', 3, '/Satoshi:24.0.1/', 70015, 1, 1, 0),
+		('4.4.4.4', 4, '', 0, 0, 0, 0)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	filename := filepath.Join(t.TempDir(), "report.txt")
+	first := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	err = writeReportFile(db, filename, first)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := string(content)
+
+	for _, expected := range []string{
+		"Report 2020/01/02 03:04:05",
+		"Network\n",
+		"Known nodes:   4\n",
+		"Online nodes:  3 (75.0%)\n",
+		"Top user agents\n",
+		"/Satoshi:25/",
+		"Protocol versions\n",
+		"70016",
+	} {
+		if !strings.Contains(report, expected) {
+			t.Errorf("Expected report to contain %q got\n%s", expected, report)
+		}
+	}
+	if strings.Index(report, "/Satoshi:25/") > strings.Index(report, "/Satoshi:24/") {
+		t.Error("Expected user agents by decreasing count got\n", report)
+	}
+
+	// The previous report is kept with the time it was written
+	err = os.Chtimes(filename, first, first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = writeReportFile(db, filename, first.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rotated, err := os.ReadFile(filename + ".20200102-030405")
+	if err != nil {
+		t.Fatal("Expected previous report to be rotated: ", err)
+	}
+	if string(rotated) != report {
+		t.Error("Expected rotated report to be unchanged")
+	}
+}
+
+func TestPruneReports(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "report.txt")
+
+	for _, name := range []string{
+		"report.txt",
+		"report.txt.20200101-000000",
+		"report.txt.20200102-000000",
+		"report.txt.20200103-000000",
+		"report.txt.bak",
+	} {
+		err := os.WriteFile(filepath.Join(dir, name), nil, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := pruneReports(filename, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+
+	expected := []string{
+		"report.txt",
+		"report.txt.20200102-000000",
+		"report.txt.20200103-000000",
+		"report.txt.bak",
+	}
+	if strings.Join(names, " ") != strings.Join(expected, " ") {
+		t.Error("Expected ", expected, " got ", names)
+	}
+}
@@ -0,0 +1,998 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Address of a node as returned by the API
+type apiAddress struct {
+	IP   string `json:"ip"`
+	Port string `json:"port"`
+}
+
+// Serve the HTTP API on the given address. Calls os.Exit(1) on failure
+func serveAPI(addr string) {
+	log.Print("Serving HTTP API on ", addr)
+
+	log.Fatal(http.ListenAndServe(addr, apiHandler()))
+}
+
+// Create the handler for all API endpoints
+func apiHandler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/api/node/schedule", handleNodeSchedule)
+	mux.HandleFunc("/api/churned-nodes", handleChurnedNodes)
+	mux.HandleFunc("/api/relay-distribution", handleRelayDistribution)
+	mux.HandleFunc("/api/node/service-history", handleServiceHistory)
+	mux.HandleFunc("/api/node/success-rate", handleSuccessRate)
+	mux.HandleFunc("/api/node/degree", handleNodeDegree)
+	mux.HandleFunc("/api/node/uptime", handleNodeUptime)
+	mux.HandleFunc("/api/subgraph", handleSubgraph)
+	mux.HandleFunc("/api/common-parents", handleCommonParents)
+	mux.HandleFunc("/api/nodes", handleNodes)
+	mux.HandleFunc("/api/health", handleHealth)
+	mux.HandleFunc("/health/live", handleHealthLive)
+	mux.HandleFunc("/health/ready", handleHealthReady)
+	mux.HandleFunc("/api/stats", handleStats)
+	mux.HandleFunc("/api/stats/reset", handleStatsReset)
+	mux.HandleFunc("/api/stats/reset/all", handleStatsResetAll)
+	mux.HandleFunc("/api/message-types", handleMessageTypes)
+	mux.HandleFunc("/api/address-freshness", handleAddressFreshness)
+	mux.HandleFunc("/api/node-age-distribution", handleNodeAgeDistribution)
+	mux.HandleFunc("/api/crawl-sessions", handleCrawlSessions)
+	mux.HandleFunc("/api/ping", handlePing)
+	mux.HandleFunc("/api/misbehaving-nodes", handleMisbehavingNodes)
+	mux.HandleFunc("/api/popular-nodes", handlePopularNodes)
+	mux.HandleFunc("/api/nodes-by-port", handleNodesByPort)
+	mux.HandleFunc("/api/abnormal-ports", handleAbnormalPorts)
+	mux.HandleFunc("/api/duplicate-ips", handleDuplicateIPs)
+	mux.HandleFunc("/api/port-distribution", handlePortDistribution)
+	mux.HandleFunc("/api/protocol-curve", handleProtocolCurve)
+	mux.HandleFunc("/api/protocol-timeline", handleProtocolTimeline)
+	mux.HandleFunc("/api/growth-rate", handleGrowthRate)
+	mux.HandleFunc("/api/top-agents-by-uptime", handleTopAgentsByUptime)
+	mux.HandleFunc("/api/top-asns", handleTopASNs)
+	mux.HandleFunc("/api/nat-nodes", handleNATNodes)
+	mux.HandleFunc("/api/bans", handleBans)
+	mux.HandleFunc("/api/client-distribution", handleClientDistribution)
+
+	return mux
+}
+
+// Write v as the JSON body of the response
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil && verbose {
+		log.Print("Writing API response: ", err)
+	}
+}
+
+// Write the list of addresses as the JSON body of the response
+func writeAddresses(w http.ResponseWriter, addresses []ip_port) {
+	res := make([]apiAddress, len(addresses))
+	for i, addr := range addresses {
+		res[i] = apiAddress{IP: addr.ip, Port: addr.port}
+	}
+
+	writeJSON(w, res)
+}
+
+// Get a duration from the query string, using def if it is absent
+func durationParam(r *http.Request, name string, def time.Duration) (time.Duration, error) {
+	val := r.URL.Query().Get(name)
+	if val == "" {
+		return def, nil
+	}
+
+	return parseDuration(val)
+}
+
+// Get an integer from the query string, using def if it is absent
+func intParam(r *http.Request, name string, def int) (int, error) {
+	val := r.URL.Query().Get(name)
+	if val == "" {
+		return def, nil
+	}
+
+	return strconv.Atoi(val)
+}
+
+// Get the ip and port parameters identifying a node from the query string.
+// Writes an error response and returns ok=false if they are missing
+func nodeParams(w http.ResponseWriter, r *http.Request) (ip, port string, ok bool) {
+	ip = r.URL.Query().Get("ip")
+	port = r.URL.Query().Get("port")
+	if ip == "" || port == "" {
+		http.Error(w, "ip and port must be specified", http.StatusBadRequest)
+		return "", "", false
+	}
+
+	return ip, port, true
+}
+
+// POST /api/node/schedule
+// Set the next refresh time of a node. Expects a JSON body of the form
+//
+//	{"ip": "1.2.3.4", "port": "8333", "next_refresh": 0}
+func handleNodeSchedule(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		IP          string `json:"ip"`
+		Port        string `json:"port"`
+		NextRefresh int64  `json:"next_refresh"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || req.IP == "" || req.Port == "" {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	db := acquireDBConn()
+	defer releaseDBConn(db)
+
+	err = UpdateNextRefresh(db, req.IP, req.Port, req.NextRefresh)
+	switch {
+	case err == ErrNodeNotFound:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	default:
+		writeJSON(w, req)
+	}
+}
+
+// GET /api/churned-nodes?older_than=7d
+// Nodes which were once online but have been offline for at least older_than
+func handleChurnedNodes(w http.ResponseWriter, r *http.Request) {
+	olderThan, err := durationParam(r, "older_than", 7*24*time.Hour)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	db := acquireDBConn()
+	defer releaseDBConn(db)
+
+	addresses, err := GetOfflineNodesOnceOnline(db, olderThan)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeAddresses(w, addresses)
+}
+
+// GET /api/relay-distribution
+// Number of nodes which relay transactions and which do not
+func handleRelayDistribution(w http.ResponseWriter, r *http.Request) {
+	db := acquireDBConn()
+	defer releaseDBConn(db)
+
+	on, off, err := GetRelayFlagDistribution(db)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, map[string]int{"on": on, "off": off})
+}
+
+// GET /api/node/service-history?ip=&port=
+// Successive sets of services advertised by a node
+func handleServiceHistory(w http.ResponseWriter, r *http.Request) {
+	ip, port, ok := nodeParams(w, r)
+	if !ok {
+		return
+	}
+
+	db := acquireDBConn()
+	defer releaseDBConn(db)
+
+	history, err := GetServiceHistory(db, ip, port)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, history)
+}
+
+// GET /api/nodes?ua_pattern=Satoshi%25
+// GET /api/nodes?asn=15169
+// Nodes matching the given filter. ua_pattern is an SQL LIKE pattern. asn
+// returns the nodes of an autonomous system which completed a handshake
+func handleNodes(w http.ResponseWriter, r *http.Request) {
+	var filter func(*sql.DB) ([]ip_port, error)
+
+	query := r.URL.Query()
+	switch {
+	case query.Get("ua_pattern") != "":
+		filter = FilterByUserAgent(query.Get("ua_pattern"))
+	case query.Get("asn") != "":
+		asn, err := strconv.Atoi(query.Get("asn"))
+		if err != nil {
+			http.Error(w, "Invalid asn", http.StatusBadRequest)
+			return
+		}
+		filter = FilterByASN(asn)
+	default:
+		http.Error(w, "A filter must be specified", http.StatusBadRequest)
+		return
+	}
+
+	db := acquireDBConn()
+	defer releaseDBConn(db)
+
+	addresses, err := filter(db)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeAddresses(w, addresses)
+}
+
+// A node with the number of peers it advertised
+type apiDegreeNode struct {
+	apiAddress
+	Degree int `json:"degree"`
+}
+
+// GET /api/stats
+// Crawler counters and summary of the crawled network
+func handleStats(w http.ResponseWriter, r *http.Request) {
+	db := acquireDBConn()
+	defer releaseDBConn(db)
+
+	network, err := GetNetworkStats(db)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	average, err := GetAverageAddressesPerNode(db)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// null if no node advertised any peer
+	var max_degree *apiDegreeNode
+	ip, port, degree, err := GetMaxDegreeNode(db)
+	if err == nil {
+		max_degree = &apiDegreeNode{apiAddress{ip, port}, degree}
+	} else if err != sql.ErrNoRows {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	partitions, err := GraphPartitionCount(db)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	online, err := GetNetworkOnlinePercent(db, time.Now().Add(-NETWORK_ONLINE_WINDOW))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	churn, err := GetNodeChurn(db, CHURN_WINDOW)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, struct {
+		Counters         map[string]int `json:"counters"`
+		Network          NetworkStats   `json:"network"`
+		AverageAddresses float64        `json:"average_addresses_per_node"`
+		MaxDegreeNode    *apiDegreeNode `json:"max_degree_node"`
+		PartitionCount   int            `json:"partition_count"`
+		OnlinePercent    float64        `json:"online_percent"`
+		ChurnRate        float64        `json:"churn_rate"`
+	}{
+		Counters:         StatSnapshot(),
+		Network:          network,
+		AverageAddresses: average,
+		MaxDegreeNode:    max_degree,
+		PartitionCount:   partitions,
+		OnlinePercent:    online,
+		ChurnRate:        churn,
+	})
+}
+
+// POST /api/stats/reset?name=
+// Set the counter with the given name back to 0
+func handleStatsReset(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	err := ResetStat(r.FormValue("name"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, StatSnapshot())
+}
+
+// POST /api/stats/reset/all
+// Set all counters back to 0
+func handleStatsResetAll(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ResetAllStats()
+
+	writeJSON(w, StatSnapshot())
+}
+
+// GET /api/message-types
+// Number of received messages by type
+func handleMessageTypes(w http.ResponseWriter, r *http.Request) {
+	msg_types, err := GetP2PMessageTypeStats()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, msg_types)
+}
+
+// GET /api/address-freshness
+// Number of advertised addresses by age of their timestamp
+func handleAddressFreshness(w http.ResponseWriter, r *http.Request) {
+	db := acquireDBConn()
+	defer releaseDBConn(db)
+
+	distribution, err := GetAddressTimestampDistribution(db, ADDRESS_FRESHNESS_BUCKETS)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, distribution)
+}
+
+// GET /api/node-age-distribution?ages=365d,30d,7d
+// Number of nodes by when they were first seen. Groups are delimited by the
+// given ages, from oldest to most recent
+func handleNodeAgeDistribution(w http.ResponseWriter, r *http.Request) {
+	ages := NODE_AGE_BUCKETS
+	if val := r.URL.Query().Get("ages"); val != "" {
+		ages = nil
+		for _, s := range strings.Split(val, ",") {
+			age, err := parseDuration(s)
+			if err != nil {
+				http.Error(w, "Invalid ages", http.StatusBadRequest)
+				return
+			}
+			ages = append(ages, age)
+		}
+	}
+
+	now := time.Now()
+	buckets := make([]time.Time, len(ages))
+	for i, age := range ages {
+		buckets[i] = now.Add(-age)
+		if i > 0 && !buckets[i].After(buckets[i-1]) {
+			http.Error(w, "Ages must be decreasing", http.StatusBadRequest)
+			return
+		}
+	}
+
+	db := acquireDBConn()
+	defer releaseDBConn(db)
+
+	distribution, err := GetNetworkAgeDistribution(db, buckets)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, distribution)
+}
+
+// GET /api/node/success-rate?ip=&port=
+// Fraction of the refreshes of a node which completed a handshake
+func handleSuccessRate(w http.ResponseWriter, r *http.Request) {
+	ip, port, ok := nodeParams(w, r)
+	if !ok {
+		return
+	}
+
+	db := acquireDBConn()
+	defer releaseDBConn(db)
+
+	rate, err := GetSuccessRate(db, ip, port)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, map[string]float64{"success_rate": rate})
+}
+
+// GET /api/node/uptime?ip=&port=&since=7d
+// Percentage of the refreshes of a node during the last `since` during which it
+// was online
+func handleNodeUptime(w http.ResponseWriter, r *http.Request) {
+	ip, port, ok := nodeParams(w, r)
+	if !ok {
+		return
+	}
+
+	since, err := durationParam(r, "since", 7*24*time.Hour)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	db := acquireDBConn()
+	defer releaseDBConn(db)
+
+	percent, err := GetNodeUptimePercent(db, ip, port, time.Now().Add(-since))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, map[string]float64{"uptime_percent": percent})
+}
+
+// GET /api/node/degree?ip=&port=
+// Number of peers advertised by a node, number of nodes advertising it and
+// fraction of all known nodes it advertised
+func handleNodeDegree(w http.ResponseWriter, r *http.Request) {
+	ip, port, ok := nodeParams(w, r)
+	if !ok {
+		return
+	}
+
+	db := acquireDBConn()
+	defer releaseDBConn(db)
+
+	out, in, err := GetEdgeCount(db, ip, port)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	coverage, err := PeerAdvertisementCoverage(db, ip, port)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, struct {
+		OutDegree int     `json:"out_degree"`
+		InDegree  int     `json:"in_degree"`
+		Coverage  float64 `json:"coverage"`
+	}{out, in, coverage})
+}
+
+// GET /api/subgraph?ip=&port=&depth=2
+// Nodes reachable from a node in at most depth hops and the relations between
+// them. Edges are pairs of indexes in nodes
+func handleSubgraph(w http.ResponseWriter, r *http.Request) {
+	ip, port, ok := nodeParams(w, r)
+	if !ok {
+		return
+	}
+
+	depth, err := intParam(r, "depth", 2)
+	if err != nil || depth < 0 {
+		http.Error(w, "Invalid depth", http.StatusBadRequest)
+		return
+	}
+
+	db := acquireDBConn()
+	defer releaseDBConn(db)
+
+	graph, err := SubgraphBFS(db, ip, port, depth)
+	switch {
+	case err == ErrNodeNotFound:
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	nodes := make([]apiAddress, len(graph.Nodes))
+	for i, addr := range graph.Nodes {
+		nodes[i] = apiAddress{addr.ip, addr.port}
+	}
+	edges := graph.Edges
+	if edges == nil {
+		edges = [][2]int{}
+	}
+
+	writeJSON(w, struct {
+		Nodes []apiAddress `json:"nodes"`
+		Edges [][2]int     `json:"edges"`
+	}{nodes, edges})
+}
+
+// GET /api/common-parents?ip1=&port1=&ip2=&port2=
+// Nodes which advertise both of the given nodes
+func handleCommonParents(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	ip1, port1 := q.Get("ip1"), q.Get("port1")
+	ip2, port2 := q.Get("ip2"), q.Get("port2")
+	if ip1 == "" || port1 == "" || ip2 == "" || port2 == "" {
+		http.Error(w, "ip1, port1, ip2 and port2 must be specified", http.StatusBadRequest)
+		return
+	}
+
+	db := acquireDBConn()
+	defer releaseDBConn(db)
+
+	parents, err := GetCommonParents(db, ip1, port1, ip2, port2)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeAddresses(w, parents)
+}
+
+// GET /api/crawl-sessions
+// Runs of the crawler, most recent first
+func handleCrawlSessions(w http.ResponseWriter, r *http.Request) {
+	db := acquireDBConn()
+	defer releaseDBConn(db)
+
+	sessions, err := GetCrawlSessions(db)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, sessions)
+}
+
+// GET /api/ping?ip=&port=
+// Connect to a node and complete a handshake, without affecting the crawl
+func handlePing(w http.ResponseWriter, r *http.Request) {
+	ip, port, ok := nodeParams(w, r)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), PING_TIMEOUT)
+	defer cancel()
+
+	latency, version, err := Ping(ctx, ip, port)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	writeJSON(w, struct {
+		LatencyMs   int64  `json:"latency_ms"`
+		Protocol    uint32 `json:"protocol"`
+		Services    uint64 `json:"services"`
+		UserAgent   string `json:"user_agent"`
+		StartHeight int32  `json:"start_height"`
+		Relay       bool   `json:"relay"`
+	}{
+		LatencyMs:   int64(latency / time.Millisecond),
+		Protocol:    version.Protocol,
+		Services:    uint64(version.Services),
+		UserAgent:   version.UserAgent,
+		StartHeight: version.StartHeight,
+		Relay:       version.Relay,
+	})
+}
+
+// GET /api/misbehaving-nodes?min_errors=10
+// Nodes which caused at least min_errors protocol errors
+func handleMisbehavingNodes(w http.ResponseWriter, r *http.Request) {
+	minErrors, err := intParam(r, "min_errors", MISBEHAVING_MIN_ERRORS)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	db := acquireDBConn()
+	defer releaseDBConn(db)
+
+	addresses, err := DetectMisbehavingNodes(db, minErrors)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeAddresses(w, addresses)
+}
+
+// /api/bans
+//
+//	GET    Nodes currently banned
+//	POST   Ban a node. Expects a JSON body of the form
+//	       {"ip": "1.2.3.4", "port": "8333", "reason": "spam", "duration": "7d"}
+//	DELETE ?ip=&port= Lift the ban of a node
+func handleBans(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		handleGetBans(w, r)
+	case "POST":
+		handleBanNode(w, r)
+	case "DELETE":
+		handleUnbanNode(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func handleGetBans(w http.ResponseWriter, r *http.Request) {
+	db := acquireDBConn()
+	defer releaseDBConn(db)
+
+	banned, err := GetBannedNodes(db)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, banned)
+}
+
+func handleBanNode(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		IP       string `json:"ip"`
+		Port     string `json:"port"`
+		Reason   string `json:"reason"`
+		Duration string `json:"duration"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || req.IP == "" || req.Port == "" || req.Duration == "" {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	duration, err := parseDuration(req.Duration)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	db := acquireDBConn()
+	defer releaseDBConn(db)
+
+	err = BanNode(db, req.IP, req.Port, req.Reason, duration)
+	switch {
+	case err == ErrNodeNotFound:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	default:
+		writeJSON(w, req)
+	}
+}
+
+func handleUnbanNode(w http.ResponseWriter, r *http.Request) {
+	ip, port, ok := nodeParams(w, r)
+	if !ok {
+		return
+	}
+
+	db := acquireDBConn()
+	defer releaseDBConn(db)
+
+	err := UnbanNode(db, ip, port)
+	switch {
+	case err == ErrNodeNotFound:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	default:
+		writeJSON(w, apiAddress{ip, port})
+	}
+}
+
+// GET /api/client-distribution
+// Number of nodes with each client fingerprint
+func handleClientDistribution(w http.ResponseWriter, r *http.Request) {
+	db := acquireDBConn()
+	defer releaseDBConn(db)
+
+	distribution, err := GetClientDistribution(db)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, distribution)
+}
+
+// GET /api/popular-nodes?min_seen_by=10
+// Nodes advertised by at least min_seen_by other nodes
+func handlePopularNodes(w http.ResponseWriter, r *http.Request) {
+	minCount, err := intParam(r, "min_seen_by", POPULAR_MIN_SEEN_BY)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	db := acquireDBConn()
+	defer releaseDBConn(db)
+
+	addresses, err := GetNodesSeenByCount(db, minCount)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeAddresses(w, addresses)
+}
+
+// GET /api/nodes-by-port?port=8333
+// Nodes listening on the given port which completed a handshake
+func handleNodesByPort(w http.ResponseWriter, r *http.Request) {
+	port, err := strconv.ParseUint(r.URL.Query().Get("port"), 10, 16)
+	if err != nil {
+		http.Error(w, "Invalid port", http.StatusBadRequest)
+		return
+	}
+
+	db := acquireDBConn()
+	defer releaseDBConn(db)
+
+	addresses, err := GetNodesWithOpenPort(db, uint16(port))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeAddresses(w, addresses)
+}
+
+// GET /api/abnormal-ports?port=8333
+// Nodes which completed a handshake on a port other than the standard one.
+// The port defaults to the one of the network in use
+func handleAbnormalPorts(w http.ResponseWriter, r *http.Request) {
+	port := uint64(PORT_CURRENT)
+	if val := r.URL.Query().Get("port"); val != "" {
+		var err error
+		port, err = strconv.ParseUint(val, 10, 16)
+		if err != nil {
+			http.Error(w, "Invalid port", http.StatusBadRequest)
+			return
+		}
+	}
+
+	db := acquireDBConn()
+	defer releaseDBConn(db)
+
+	addresses, err := GetNodesWithAbnormalPorts(db, uint16(port))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeAddresses(w, addresses)
+}
+
+// GET /api/duplicate-ips
+// IPs of which several ports are known, with their ports
+func handleDuplicateIPs(w http.ResponseWriter, r *http.Request) {
+	db := acquireDBConn()
+	defer releaseDBConn(db)
+
+	duplicates, err := GetDuplicateIPs(db)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, duplicates)
+}
+
+// GET /api/port-distribution
+// Number of nodes which completed a handshake, by port
+func handlePortDistribution(w http.ResponseWriter, r *http.Request) {
+	db := acquireDBConn()
+	defer releaseDBConn(db)
+
+	distribution, err := PortDistribution(db)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, distribution)
+}
+
+// GET /api/protocol-curve?bucket_days=7
+// Average protocol version of online nodes over time
+func handleProtocolCurve(w http.ResponseWriter, r *http.Request) {
+	bucketDays, err := intParam(r, "bucket_days", 7)
+	if err != nil || bucketDays < 1 {
+		http.Error(w, "Invalid bucket_days", http.StatusBadRequest)
+		return
+	}
+
+	db := acquireDBConn()
+	defer releaseDBConn(db)
+
+	curve, err := GetProtocolUpgradeCurve(db, bucketDays)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, curve)
+}
+
+// GET /api/protocol-timeline?bucket_hours=24
+// Median and 90th percentile protocol version of online nodes over time
+func handleProtocolTimeline(w http.ResponseWriter, r *http.Request) {
+	bucketHours, err := intParam(r, "bucket_hours", 24)
+	if err != nil || bucketHours < 1 {
+		http.Error(w, "Invalid bucket_hours", http.StatusBadRequest)
+		return
+	}
+
+	db := acquireDBConn()
+	defer releaseDBConn(db)
+
+	timeline, err := GetProtocolVersionTimeline(db, bucketHours)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, timeline)
+}
+
+// GET /api/growth-rate?window=7d
+// Number of reachable nodes discovered per day over the last window
+func handleGrowthRate(w http.ResponseWriter, r *http.Request) {
+	window, err := durationParam(r, "window", 7*24*time.Hour)
+	if err != nil || window <= 0 {
+		http.Error(w, "Invalid window", http.StatusBadRequest)
+		return
+	}
+
+	db := acquireDBConn()
+	defer releaseDBConn(db)
+
+	rate, err := GetGrowthRate(db, window)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, map[string]float64{"nodes_per_day": rate})
+}
+
+// GET /api/health
+// Activity of the crawler. It is stalled if no node was updated recently
+func handleHealth(w http.ResponseWriter, r *http.Request) {
+	db := acquireDBConn()
+	defer releaseDBConn(db)
+
+	updated, err := GetNodesUpdatedInLastN(db, STALL_WINDOW)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, struct {
+		UpdatedNodes int    `json:"updated_nodes"`
+		Window       string `json:"window"`
+		Stalled      bool   `json:"stalled"`
+	}{updated, STALL_WINDOW.String(), updated == 0})
+}
+
+// GET /health/live
+// Liveness probe, always succeeds while the process serves requests
+func handleHealthLive(w http.ResponseWriter, r *http.Request) {
+	io.WriteString(w, "OK\n")
+}
+
+// GET /health/ready
+// Readiness probe. Fails if no DB connection is available or if the crawler
+// is stalled
+func handleHealthReady(w http.ResponseWriter, r *http.Request) {
+	var db *sql.DB
+	select {
+	case db = <-dbConnectionPool:
+		defer releaseDBConn(db)
+	default:
+		http.Error(w, "No DB connection available", http.StatusServiceUnavailable)
+		return
+	}
+
+	updated, err := GetNodesUpdatedInLastN(db, STALL_WINDOW)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if updated == 0 {
+		http.Error(w, "No node updated in the last "+STALL_WINDOW.String(), http.StatusServiceUnavailable)
+		return
+	}
+
+	io.WriteString(w, "OK\n")
+}
+
+// GET /api/top-agents-by-uptime?limit=10
+// User agents whose nodes are online the most often
+func handleTopAgentsByUptime(w http.ResponseWriter, r *http.Request) {
+	limit, err := intParam(r, "limit", 10)
+	if err != nil || limit < 1 {
+		http.Error(w, "Invalid limit", http.StatusBadRequest)
+		return
+	}
+
+	db := acquireDBConn()
+	defer releaseDBConn(db)
+
+	top, err := GetTopUserAgentsByUptime(db, limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, top)
+}
+
+// GET /api/top-asns?limit=10
+// Autonomous systems with the most reachable nodes
+func handleTopASNs(w http.ResponseWriter, r *http.Request) {
+	limit, err := intParam(r, "limit", 10)
+	if err != nil || limit < 1 {
+		http.Error(w, "Invalid limit", http.StatusBadRequest)
+		return
+	}
+
+	db := acquireDBConn()
+	defer releaseDBConn(db)
+
+	top, err := GetASNTopList(db, limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, top)
+}
+
+// GET /api/nat-nodes
+// Number of nodes with a private address
+func handleNATNodes(w http.ResponseWriter, r *http.Request) {
+	db := acquireDBConn()
+	defer releaseDBConn(db)
+
+	count, err := DetectNATedNodes(db)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, map[string]int{"nat_nodes": count})
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandleNodeSchedule(t *testing.T) {
+	db := tempDB(t)
+	defer db.Close()
+	tempDBPool(db)
+
+	_, err := db.Exec(`INSERT INTO nodes (ip, port, next_refresh, updated_at) 
+		VALUES ('1.1.1.1', 1, 500, 0)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		method string
+		body   string
+		status int
+	}{
+		{"POST", `{"ip":"1.1.1.1","port":"1","next_refresh":0}`, http.StatusOK},
+		{"POST", `{"ip":"2.2.2.2","port":"2","next_refresh":0}`, http.StatusNotFound},
+		{"POST", `{"ip":"1.1.1.1"}`, http.StatusBadRequest},
+		{"GET", ``, http.StatusMethodNotAllowed},
+	} {
+		req := httptest.NewRequest(c.method, "/api/node/schedule", strings.NewReader(c.body))
+		w := httptest.NewRecorder()
+		apiHandler().ServeHTTP(w, req)
+
+		if w.Code != c.status {
+			t.Error(c.method, " ", c.body, " expected status ", c.status, " got ", w.Code)
+		}
+	}
+
+	var next_refresh int64
+	err = db.QueryRow("SELECT next_refresh FROM nodes WHERE ip='1.1.1.1'").Scan(&next_refresh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next_refresh != 0 {
+		t.Error("Expected next_refresh 0 got ", next_refresh)
+	}
+}
+
+func TestHandleBans(t *testing.T) {
+	db := tempDB(t)
+	defer db.Close()
+	tempDBPool(db)
+
+	tempGraph(t, db, 1, nil)
+
+	for _, c := range []struct {
+		method string
+		url    string
+		body   string
+		status int
+	}{
+		{"POST", "/api/bans", `{"ip":"1.1.1.1","port":"1","reason":"spam","duration":"1d"}`, http.StatusOK},
+		{"POST", "/api/bans", `{"ip":"2.2.2.2","port":"2","duration":"1d"}`, http.StatusNotFound},
+		{"POST", "/api/bans", `{"ip":"1.1.1.1","port":"1","duration":"soon"}`, http.StatusBadRequest},
+		{"GET", "/api/bans", ``, http.StatusOK},
+		{"DELETE", "/api/bans?ip=1.1.1.1&port=1", ``, http.StatusOK},
+		{"DELETE", "/api/bans?ip=1.1.1.1&port=1", ``, http.StatusNotFound},
+		{"PUT", "/api/bans", ``, http.StatusMethodNotAllowed},
+	} {
+		req := httptest.NewRequest(c.method, c.url, strings.NewReader(c.body))
+		w := httptest.NewRecorder()
+		apiHandler().ServeHTTP(w, req)
+
+		if w.Code != c.status {
+			t.Error(c.method, " ", c.url, " ", c.body, " expected status ", c.status, " got ", w.Code)
+		}
+	}
+}
+
+func TestHealthEndpoints(t *testing.T) {
+	db := tempDB(t)
+	defer db.Close()
+	tempDBPool(db)
+
+	server := httptest.NewServer(apiHandler())
+	defer server.Close()
+
+	status := func(path string) int {
+		res, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	// TEST: No node updated recently
+	if code := status("/health/live"); code != http.StatusOK {
+		t.Error("Expected live status 200 got ", code)
+	}
+	if code := status("/health/ready"); code != http.StatusServiceUnavailable {
+		t.Error("Expected ready status 503 without updates got ", code)
+	}
+
+	// TEST: Crawler is updating nodes
+	_, err := db.Exec("INSERT INTO nodes (ip, port, updated_at) VALUES ('1.1.1.1', 1, ?)",
+		time.Now().Unix())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := status("/health/ready"); code != http.StatusOK {
+		t.Error("Expected ready status 200 got ", code)
+	}
+
+	// TEST: All DB connections are in use
+	conn := acquireDBConn()
+	if code := status("/health/ready"); code != http.StatusServiceUnavailable {
+		t.Error("Expected ready status 503 without DB connection got ", code)
+	}
+	if code := status("/health/live"); code != http.StatusOK {
+		t.Error("Expected live status 200 got ", code)
+	}
+	releaseDBConn(conn)
+}
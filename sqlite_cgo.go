@@ -0,0 +1,11 @@
+//go:build cgo
+// +build cgo
+
+package main
+
+import (
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Name of the SQLite driver. go-sqlite3 is used when cgo is available
+const SQLITE_DRIVER = "sqlite3"
@@ -0,0 +1,12 @@
+//go:build !cgo
+// +build !cgo
+
+package main
+
+import (
+	_ "modernc.org/sqlite"
+)
+
+// Name of the SQLite driver. Without cgo (e.g. when cross-compiling for
+// routers) the pure Go implementation is used
+const SQLITE_DRIVER = "sqlite"
@@ -3,10 +3,13 @@ package main
 import (
 	"bufio"
 	"fmt"
+	"io"
 	"os"
 	"runtime"
 	"runtime/pprof"
 	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
@@ -18,33 +21,27 @@ type Stat struct {
 
 var chstatcounter chan Stat
 
+// Prefix of the counters of received messages by type
+const MSG_STAT_PREFIX = "msg_"
+
+// Counter names (sorted) and values. Protected by statLock
+var (
+	counters       sort.StringSlice
+	counter_values map[string]int
+	statLock       = &sync.Mutex{}
+)
+
 func init() {
 	chstatcounter = make(chan Stat, 200)
+	counter_values = make(map[string]int)
 }
 
 // Show statistics about the program every `frequency` seconds
 // Counters be created and incremented by sending a string with the name of the
 // counter to channel `chstatcounter`
 func stats(frequency int, memory bool) {
-	counters := sort.StringSlice{}
-	counter_values := make(map[string]int)
-	lock := &sync.Mutex{}
-
 	// Increment counter statistics
-	go func() {
-		for c := range chstatcounter {
-			lock.Lock()
-			if val, ok := counter_values[c.name]; ok {
-				counter_values[c.name] = val + c.value
-			} else {
-				counters = append(counters, c.name)
-				counters.Sort()
-
-				counter_values[c.name] = c.value
-			}
-			lock.Unlock()
-		}
-	}()
+	go accumulateStats(chstatcounter)
 
 	// Display stats at each given interval
 	go func() {
@@ -58,52 +55,208 @@ func stats(frequency int, memory bool) {
 		timer := time.NewTimer(time.Duration(0))
 
 		for t := range timer.C {
-			lock.Lock()
-
 			// Time difference since last call
 			diff = int(t.Sub(last) / time.Second)
 			last = t
 
-			runtime.ReadMemStats(&m)
+			if memory {
+				runtime.ReadMemStats(&m)
+				writeStats(w, t, diff, last_values, &m)
+			} else {
+				writeStats(w, t, diff, last_values, nil)
+			}
+			w.Flush()
 
-			fmt.Fprintf(w, t.Format("2006/01/02 15:04:05 "))
+			timer.Reset(time.Duration(frequency) * time.Second)
+		}
+	}()
+}
 
-			// Counters
-			for _, c := range counters {
-				val := counter_values[c]
-				val_last := last_values[c]
+// Add the counter increments received on `ch` to the counters until `ch` is
+// closed
+func accumulateStats(ch <-chan Stat) {
+	for c := range ch {
+		statLock.Lock()
+		if val, ok := counter_values[c.name]; ok {
+			counter_values[c.name] = val + c.value
+		} else {
+			counters = append(counters, c.name)
+			counters.Sort()
 
-				fmt.Fprintf(w, "%s: %d (%d", c, val, val-val_last)
+			counter_values[c.name] = c.value
+		}
+		statLock.Unlock()
+	}
+}
 
-				if diff != 0 {
-					fmt.Fprintf(w, " %d/s", (val-val_last)/diff)
-				}
-				w.WriteString(")\t")
+// Get a copy of the current value of all counters
+func StatSnapshot() map[string]int {
+	statLock.Lock()
+	defer statLock.Unlock()
 
-				last_values[c] = val
-			}
+	snapshot := make(map[string]int, len(counter_values))
+	for name, val := range counter_values {
+		snapshot[name] = val
+	}
 
-			if memory {
-				fmt.Fprintf(w, " mem: %d sys %d alloc %d idle %d released",
-					m.HeapSys, m.HeapAlloc, m.HeapIdle, m.HeapReleased)
-			}
+	return snapshot
+}
 
-			w.WriteRune('\n')
-			w.Flush()
+// Count received messages of each type, from the msg_<type> counters
+func GetP2PMessageTypeStats() (map[string]int, error) {
+	msg_types := make(map[string]int)
 
-			lock.Unlock()
+	for name, val := range StatSnapshot() {
+		if strings.HasPrefix(name, MSG_STAT_PREFIX) {
+			msg_types[strings.TrimPrefix(name, MSG_STAT_PREFIX)] = val
+		}
+	}
 
-			timer.Reset(time.Duration(frequency) * time.Second)
+	return msg_types, nil
+}
+
+// Set the given counter back to 0
+func ResetStat(name string) error {
+	statLock.Lock()
+	defer statLock.Unlock()
+
+	if _, ok := counter_values[name]; !ok {
+		return fmt.Errorf("ResetStat: Unknown counter %s", name)
+	}
+	counter_values[name] = 0
+
+	return nil
+}
+
+// Set all counters back to 0
+func ResetAllStats() {
+	statLock.Lock()
+	defer statLock.Unlock()
+
+	for name := range counter_values {
+		counter_values[name] = 0
+	}
+}
+
+// Write a line with the value of each counter, its increment since
+// `last_values` and its rate over `diff` seconds. `last_values` is updated
+// with the current values. Memory stats are written if `m` is not nil.
+func writeStats(w io.Writer, t time.Time, diff int, last_values map[string]int, m *runtime.MemStats) {
+	statLock.Lock()
+	defer statLock.Unlock()
+
+	fmt.Fprintf(w, t.Format("2006/01/02 15:04:05 "))
+
+	// Counters
+	for _, c := range counters {
+		val := counter_values[c]
+		val_last := last_values[c]
+		if val < val_last {
+			// Counter was reset since last print
+			val_last = 0
 		}
-	}()
+
+		fmt.Fprintf(w, "%s: %d (%d", c, val, val-val_last)
+
+		if diff != 0 {
+			fmt.Fprintf(w, " %d/s", (val-val_last)/diff)
+		}
+		io.WriteString(w, ")\t")
+
+		last_values[c] = val
+	}
+
+	if m != nil {
+		fmt.Fprintf(w, " mem: %d sys %d alloc %d idle %d released",
+			m.HeapSys, m.HeapAlloc, m.HeapIdle, m.HeapReleased)
+	}
+
+	io.WriteString(w, "\n")
+}
+
+// Measures the duration of an operation. The duration is counted in one of
+// the counters timer_<name>_<bucket>
+type StatTimer struct {
+	name  string
+	start time.Time
+}
+
+// Start measuring the duration of the named operation
+func NewStatTimer(name string) StatTimer {
+	return StatTimer{name: name, start: time.Now()}
 }
 
-// Periodically save heap stats
-func UpdateHeapProfile() {
+// Stop measuring and increment the counter for the elapsed duration
+func (st *StatTimer) Stop() {
+	elapsed := time.Since(st.start)
+
+	chstatcounter <- Stat{"timer_" + st.name + "_" + timerBucket(elapsed), 1}
+}
+
+// Name of the latency bucket for the given duration
+func timerBucket(d time.Duration) string {
+	switch {
+	case d < time.Millisecond:
+		return "lt1ms"
+	case d < 10*time.Millisecond:
+		return "1-10ms"
+	case d < 100*time.Millisecond:
+		return "10-100ms"
+	default:
+		return "gt100ms"
+	}
+}
+
+// Write a CSV line with the current memory usage :
+//
+//	unix_timestamp,heap_alloc,heap_sys,rss_kb
+func WriteMemUsage(w io.Writer) error {
+	m := runtime.MemStats{}
+	runtime.ReadMemStats(&m)
+
+	_, err := fmt.Fprintf(w, "%d,%d,%d,%d\n", time.Now().Unix(), m.HeapAlloc, m.HeapSys, processRSS())
+	return err
+}
+
+// Resident set size of the process in kB. Returns 0 if it is not available
+// (only supported on Linux)
+func processRSS() int {
+	f, err := os.Open("/proc/self/status")
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "VmRSS:" {
+			rss, err := strconv.Atoi(fields[1])
+			if err != nil {
+				return 0
+			}
+			return rss
+		}
+	}
+
+	return 0
+}
+
+// Periodically write a heap profile to `w` every `interval` until `stop` is
+// closed
+func UpdateHeapProfile(w io.Writer, interval time.Duration, stop <-chan bool) {
 	timer := time.NewTimer(time.Duration(0))
+	defer timer.Stop()
 
-	for _ = range timer.C {
-		pprof.WriteHeapProfile(fheap)
-		timer.Reset(time.Second)
+	for {
+		select {
+		case <-timer.C:
+			pprof.WriteHeapProfile(w)
+			chstatcounter <- Stat{"heap_profile_writes", 1}
+
+			timer.Reset(interval)
+		case <-stop:
+			return
+		}
 	}
 }
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// Reset the counters to an empty state
+func resetCounters() {
+	statLock.Lock()
+	counters = sort.StringSlice{}
+	counter_values = make(map[string]int)
+	statLock.Unlock()
+}
+
+// Discard the stats sent to chstatcounter by other tests
+func drainStats() {
+	for {
+		select {
+		case <-chstatcounter:
+		default:
+			return
+		}
+	}
+}
+
+func TestStatsAccumulation(t *testing.T) {
+	resetCounters()
+
+	ch := make(chan Stat, 20)
+	done := make(chan bool)
+	go func() {
+		accumulateStats(ch)
+		done <- true
+	}()
+
+	for i := 0; i < 10; i++ {
+		ch <- Stat{"refr", 1}
+	}
+	ch <- Stat{"addr", 1000}
+	close(ch)
+	<-done
+
+	statLock.Lock()
+	defer statLock.Unlock()
+
+	if counter_values["refr"] != 10 {
+		t.Error("refr expected 10 got ", counter_values["refr"])
+	}
+	if counter_values["addr"] != 1000 {
+		t.Error("addr expected 1000 got ", counter_values["addr"])
+	}
+	if !sort.IsSorted(counters) || len(counters) != 2 {
+		t.Error("Expected 2 sorted counters got ", counters)
+	}
+}
+
+func TestStatsRateCalculation(t *testing.T) {
+	resetCounters()
+
+	ch := make(chan Stat, 1)
+	ch <- Stat{"refr", 100}
+	close(ch)
+	accumulateStats(ch)
+
+	now := time.Date(2014, 1, 2, 3, 4, 5, 0, time.UTC)
+	last_values := map[string]int{"refr": 40}
+	w := &bytes.Buffer{}
+
+	// 60 new over 20 seconds
+	writeStats(w, now, 20, last_values, nil)
+
+	expected := "2014/01/02 03:04:05 refr: 100 (60 3/s)\t\n"
+	if w.String() != expected {
+		t.Errorf("Expected %q got %q", expected, w.String())
+	}
+	if last_values["refr"] != 100 {
+		t.Error("Last values not updated, got ", last_values["refr"])
+	}
+
+	// No rate when no time elapsed
+	w.Reset()
+	writeStats(w, now, 0, last_values, nil)
+
+	expected = "2014/01/02 03:04:05 refr: 100 (0)\t\n"
+	if w.String() != expected {
+		t.Errorf("Expected %q got %q", expected, w.String())
+	}
+}
+
+func TestStatSnapshot(t *testing.T) {
+	resetCounters()
+
+	ch := make(chan Stat, 2)
+	ch <- Stat{"refr", 3}
+	ch <- Stat{"skip", 2}
+	close(ch)
+	accumulateStats(ch)
+
+	snapshot := StatSnapshot()
+	expected := map[string]int{"refr": 3, "skip": 2}
+	if !reflect.DeepEqual(expected, snapshot) {
+		t.Error("Snapshot expected ", expected, " got ", snapshot)
+	}
+
+	// Modifying the snapshot must not affect the counters
+	snapshot["refr"] = 100
+	snapshot["new"] = 1
+
+	got := StatSnapshot()
+	if !reflect.DeepEqual(expected, got) {
+		t.Error("Counters modified through snapshot, expected ", expected, " got ", got)
+	}
+}
+
+func TestResetStats(t *testing.T) {
+	resetCounters()
+
+	ch := make(chan Stat, 2)
+	ch <- Stat{"refr", 3}
+	ch <- Stat{"skip", 2}
+	close(ch)
+	accumulateStats(ch)
+
+	// TEST: Reset a single counter, twice
+	for i := 0; i < 2; i++ {
+		err := ResetStat("refr")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := map[string]int{"refr": 0, "skip": 2}
+		if got := StatSnapshot(); !reflect.DeepEqual(expected, got) {
+			t.Error("Reset counter expected ", expected, " got ", got)
+		}
+	}
+
+	// TEST: Unknown counter
+	if err := ResetStat("unknown"); err == nil {
+		t.Error("Resetting unknown counter should fail")
+	}
+
+	// TEST: Reset all counters, twice
+	for i := 0; i < 2; i++ {
+		ResetAllStats()
+
+		expected := map[string]int{"refr": 0, "skip": 0}
+		if got := StatSnapshot(); !reflect.DeepEqual(expected, got) {
+			t.Error("Reset all counters expected ", expected, " got ", got)
+		}
+	}
+
+	// TEST: No negative increment after reset
+	w := &bytes.Buffer{}
+	writeStats(w, time.Unix(0, 0).UTC(), 1, map[string]int{"refr": 3, "skip": 2}, nil)
+
+	expected := "1970/01/01 00:00:00 refr: 0 (0 0/s)\tskip: 0 (0 0/s)\t\n"
+	if w.String() != expected {
+		t.Errorf("Expected %q got %q", expected, w.String())
+	}
+}
+
+func TestTimerBucket(t *testing.T) {
+	for _, c := range []struct {
+		d        time.Duration
+		expected string
+	}{
+		{0, "lt1ms"},
+		{999 * time.Microsecond, "lt1ms"},
+		{time.Millisecond, "1-10ms"},
+		{9 * time.Millisecond, "1-10ms"},
+		{10 * time.Millisecond, "10-100ms"},
+		{100 * time.Millisecond, "gt100ms"},
+		{time.Minute, "gt100ms"},
+	} {
+		if got := timerBucket(c.d); got != c.expected {
+			t.Error(c.d, " expected ", c.expected, " got ", got)
+		}
+	}
+}
+
+func TestStatTimer(t *testing.T) {
+	drainStats()
+
+	timer := NewStatTimer("test")
+	timer.start = timer.start.Add(-50 * time.Millisecond)
+	timer.Stop()
+
+	stat := <-chstatcounter
+	expected := Stat{"timer_test_10-100ms", 1}
+	if stat != expected {
+		t.Error("Timer stat expected ", expected, " got ", stat)
+	}
+}
+
+func TestGetP2PMessageTypeStats(t *testing.T) {
+	resetCounters()
+
+	ch := make(chan Stat, 3)
+	ch <- Stat{"msg_addr", 3}
+	ch <- Stat{"msg_inv", 2}
+	ch <- Stat{"refr", 1}
+	close(ch)
+	accumulateStats(ch)
+
+	got, err := GetP2PMessageTypeStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]int{"addr": 3, "inv": 2}
+	if !reflect.DeepEqual(expected, got) {
+		t.Error("Message types expected ", expected, " got ", got)
+	}
+}
+
+func TestUpdateHeapProfile(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "heap.prof"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	stop := make(chan bool)
+	done := make(chan bool)
+	go func() {
+		UpdateHeapProfile(f, 10*time.Millisecond, stop)
+		done <- true
+	}()
+
+	// Count profile writes while the profiler runs
+	writes := 0
+	timeout := time.After(100 * time.Millisecond)
+loop:
+	for {
+		select {
+		case stat := <-chstatcounter:
+			if stat.name == "heap_profile_writes" {
+				writes += stat.value
+			}
+		case <-timeout:
+			break loop
+		}
+	}
+	close(stop)
+	<-done
+
+	if writes < 5 {
+		t.Error("Expected at least 5 heap profile writes got ", writes)
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() == 0 {
+		t.Error("Heap profile file is empty")
+	}
+}
+
+func TestWriteMemUsage(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "mem.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	for i := 0; i < 3; i++ {
+		err = WriteMemUsage(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err = f.Seek(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 {
+		t.Fatal("Expected 3 lines got ", len(records))
+	}
+
+	for _, record := range records {
+		if len(record) != 4 {
+			t.Error("Expected 4 fields got ", record)
+			continue
+		}
+		for _, field := range record {
+			if _, err := strconv.ParseUint(field, 10, 64); err != nil {
+				t.Error("Field is not an integer: ", field)
+			}
+		}
+	}
+}
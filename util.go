@@ -4,9 +4,30 @@ import (
 	"bytes"
 	"crypto/sha256"
 	"encoding/binary"
+	"encoding/hex"
 	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
 )
 
+// Decode a hash as displayed (big-endian hex) to its byte order in messages.
+// Panics if s is not valid hex, it is meant for constants
+func hashFromHex(s string) []byte {
+	hash, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+
+	for i, j := 0, len(hash)-1; i < j; i, j = i+1, j-1 {
+		hash[i], hash[j] = hash[j], hash[i]
+	}
+
+	return hash
+}
+
 // Double sha256 for calculating checksums
 func doubleSha256(data []byte) []byte {
 	hash := sha256.Sum256(data)
@@ -51,7 +72,7 @@ func varInt(data []byte) (val uint64, n int, err error) {
 			err = fmt.Errorf("varInt: Not enough data for uint64 (%d)", len(data))
 			return
 		}
-		n = 5
+		n = 9
 		val = binary.LittleEndian.Uint64(data[1:9])
 	default: // No prefix
 		n = 1
@@ -61,6 +82,41 @@ func varInt(data []byte) (val uint64, n int, err error) {
 	return
 }
 
+// Write a variable length integer, using the smallest representation read by
+// varInt
+func encodeVarInt(val uint64) []byte {
+	var data []byte
+
+	switch {
+	case val < 0xfd:
+		return []byte{byte(val)}
+	case val <= 0xffff:
+		data = make([]byte, 3)
+		data[0] = 0xfd
+		binary.LittleEndian.PutUint16(data[1:], uint16(val))
+	case val <= 0xffffffff:
+		data = make([]byte, 5)
+		data[0] = 0xfe
+		binary.LittleEndian.PutUint32(data[1:], uint32(val))
+	default:
+		data = make([]byte, 9)
+		data[0] = 0xff
+		binary.LittleEndian.PutUint64(data[1:], val)
+	}
+
+	return data
+}
+
+// Write a var_str: the string prefixed with its length as a varInt. Fails if
+// the string cannot fit in a message
+func encodeVarStr(s string) ([]byte, error) {
+	if len(s) > MAX_PAYLOAD {
+		return nil, fmt.Errorf("encodeVarStr: String too long (%d)", len(s))
+	}
+
+	return append(encodeVarInt(uint64(len(s))), s...), nil
+}
+
 // Read a var_str. This is a byte string prefixed with its length represented as
 // a varInt
 // Returns:
@@ -87,3 +143,68 @@ func varStr(data []byte) (str string, n int, err error) {
 
 	return string(bytes.TrimRight(str_data, string(0))), n + int(length), nil
 }
+
+// Canonical ip:port representation of an address, e.g. 1.2.3.4:8333 or
+// [2001:db8::1]:8333. IPv4-mapped IPv6 addresses are written as IPv4
+func CanonicalNetAddr(na NetAddr) string {
+	return net.JoinHostPort(na.IP.String(), strconv.Itoa(int(na.Port)))
+}
+
+// Parse a duration. In addition to the units supported by time.ParseDuration,
+// a number of days can be given with the suffix "d" (e.g. 7d)
+func parseDuration(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.ParseFloat(strings.TrimSuffix(s, "d"), 64)
+		if err != nil {
+			return 0, fmt.Errorf("parseDuration: Invalid duration %s", s)
+		}
+
+		return time.Duration(days * float64(24*time.Hour)), nil
+	}
+
+	return time.ParseDuration(s)
+}
+
+// Matches the name and major version of the first component of a user agent
+var userAgentRegexp = regexp.MustCompile(`^/([^:/]+):(\d+)[^/]*/`)
+
+// Compile a comma separated list of glob patterns matching user agents. `*`
+// matches any sequence of characters, including `/`, and `?` a single one
+func userAgentPatterns(list string) (patterns []*regexp.Regexp) {
+	for _, glob := range strings.Split(list, ",") {
+		glob = strings.TrimSpace(glob)
+		if glob == "" {
+			continue
+		}
+
+		expr := regexp.QuoteMeta(glob)
+		expr = strings.Replace(expr, `\*`, ".*", -1)
+		expr = strings.Replace(expr, `\?`, ".", -1)
+		patterns = append(patterns, regexp.MustCompile("^"+expr+"$"))
+	}
+
+	return
+}
+
+// Whether the user agent matches any of the patterns
+func matchUserAgent(patterns []*regexp.Regexp, ua string) bool {
+	for _, p := range patterns {
+		if p.MatchString(ua) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Normalize a user agent to the software name and major version so that
+// similar versions can be grouped (e.g. /Satoshi:25.1.0/ becomes /Satoshi:25/).
+// Returns "Other" if the user agent does not follow the /name:version/ format
+func UserAgentBucket(ua string) string {
+	m := userAgentRegexp.FindStringSubmatch(ua)
+	if m == nil {
+		return "Other"
+	}
+
+	return "/" + m[1] + ":" + m[2] + "/"
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEncodeVarInt(t *testing.T) {
+	for _, c := range []struct {
+		val  uint64
+		size int
+	}{
+		{0, 1},
+		{0xfc, 1},
+		{0xfd, 3},
+		{0xffff, 3},
+		{0x10000, 5},
+		{0xffffffff, 5},
+		{0x100000000, 9},
+		{math.MaxUint64, 9},
+	} {
+		data := encodeVarInt(c.val)
+		if len(data) != c.size {
+			t.Errorf("%#x: expected %d bytes got %d", c.val, c.size, len(data))
+		}
+
+		val, n, err := varInt(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if val != c.val || n != c.size {
+			t.Errorf("%#x: decoded %#x in %d bytes", c.val, val, n)
+		}
+	}
+}
+
+func TestEncodeVarStr(t *testing.T) {
+	for _, s := range []string{"", USER_AGENT, strings.Repeat("a", 0xfd), strings.Repeat("b", 0x10000)} {
+		data, err := encodeVarStr(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		str, n, err := varStr(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if str != s || n != len(data) {
+			t.Errorf("String of %d bytes decoded as %d bytes in %d/%d", len(s), len(str), n, len(data))
+		}
+	}
+
+	// TEST: Too long for a message
+	_, err := encodeVarStr(strings.Repeat("c", MAX_PAYLOAD+1))
+	if err == nil {
+		t.Error("Expected error for string longer than a message")
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	for _, c := range []struct {
+		in       string
+		expected time.Duration
+		err      bool
+	}{
+		{"7d", 7 * 24 * time.Hour, false},
+		{"0.5d", 12 * time.Hour, false},
+		{"90m", 90 * time.Minute, false},
+		{"1h30m", 90 * time.Minute, false},
+		{"xd", 0, true},
+		{"7", 0, true},
+	} {
+		got, err := parseDuration(c.in)
+		if (err != nil) != c.err {
+			t.Error(c.in, " expected error ", c.err, " got ", err)
+		}
+		if got != c.expected {
+			t.Error(c.in, " expected ", c.expected, " got ", got)
+		}
+	}
+}
+
+func TestUserAgentBucket(t *testing.T) {
+	for _, c := range []struct {
+		ua       string
+		expected string
+	}{
+		{"/Satoshi:25.0.0/", "/Satoshi:25/"},
+		{"/Satoshi:25.1.0/", "/Satoshi:25/"},
+		{"/Satoshi:0.9.3/", "/Satoshi:0/"},
+		{"/btcd:0.23.3/", "/btcd:0/"},
+		{"/Satoshi:0.9.1/Bitcoin XT:0.1/", "/Satoshi:0/"},
+		{"/bcoin:2.2.0(full)/", "/bcoin:2/"},
+		{"", "Other"},
+		{"Satoshi:25.0.0", "Other"},
+		{"/Satoshi/", "Other"},
+		{"/Satoshi:beta/", "Other"},
+	} {
+		got := UserAgentBucket(c.ua)
+		if got != c.expected {
+			t.Error(c.ua, " expected ", c.expected, " got ", got)
+		}
+	}
+}
+
+func TestMatchUserAgent(t *testing.T) {
+	patterns := userAgentPatterns("/Bitcoin ABC:*, /Satoshi:0.1?.*/,,")
+	if len(patterns) != 2 {
+		t.Fatal("Expected 2 patterns got ", len(patterns))
+	}
+
+	for _, c := range []struct {
+		ua       string
+		expected bool
+	}{
+		{"/Bitcoin ABC:0.14.6(EB8.0)/", true},
+		{"/Satoshi:0.14.2/", true},
+		{"/Satoshi:0.9.3/", false},
+		{"/Satoshi:25.0.0/", false},
+		{"/Bitcoin ABC", false},
+		{"", false},
+	} {
+		got := matchUserAgent(patterns, c.ua)
+		if got != c.expected {
+			t.Error(c.ua, " expected ", c.expected, " got ", got)
+		}
+	}
+
+	if matchUserAgent(userAgentPatterns(""), "/Satoshi:25.0.0/") {
+		t.Error("Expected no match without patterns")
+	}
+}
+
+func TestCanonicalNetAddr(t *testing.T) {
+	for _, c := range []struct {
+		ip   string
+		port uint16
+	}{
+		{"1.2.3.4", 8333},
+		{"::ffff:1.2.3.4", 8333},
+		{"2001:db8::1", 18333},
+		{"fe80::1:2", 0},
+		{"::", 1},
+	} {
+		ip := net.ParseIP(c.ip)
+		got := CanonicalNetAddr(NetAddr{IP: ip, Port: c.port})
+
+		expected := net.JoinHostPort(ip.String(), strconv.Itoa(int(c.port)))
+		if got != expected {
+			t.Error(c.ip, " expected ", expected, " got ", got)
+		}
+	}
+
+	// Addresses parsed from messages are 16 bytes long
+	got := CanonicalNetAddr(NetAddr{IP: net.IPv4(1, 2, 3, 4).To16(), Port: 8333})
+	if got != "1.2.3.4:8333" {
+		t.Error("Expected 1.2.3.4:8333 got ", got)
+	}
+	got = CanonicalNetAddr(NetAddr{IP: net.ParseIP("2001:db8::1"), Port: 8333})
+	if got != "[2001:db8::1]:8333" {
+		t.Error("Expected [2001:db8::1]:8333 got ", got)
+	}
+}
+
+func TestHashFromHex(t *testing.T) {
+	hash := hashFromHex("000000000019d6689c085ae165831e934ff763ae46a2a6c172b3f1b60a8ce26f")
+	expected := "6fe28c0ab6f1b372c1a6a246ae63f74f931e8365e15a089c68d6190000000000"
+	if fmt.Sprintf("%x", hash) != expected {
+		t.Errorf("Expected hash %s got %x", expected, hash)
+	}
+}
@@ -1,11 +1,16 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"log"
 	"net"
+	"regexp"
 	"strconv"
 	"sync"
 	"time"
+
+	"golang.org/x/time/rate"
 )
 
 type Node struct {
@@ -14,12 +19,20 @@ type Node struct {
 
 	Version   *MsgVersion
 	Addresses []NetAddr
+
+	Errors map[string]int // Protocol errors during the refresh, by type
+
+	Excluded bool // The user agent matched -exclude-user-agent
+
+	ChainHeight int // Height of the chain of the node, 0 if unknown
 }
 
-// Periodically get addresses of Nodes which need to be updated
+// Periodically queue addresses of Nodes which need to be updated until stop is
+// closed. With -once, only a single batch of addresses is queued
 // Closes addresses on exit
-func getNodes(addresses chan<- ip_port, wg *sync.WaitGroup) {
+func getNodes(addresses *AddressManager, stop <-chan bool, wg *sync.WaitGroup) {
 	defer func() {
+		addresses.Close()
 		wg.Done()
 	}()
 
@@ -40,46 +53,84 @@ func getNodes(addresses chan<- ip_port, wg *sync.WaitGroup) {
 		}
 
 		log.Print("Bootstrapping from ", flagBootstrap)
-		addresses <- ip_port{ip, port}
+		addresses.Push(ip_port{ip, port}, PRIORITY_BOOTSTRAP)
 
 		// Give connection to bootstraped address time to succeed before
 		// attempting to get more addresses
-		time.Sleep(time.Minute)
+		select {
+		case <-stop:
+			return
+		case <-time.After(time.Minute):
+		}
+	} else if flagAutoBootstrap && flagBootstrap == "" {
+		// Reconnect quickly to well connected nodes
+		db := acquireDBConn()
+		n, err := enqueueBootstrapNodes(db, addresses, AUTO_BOOTSTRAP_NUM)
+		releaseDBConn(db)
+		if err != nil {
+			log.Fatal("Could not get nodes to bootstrap from: ", err)
+		}
+
+		log.Print("Auto-bootstrapping from ", n, " nodes")
 	}
 
 	// Attempt to get new addresses endlessly.
 
 	for {
-		log.Print(len(addresses), " addresses in queue")
+		queued := addresses.Len()
+		log.Print(queued, " addresses in queue")
 
 		// Only get new addresses if we consumed at least half of the addresses fetched
 		// during the last iteration
-		if len(addresses) < ADDRESSES_NUM/2 {
-			fetched_addresses, max_addresses := addressesToUpdate()
+		if queued < ADDRESSES_NUM/2 {
+			if flagAutoBan > 0 {
+				db := acquireDBConn()
+				banned, err := AutoBanMisbehavingNodes(db, flagAutoBan)
+				releaseDBConn(db)
+				if err != nil {
+					log.Print("Could not ban misbehaving nodes: ", err)
+				} else if banned > 0 {
+					log.Print("Banned ", banned, " misbehaving nodes")
+				}
+			}
+
+			fetched_addresses, priorities, max_addresses := addressesToUpdate()
 
 			log.Print("Adding ", len(fetched_addresses), "/", max_addresses, " addresses")
 
-			for _, addr := range fetched_addresses {
-				addresses <- addr
+			for i, addr := range fetched_addresses {
+				// Keep the order of a random sample
+				if flagRandomSample {
+					priorities[i] = 0
+				}
+				addresses.Push(addr, priorities[i])
 			}
 		}
 
-		time.Sleep(ADDRESSES_INTERVAL)
-	}
+		// Let the rest of the pipeline drain
+		if flagOnce {
+			return
+		}
 
+		select {
+		case <-stop:
+			return
+		case <-time.After(ADDRESSES_INTERVAL):
+		}
+	}
 }
 
-// Attempt to connect to the addresses provided by `addresses` and sends the
-// resulting Node to `nodes`
+// Attempt to connect to the addresses popped from `addresses` until it is
+// closed and empty, and send the resulting Node to `nodes`
 // The number of addresses which are checked simultaneously is defined by
-// NUM_CONNECTION_GOROUTINES.
+// -num-connection-goroutines.
 // Closes nodes on exit
-func connectNodes(addresses <-chan ip_port, nodes chan<- Node, wg *sync.WaitGroup) {
+func connectNodes(addresses *AddressManager, nodes chan<- Node, wg *sync.WaitGroup) {
 	// Declare here for defered check
-	rate_limiter := make(chan bool, NUM_CONNECTION_GOROUTINES)
+	rate_limiter := make(chan bool, flagNumConnectionGoroutines)
 	defer func() {
 		// Wait for goroutines to finish
-		for i := 0; i < NUM_CONNECTION_GOROUTINES; i++ {
+		for i := 0; i < cap(rate_limiter); i++ {
 			<-rate_limiter
 		}
 
@@ -87,12 +138,29 @@ func connectNodes(addresses <-chan ip_port, nodes chan<- Node, wg *sync.WaitGrou
 		wg.Done()
 	}()
 
+	// Limit connections per minute if requested
+	var crawl_limiter *rate.Limiter
+	if flagCrawlRate > 0 {
+		crawl_limiter = rate.NewLimiter(rate.Limit(float64(flagCrawlRate)/60), 1)
+	}
+
 	// Attempt to get a connection to each node
-	for i := 0; i < NUM_CONNECTION_GOROUTINES; i++ {
+	for i := 0; i < cap(rate_limiter); i++ {
 		rate_limiter <- true
 	}
-	for ipp := range addresses {
+	for {
+		// Pop once a connection is available, so that the address with the
+		// highest priority at that time is used
 		<-rate_limiter
+		ipp := addresses.Pop()
+		if ipp == (ip_port{}) {
+			rate_limiter <- true
+			break
+		}
+
+		if crawl_limiter != nil {
+			crawl_limiter.Wait(context.Background())
+		}
 		go connectSingleNode(ipp, nodes, rate_limiter)
 	}
 }
@@ -102,10 +170,23 @@ func connectSingleNode(ipp ip_port, nodes chan<- Node, end chan<- bool) {
 		end <- true
 	}()
 
+	// Addresses given without a port use the default one of the network
+	if ipp.port == "" {
+		ipp.port = strconv.Itoa(int(PORT_CURRENT))
+	}
+
 	hostport := net.JoinHostPort(ipp.ip, ipp.port)
-	conn, err := net.DialTimeout("tcp", hostport, NODE_CONNECT_TIMEOUT*time.Second)
+	timeout := adaptiveTimeout(ipp.ip, latencies.History(ipp.ip))
+
+	start := time.Now()
+	conn, err := net.DialTimeout("tcp", hostport, timeout)
 	if err != nil {
 		conn = nil
+		if net_err, ok := err.(net.Error); ok && net_err.Timeout() {
+			latencies.AddTimeout(ipp.ip, timeout)
+		}
+	} else {
+		latencies.Add(ipp.ip, time.Since(start))
 	}
 
 	portval, err := strconv.Atoi(ipp.port)
@@ -132,12 +213,12 @@ func updateNodes(nodes <-chan Node, save chan<- Node, wg *sync.WaitGroup) {
 		wg.Done()
 	}()
 
-	goroutine_end := make(chan bool, NUM_UPDATE_GOROUTINES)
-	for i := 0; i < NUM_UPDATE_GOROUTINES; i++ {
+	goroutine_end := make(chan bool, flagNumUpdateGoroutines)
+	for i := 0; i < flagNumUpdateGoroutines; i++ {
 		go updateNodeThread(nodes, save, goroutine_end)
 	}
 
-	for i := 0; i < NUM_UPDATE_GOROUTINES; i++ {
+	for i := 0; i < flagNumUpdateGoroutines; i++ {
 		<-goroutine_end
 	}
 }
@@ -148,11 +229,12 @@ func updateNodeThread(nodes <-chan Node, save chan<- Node, end chan<- bool) {
 	}()
 
 	var upd Node
+	exclude := userAgentPatterns(flagExcludeUserAgent)
 
 	for node := range nodes {
 		if node.Conn != nil {
 			// Log memory usage
-			upd = refreshNode(node)
+			upd = refreshNode(node, exclude)
 			chstatcounter <- Stat{"refr", 1}
 			chstatcounter <- Stat{"addr", len(upd.Addresses)}
 		} else {
@@ -163,8 +245,9 @@ func updateNodeThread(nodes <-chan Node, save chan<- Node, end chan<- bool) {
 	}
 }
 
-// Connect to the node and retrieve updated information
-func refreshNode(node Node) (updated Node) {
+// Connect to the node and retrieve updated information. Peers are not fetched
+// from nodes whose user agent matches one of the `exclude` patterns
+func refreshNode(node Node, exclude []*regexp.Regexp) (updated Node) {
 	defer func() {
 		if node.Conn != nil {
 			node.Conn.Close()
@@ -177,6 +260,8 @@ func refreshNode(node Node) (updated Node) {
 	ip := node.NetAddr.IP.String()
 	port := node.NetAddr.Port
 
+	handshake_timer := NewStatTimer("handshake")
+
 	err := sendVersion(node)
 	if err != nil {
 		// Firewall blocking port
@@ -186,6 +271,7 @@ func refreshNode(node Node) (updated Node) {
 
 	version, err := receiveVersion(node)
 	if err != nil {
+		updated.recordError(err)
 		if verbose {
 			log.Printf("Receiving version (%s %d): %v", ip, port, err)
 		}
@@ -194,13 +280,29 @@ func refreshNode(node Node) (updated Node) {
 
 	updated.Version = &version
 
-	msg, err := receiveMessage(node)
+	err = sendVerack(node)
+	if err != nil {
+		if verbose {
+			log.Printf("Sending verack (%s %d): %v", ip, port, err)
+		}
+		return
+	}
+
+	if matchUserAgent(exclude, version.UserAgent) {
+		updated.Excluded = true
+		chstatcounter <- Stat{"excluded", 1}
+		return
+	}
+
+	msg, err := receiveMessageWithTimeout(node, flagMessageTimeout)
 	if err != nil || msg.Type != "verack" {
+		updated.recordError(err)
 		if verbose {
 			log.Printf("Receiving verack (%s %d): %v", ip, port, err)
 		}
 		return // Expected verack to finish handshake
 	}
+	handshake_timer.Stop()
 
 	err = sendGetAddr(node)
 	if err != nil {
@@ -214,10 +316,11 @@ func refreshNode(node Node) (updated Node) {
 	addresses := make([]NetAddr, 0)
 
 	for num_getaddr < 4 {
-		msg, err = receiveMessage(node)
+		msg, err = receiveMessageWithTimeout(node, flagMessageTimeout)
 
 		if err != nil {
 			// TODO: Connection error ? Retry ?
+			updated.recordError(err)
 			if verbose {
 				log.Printf("Error, receiving message (%s %d): %v", ip, port, err)
 			}
@@ -236,7 +339,7 @@ func refreshNode(node Node) (updated Node) {
 
 			// Consider that all messages have been received for this getaddr
 			// Get the result of getaddr 10 times
-			if len(new_addresses) < 1000 {
+			if addrMessageCount(msg) < 1000 {
 				num_getaddr += 1
 
 				err = sendGetAddr(node)
@@ -245,6 +348,23 @@ func refreshNode(node Node) (updated Node) {
 					return
 				}
 			}
+		case "headers":
+			count, err := parseHeadersMessage(msg)
+			if err != nil {
+				updated.recordError(err)
+				if verbose {
+					log.Printf("Parsing headers (%s %d): %v", ip, port, err)
+				}
+				continue
+			}
+
+			// Unsolicited headers following the genesis block
+			if headersFromGenesis(msg) {
+				updated.ChainHeight = count
+			}
+			if verbose {
+				log.Printf("Received %d headers from %v", count, node.Conn.RemoteAddr())
+			}
 		default:
 			if verbose {
 				log.Printf("Received %s from %v", msg.Type, node.Conn.RemoteAddr())
@@ -257,6 +377,92 @@ func refreshNode(node Node) (updated Node) {
 	return
 }
 
+// Check that the given node is reachable by connecting to it and completing a
+// handshake, independently of the crawl. Returns the time taken from the
+// start of the connection to the end of the handshake and the version sent by
+// the node. Nothing is saved to the DB.
+func Ping(ctx context.Context, ip, port string) (latency time.Duration, version *MsgVersion, err error) {
+	start := time.Now()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(ip, port))
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	// Abort the handshake if the context ends
+	done := make(chan bool)
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	node := Node{Conn: conn}
+
+	err = sendVersion(node)
+	if err != nil {
+		return
+	}
+
+	ver, err := receiveVersion(node)
+	if err != nil {
+		return
+	}
+
+	msg, err := receiveMessage(node)
+	if err != nil {
+		return
+	}
+	if msg.Type != "verack" {
+		err = fmt.Errorf("Expected verack got %s", msg.Type)
+		return
+	}
+
+	return time.Since(start), &ver, nil
+}
+
+// Count err against the node if it was caused by invalid data sent by the node
+func (node *Node) recordError(err error) {
+	error_type := nodeErrorType(err)
+	if error_type == "" {
+		return
+	}
+
+	if node.Errors == nil {
+		node.Errors = make(map[string]int)
+	}
+	node.Errors[error_type]++
+}
+
+// Periodically delete relations between nodes which were not seen for ttl, so
+// that nodes_known does not grow indefinitely
+func graphGC(interval, ttl time.Duration, stop <-chan bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			db := acquireDBConn()
+			count, err := DropEdgesOlderThan(db, time.Now().Add(-ttl))
+			releaseDBConn(db)
+			if err != nil {
+				log.Print("Could not drop old relations: ", err)
+				continue
+			}
+
+			log.Print("Dropped ", count, " relations older than ", ttl)
+		case <-stop:
+			return
+		}
+	}
+}
+
 func saveNodes(save <-chan Node, wg *sync.WaitGroup) {
 	defer func() {
 		wg.Done()
@@ -265,8 +471,21 @@ func saveNodes(save <-chan Node, wg *sync.WaitGroup) {
 	db := acquireDBConn()
 	defer releaseDBConn(db)
 
+	last_memusage := time.Time{}
+
 	for n := range save {
 		chstatcounter <- Stat{"save", 1}
-		n.Save(db)
+		err := n.Save(db)
+		if err != nil {
+			log.Print("Saving node: ", err)
+		}
+
+		if fmem != nil && time.Since(last_memusage) >= memusageInterval {
+			err := WriteMemUsage(fmem)
+			if err != nil {
+				log.Print("Writing memory usage: ", err)
+			}
+			last_memusage = time.Now()
+		}
 	}
 }
@@ -0,0 +1,610 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Start a node listening on localhost which runs handle on the first
+// connection it accepts. Returns the address of the node
+func mockNode(t *testing.T, handle func(node Node)) (ip, port string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		handle(Node{Conn: conn})
+	}()
+
+	ip, port, err = net.SplitHostPort(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+// Complete a handshake as the remote node, answering the version sent by the
+// crawler
+func mockHandshake(node Node) bool {
+	_, err := receiveVersion(node)
+	if err != nil {
+		return false
+	}
+
+	if sendVersion(node) != nil {
+		return false
+	}
+
+	return sendMessage(node, Message{Type: "verack", Payload: []byte{}}) == nil
+}
+
+func TestPing(t *testing.T) {
+	// TEST: Successful handshake
+	ip, port := mockNode(t, func(node Node) { mockHandshake(node) })
+
+	latency, version, err := Ping(context.Background(), ip, port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latency <= 0 {
+		t.Error("Expected positive latency got ", latency)
+	}
+	if version == nil || version.UserAgent != USER_AGENT || version.Protocol != CURRENT_PROTOCOL {
+		t.Error("Unexpected version ", version)
+	}
+
+	// TEST: Node does not complete handshake
+	ip, port = mockNode(t, func(node Node) {
+		receiveVersion(node)
+		sendMessage(node, Message{Type: "ping", Payload: make([]byte, 8)})
+	})
+
+	_, _, err = Ping(context.Background(), ip, port)
+	if err == nil {
+		t.Error("Expected error for node not sending version")
+	}
+
+	// TEST: Context ends while waiting for the node
+	ip, port = mockNode(t, func(node Node) { time.Sleep(time.Second) })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, _, err = Ping(ctx, ip, port)
+	if err == nil {
+		t.Error("Expected error for unresponsive node")
+	}
+	if time.Since(start) > 500*time.Millisecond {
+		t.Error("Ping did not stop at end of context")
+	}
+}
+
+func TestGraphGC(t *testing.T) {
+	db := tempDB(t)
+	defer db.Close()
+	tempDBPool(db)
+
+	tempGraph(t, db, 3, nil)
+	now := time.Now().Unix()
+	_, err := db.Exec(`INSERT INTO nodes_known (id_source, id_known, updated_at) VALUES
+		(1, 2, ?), -- older than ttl
+		(1, 3, ?),
+		(2, 3, ?)`, now-7200, now, now-60)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stop := make(chan bool)
+	done := make(chan bool)
+	go func() {
+		graphGC(10*time.Millisecond, time.Hour, stop)
+		done <- true
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	close(stop)
+	<-done
+
+	count, err := TotalKnownEdges(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Error("Expected 2 relations left got ", count)
+	}
+}
+
+func TestConnectSingleNode(t *testing.T) {
+	savedConnect, savedMessage := flagConnectTimeout, flagMessageTimeout
+	defer func() { flagConnectTimeout, flagMessageTimeout = savedConnect, savedMessage }()
+	flagConnectTimeout = 100 * time.Millisecond
+	flagMessageTimeout = 100 * time.Millisecond
+
+	nodes := make(chan Node, 1)
+	end := make(chan bool, 1)
+
+	// TEST: Connection times out (192.0.2.0/24 is reserved for documentation)
+	start := time.Now()
+	connectSingleNode(ip_port{"192.0.2.1", "8333"}, nodes, end)
+	node := <-nodes
+	<-end
+
+	if node.Conn != nil {
+		node.Conn.Close()
+		t.Error("Expected no connection to unreachable node")
+	}
+	if !node.NetAddr.IP.Equal(net.ParseIP("192.0.2.1")) || node.NetAddr.Port != 8333 {
+		t.Error("Unexpected address ", node.NetAddr)
+	}
+	if time.Since(start) > time.Second {
+		t.Error("Connection did not stop at -connect-timeout")
+	}
+
+	// TEST: Node accepts the connection but never reads, the handshake times out
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+
+	ip, port, _ := net.SplitHostPort(l.Addr().String())
+	connectSingleNode(ip_port{ip, port}, nodes, end)
+	node = <-nodes
+	<-end
+	if node.Conn == nil {
+		t.Fatal("Expected connection to listening node")
+	}
+	defer (<-accepted).Close()
+
+	upd := refreshNode(node, nil)
+	drainStats()
+	if upd.Version != nil || upd.Addresses != nil {
+		t.Error("Expected nothing from node which never answers got ", upd.Version, upd.Addresses)
+	}
+}
+
+func TestConnectNodesCrawlRate(t *testing.T) {
+	saved := flagCrawlRate
+	defer func() { flagCrawlRate = saved }()
+
+	// 10 connections per second. Over 1s at most 11 connections must be
+	// attempted (the first one is immediate)
+	flagCrawlRate = 600
+
+	addresses := NewAddressManager()
+	for i := 0; i < 100; i++ {
+		addresses.Push(ip_port{"127.0.0.1", "1"}, 0) // Refused
+	}
+	nodes := make(chan Node, 100)
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go connectNodes(addresses, nodes, wg)
+
+	time.Sleep(time.Second)
+	if len(nodes) > 11 {
+		t.Error("Expected at most 11 connections in 1s got ", len(nodes))
+	}
+	if len(nodes) < 5 {
+		t.Error("Expected connections to continue at the crawl rate got ", len(nodes))
+	}
+
+	// Drop the remaining addresses
+	for addresses.Len() > 0 {
+		addresses.Pop()
+	}
+	addresses.Close()
+	wg.Wait()
+}
+
+func TestConnectNodesGoroutines(t *testing.T) {
+	saved := flagNumConnectionGoroutines
+	defer func() { flagNumConnectionGoroutines = saved }()
+	flagNumConnectionGoroutines = 50
+
+	// Connections are held open until the test ends, so every accepted
+	// connection is a dial which completed
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	var accepted int64
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			atomic.AddInt64(&accepted, 1)
+		}
+	}()
+
+	ip, port, _ := net.SplitHostPort(l.Addr().String())
+	addresses := NewAddressManager()
+	for i := 0; i < 200; i++ {
+		addresses.Push(ip_port{ip, port}, 0)
+	}
+	addresses.Close()
+
+	// A dial is in flight until its node is received: the goroutine keeps
+	// its slot while nobody reads from the unbuffered channel
+	nodes := make(chan Node)
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go connectNodes(addresses, nodes, wg)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt64(&accepted) < 50 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := atomic.LoadInt64(&accepted); n != 50 {
+		t.Fatal("Expected 50 dials in flight got ", n)
+	}
+
+	received := 0
+	max_in_flight := int64(0)
+	for node := range nodes {
+		if node.Conn == nil {
+			t.Fatal("Expected connection to ", node.NetAddr.IP)
+		}
+		defer node.Conn.Close()
+
+		received++
+		if n := atomic.LoadInt64(&accepted) - int64(received); n > max_in_flight {
+			max_in_flight = n
+		}
+	}
+	wg.Wait()
+
+	if received != 200 {
+		t.Error("Expected 200 nodes got ", received)
+	}
+	if max_in_flight > 50 {
+		t.Error("Expected at most 50 dials in flight got ", max_in_flight)
+	}
+}
+
+func TestGetNodesOnce(t *testing.T) {
+	saved := flagOnce
+	defer func() { flagOnce = saved }()
+	flagOnce = true
+
+	db := tempDB(t)
+	defer db.Close()
+	tempDBPool(db)
+
+	_, err := db.Exec(`INSERT INTO nodes (ip, port, success, next_refresh, updated_at) VALUES 
+		('127.0.0.1', 1, 1, 1, 0),
+		('127.0.0.2', 1, 1, 1, 0)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addresses := NewAddressManager()
+	nodes := make(chan Node, 10)
+	wg := &sync.WaitGroup{}
+	wg.Add(2)
+	go getNodes(addresses, nil, wg)
+	go connectNodes(addresses, nodes, wg)
+
+	done := make(chan bool)
+	go func() {
+		wg.Wait()
+		done <- true
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Pipeline did not exit after the first batch")
+	}
+
+	if len(nodes) != 2 {
+		t.Error("Expected 2 nodes from the first batch got ", len(nodes))
+	}
+}
+
+func TestGetNodesStop(t *testing.T) {
+	db := tempDB(t)
+	defer db.Close()
+	tempDBPool(db)
+
+	// Known node which does not need to be refreshed
+	_, err := db.Exec(`INSERT INTO nodes (ip, port, success, next_refresh, updated_at) 
+		VALUES ('127.0.0.1', 1, 1, 0, 0)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addresses := NewAddressManager()
+	stop := make(chan bool)
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go getNodes(addresses, stop, wg)
+
+	close(stop)
+
+	popped := make(chan ip_port)
+	go func() { popped <- addresses.Pop() }()
+
+	select {
+	case addr := <-popped:
+		if addr != (ip_port{}) {
+			t.Error("Expected no address queued got ", addr)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Addresses not closed after stop")
+	}
+	wg.Wait()
+}
+
+func TestRefreshNodeSendsVerack(t *testing.T) {
+	// The first messages sent by the crawler after the handshake
+	received := make(chan string, 2)
+	ip, port := mockNode(t, func(node Node) {
+		if !mockHandshake(node) {
+			return
+		}
+		for i := 0; i < 2; i++ {
+			msg, err := receiveMessage(node)
+			if err != nil {
+				break
+			}
+			received <- msg.Type
+		}
+		close(received)
+	})
+
+	conn, err := net.Dial("tcp", net.JoinHostPort(ip, port))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	refreshNode(Node{Conn: conn}, nil)
+	drainStats()
+
+	if msg_type := <-received; msg_type != "verack" {
+		t.Error("Expected verack after version got ", msg_type)
+	}
+	if msg_type := <-received; msg_type != "getaddr" {
+		t.Error("Expected getaddr after handshake got ", msg_type)
+	}
+}
+
+func TestUpdateNodeThreadExcludedUserAgent(t *testing.T) {
+	saved := flagExcludeUserAgent
+	defer func() { flagExcludeUserAgent = saved }()
+	flagExcludeUserAgent = "/BTCCRAWLER/*"
+
+	// The remote node answers with the crawler's own user agent
+	received := make(chan string, 10)
+	ip, port := mockNode(t, func(node Node) {
+		if !mockHandshake(node) {
+			return
+		}
+		for {
+			msg, err := receiveMessage(node)
+			if err != nil {
+				close(received)
+				return
+			}
+			received <- msg.Type
+		}
+	})
+
+	conn, err := net.Dial("tcp", net.JoinHostPort(ip, port))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nodes := make(chan Node, 1)
+	save := make(chan Node, 1)
+	end := make(chan bool, 1)
+	nodes <- Node{Conn: conn}
+	close(nodes)
+
+	updateNodeThread(nodes, save, end)
+	upd := <-save
+	drainStats()
+
+	if !upd.Excluded {
+		t.Error("Expected node to be excluded")
+	}
+	if upd.Version == nil || upd.Version.UserAgent != USER_AGENT {
+		t.Error("Expected version of excluded node to be kept got ", upd.Version)
+	}
+	for msg_type := range received {
+		if msg_type == "getaddr" {
+			t.Error("Expected no getaddr sent to excluded node")
+		}
+	}
+
+	// Excluded nodes are not refreshed for a long time
+	db := tempDB(t)
+	defer db.Close()
+
+	upd.NetAddr = NetAddr{IP: net.ParseIP("1.2.3.4"), Port: 8333}
+	err = upd.Save(db)
+	drainStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var next_refresh int64
+	err = db.QueryRow("SELECT next_refresh FROM nodes WHERE ip='1.2.3.4'").Scan(&next_refresh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next_refresh < time.Now().Add(30*24*time.Hour).Unix() {
+		t.Error("Expected next refresh far in the future got ", time.Unix(next_refresh, 0))
+	}
+}
+
+func TestUpdateNodeThread(t *testing.T) {
+	drainStats()
+	defer drainStats()
+
+	// Each connected node answers getaddr with a single address of its own
+	nodes := make(chan Node, 5)
+	for i := 1; i <= 3; i++ {
+		peer := NetAddr{IP: net.IPv4(10, 0, 0, byte(i)), Port: 8333}
+		ip, port := mockNode(t, func(node Node) {
+			if !mockHandshake(node) {
+				return
+			}
+			for {
+				msg, err := receiveMessage(node)
+				if err != nil {
+					return
+				}
+				if msg.Type != "getaddr" {
+					continue
+				}
+				err = sendMessage(node, Message{Type: "addr", Payload: addrPayload(peer)})
+				if err != nil {
+					return
+				}
+			}
+		})
+
+		conn, err := net.Dial("tcp", net.JoinHostPort(ip, port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		nodes <- Node{NetAddr: peer, Conn: conn}
+	}
+	for i := 4; i <= 5; i++ {
+		nodes <- Node{NetAddr: NetAddr{IP: net.IPv4(10, 0, 0, byte(i)), Port: 8333}}
+	}
+	close(nodes)
+
+	save := make(chan Node, 5)
+	end := make(chan bool, 1)
+	updateNodeThread(nodes, save, end)
+	close(save)
+	drainStats()
+
+	select {
+	case <-end:
+	default:
+		t.Error("Expected end to be signaled")
+	}
+
+	refreshed, skipped := 0, 0
+	for upd := range save {
+		if upd.Conn == nil {
+			skipped++
+			if upd.Addresses != nil || upd.Version != nil {
+				t.Error("Expected node without connection to be unchanged got ", upd)
+			}
+			continue
+		}
+
+		refreshed++
+		if upd.Version == nil {
+			t.Error("Expected version of ", upd.NetAddr.IP, " to be set")
+		}
+		if len(upd.Addresses) == 0 {
+			t.Error("Expected addresses from ", upd.NetAddr.IP)
+		}
+		for _, addr := range upd.Addresses {
+			if !addr.IP.Equal(upd.NetAddr.IP) {
+				t.Error("Expected address ", upd.NetAddr.IP, " got ", addr.IP)
+			}
+		}
+	}
+
+	if refreshed != 3 || skipped != 2 {
+		t.Error("Expected 3 refreshed and 2 skipped nodes got ", refreshed, skipped)
+	}
+}
+
+func TestRefreshNodeDeduplicatesAddresses(t *testing.T) {
+	drainStats()
+	defer drainStats()
+
+	a := NetAddr{IP: net.ParseIP("1.2.3.4"), Port: 8333}
+	b := NetAddr{IP: net.ParseIP("2001:db8::1"), Port: 8333}
+	handled := make(chan bool)
+	ip, port := mockNode(t, func(node Node) {
+		defer close(handled)
+		if !mockHandshake(node) {
+			return
+		}
+		for {
+			msg, err := receiveMessage(node)
+			if err != nil {
+				return
+			}
+			if msg.Type == "getaddr" {
+				sendMessage(node, Message{Type: "addr", Payload: addrPayload(a, a, b)})
+			}
+		}
+	})
+
+	conn, err := net.Dial("tcp", net.JoinHostPort(ip, port))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Stats are read while refreshing, to count the dropped duplicates
+	dropped := make(chan int)
+	stop := make(chan bool)
+	go func() {
+		total := 0
+		for {
+			select {
+			case s := <-chstatcounter:
+				if s.name == "addr_dedup" {
+					total += s.value
+				}
+			case <-stop:
+				for len(chstatcounter) > 0 {
+					if s := <-chstatcounter; s.name == "addr_dedup" {
+						total += s.value
+					}
+				}
+				dropped <- total
+				return
+			}
+		}
+	}()
+
+	upd := refreshNode(Node{Conn: conn}, nil)
+	close(stop)
+
+	// The mock node stops when the connection is closed
+	conn.Close()
+	<-handled
+
+	// The reply to each of the 3 getaddr has one duplicate
+	if len(upd.Addresses) != 6 {
+		t.Error("Expected 6 addresses got ", len(upd.Addresses))
+	}
+	if total := <-dropped; total != 3 {
+		t.Error("Expected 3 dropped duplicates got ", total)
+	}
+}